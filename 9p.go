@@ -1,6 +1,9 @@
 package qp
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"strings"
+)
 
 // NineP2000 implements 9P2000 encoding and decoding.
 //
@@ -46,14 +49,48 @@ var NineP2000 = nineP2000{}
 
 // Tag is a unique identifier for a request. It is echoed by the response. It
 // is the responsibility of the client to ensure that it is unique among all
-// current requests.
+// current requests. A raw tag converts to a Tag with Tag(v), and back with
+// Uint16.
 type Tag uint16
 
+// Uint16 returns the tag as a raw uint16.
+func (t Tag) Uint16() uint16 {
+	return uint16(t)
+}
+
 // GetTag is a convenience method to retrieve the tag without type asserting.
 func (t Tag) GetTag() Tag {
 	return t
 }
 
+// SetTag is a convenience method to set the tag without type asserting.
+func (t *Tag) SetTag(nt Tag) {
+	*t = nt
+}
+
+// IsNoTag reports whether the tag is NOTAG, which is only used for version
+// negotiation.
+func (t Tag) IsNoTag() bool {
+	return t == NOTAG
+}
+
+// Valid reports whether the tag can identify a request other than a
+// VersionRequest, which is any tag except NOTAG.
+func (t Tag) Valid() bool {
+	return t != NOTAG
+}
+
+// TagFromBody returns the tag of an encoded message body, without decoding the
+// rest of the message. This relies on the tag being the first field of every
+// message in all supported protocols, which must hold for any message added
+// in the future.
+func TagFromBody(b []byte) (Tag, error) {
+	if len(b) < 2 {
+		return NOTAG, ErrPayloadTooShort
+	}
+	return Tag(binary.LittleEndian.Uint16(b[0:2])), nil
+}
+
 // Fid is a "file identifier", and is quite similar in concept to a file
 // descriptor, and is used to keep track of a file and its potential opening
 // mode. The client is responsible for providing a unique Fid to use. The Fid
@@ -78,13 +115,49 @@ type Qid struct {
 	Type QidType
 
 	// Version describes the version of the file. It is usually incremented
-	// every time the file is changed.
+	// every time the file is changed. Clients may cache file content for as
+	// long as the version stays the same, so a changed version invalidates
+	// any cached data.
 	Version uint32
 
 	// Path is a unique identifier for the file within a file server.
 	Path uint64
 }
 
+// NewQid returns a Qid with the provided type, version and path.
+func NewQid(typ QidType, version uint32, path uint64) Qid {
+	return Qid{
+		Type:    typ,
+		Version: version,
+		Path:    path,
+	}
+}
+
+// Equal reports whether two Qids refer to the same version of the same file,
+// comparing all fields.
+func (q Qid) Equal(o Qid) bool {
+	return q.Type == o.Type && q.Version == o.Version && q.Path == o.Path
+}
+
+// QidType returns the Qid type of a file with the mode, which is the top byte
+// of the mode, as on Plan 9. For example, DMDIR becomes QTDIR, and the
+// 9P2000.u DMSYMLINK becomes QTSYMLINK.
+func (m FileMode) QidType() QidType {
+	return QidType(m >> 24)
+}
+
+// Perm returns the permission bits of the mode, which are the read, write and
+// execute bits for the owner, group and others.
+func (m FileMode) Perm() FileMode {
+	return m & 0777
+}
+
+// FileMode returns the mode bits corresponding to the Qid type, without any
+// permissions. It is the inverse of FileMode.QidType.
+func (qt QidType) FileMode() FileMode {
+	return FileMode(qt) << 24
+}
+
 func (q *Qid) EncodedSize() int { return 13 }
 
 func (q *Qid) Marshal(b []byte) error {
@@ -95,13 +168,9 @@ func (q *Qid) Marshal(b []byte) error {
 }
 
 func (q *Qid) Unmarshal(b []byte) error {
-	if len(b) < 13 {
-		return ErrPayloadTooShort
-	}
-	q.Type = QidType(b[0])
-	q.Version = binary.LittleEndian.Uint32(b[1:5])
-	q.Path = binary.LittleEndian.Uint64(b[5:13])
-	return nil
+	r := fieldReader{b: b}
+	*q = r.qid("")
+	return r.err
 }
 
 // Stat is a directory entry, providing detailed information of a file. It is
@@ -141,6 +210,67 @@ type Stat struct {
 	MUID string
 }
 
+// NewNoTouchStat returns a Stat with all fields set to the "don't touch"
+// values used by WriteStatRequest: all ones for numeric fields, and empty
+// strings. Only the fields that are to be changed should be set on the
+// returned Stat.
+func NewNoTouchStat() Stat {
+	return Stat{
+		Type: ^uint16(0),
+		Dev:  ^uint32(0),
+		Qid: Qid{
+			Type:    ^QidType(0),
+			Version: ^uint32(0),
+			Path:    ^uint64(0),
+		},
+		Mode:   ^FileMode(0),
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+	}
+}
+
+// NameChanged reports whether the Stat of a WriteStatRequest changes the name.
+func (s *Stat) NameChanged() bool { return s.Name != "" }
+
+// UIDChanged reports whether the Stat of a WriteStatRequest changes the owner.
+func (s *Stat) UIDChanged() bool { return s.UID != "" }
+
+// GIDChanged reports whether the Stat of a WriteStatRequest changes the group.
+func (s *Stat) GIDChanged() bool { return s.GID != "" }
+
+// ModeChanged reports whether the Stat of a WriteStatRequest changes the
+// mode. A mode of 0 is a change.
+func (s *Stat) ModeChanged() bool { return s.Mode != ^FileMode(0) }
+
+// AtimeChanged reports whether the Stat of a WriteStatRequest changes the
+// access time.
+func (s *Stat) AtimeChanged() bool { return s.Atime != ^uint32(0) }
+
+// MtimeChanged reports whether the Stat of a WriteStatRequest changes the
+// modification time.
+func (s *Stat) MtimeChanged() bool { return s.Mtime != ^uint32(0) }
+
+// LengthChanged reports whether the Stat of a WriteStatRequest changes the
+// length of the file. A length of 0 is a change, truncating the file.
+func (s *Stat) LengthChanged() bool { return s.Length != ^uint64(0) }
+
+// Validate verifies that the Stat can be encoded consistently, with every
+// string, and the Stat as a whole, fitting in its 16-bit size prefix.
+// ErrStatTooBig is returned otherwise. Marshal does not check this, and
+// silently truncates the size prefixes.
+func (s *Stat) Validate() error {
+	for _, str := range []string{s.Name, s.UID, s.GID, s.MUID} {
+		if len(str) > 0xFFFF {
+			return ErrStatTooBig
+		}
+	}
+	if s.EncodedSize()-2 > 0xFFFF {
+		return ErrStatTooBig
+	}
+	return nil
+}
+
 func (s *Stat) EncodedSize() int {
 	return 2 + 2 + 4 + 13 + 4 + 4 + 4 + 8 + 2 + 2 + 2 + 2 + len(s.Name) + len(s.UID) + len(s.GID) + len(s.MUID)
 }
@@ -190,65 +320,39 @@ func (s *Stat) Marshal(b []byte) error {
 }
 
 func (s *Stat) Unmarshal(b []byte) error {
-	t := 2 + 2 + 4 + 13 + 4 + 4 + 4 + 8 + 2 + 2 + 2 + 2
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-
-	// Well then, let's get started...
-	s.Type = binary.LittleEndian.Uint16(b[2:4])
-	s.Dev = binary.LittleEndian.Uint32(b[4:8])
-
-	// Decode the qid
-	s.Qid.Type = QidType(b[8])
-	s.Qid.Version = binary.LittleEndian.Uint32(b[9:13])
-	s.Qid.Path = binary.LittleEndian.Uint64(b[13:21])
-
-	// More of the main struct
-	s.Mode = FileMode(binary.LittleEndian.Uint32(b[21:25]))
-	s.Atime = binary.LittleEndian.Uint32(b[25:29])
-	s.Mtime = binary.LittleEndian.Uint32(b[29:33])
-	s.Length = binary.LittleEndian.Uint64(b[33:41])
-
-	// And now the variable part.
-
-	// Name
-	idx := 41
-	l := int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	s.Name = string(b[idx+2 : idx+2+l])
-	idx += 2 + l
-
-	// UID
-	l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	t += l
-	if len(b) < t+l {
-		return ErrPayloadTooShort
-	}
-	s.UID = string(b[idx+2 : idx+2+l])
-	idx += 2 + l
+	r := fieldReader{b: b}
+	s.unmarshal(&r)
+	return r.err
+}
 
-	// GID
-	l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	s.GID = string(b[idx+2 : idx+2+l])
-	idx += 2 + l
+func (s *Stat) unmarshal(r *fieldReader) {
+	// The size prefix is implied by the fields, and is not validated here.
+	r.take("", -1, 2)
+	s.Type = r.u16("Type")
+	s.Dev = r.u32("Dev")
+	s.Qid = r.qid("Qid")
+	s.Mode = FileMode(r.u32("Mode"))
+	s.Atime = r.u32("Atime")
+	s.Mtime = r.u32("Mtime")
+	s.Length = r.u64("Length")
+	s.Name = r.str("Name")
+	s.UID = r.str("UID")
+	s.GID = r.str("GID")
+	s.MUID = r.str("MUID")
+}
 
-	// MUID
-	l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	s.MUID = string(b[idx+2 : idx+2+l])
+// StatSize returns the size of a Stat struct as it is encoded in StatResponse
+// and WriteStatRequest. Those messages prefix the Stat with a 2-byte length,
+// while the Stat struct itself begins with another 2-byte size field that
+// does not include its own 2 bytes. The returned size includes both prefixes.
+func StatSize(s Stat) int {
+	return 2 + s.EncodedSize()
+}
 
-	return nil
+// ValidName reports whether name is a valid file name, which must be
+// non-empty, must not be "." or "..", and must not contain a slash.
+func ValidName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
 }
 
 //
@@ -283,22 +387,32 @@ func (vr *VersionRequest) Marshal(b []byte) error {
 }
 
 func (vr *VersionRequest) Unmarshal(b []byte) error {
-	t := 2 + 4 + 2
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	vr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	vr.MessageSize = binary.LittleEndian.Uint32(b[2:6])
+	r := fieldReader{b: b}
+	vr.unmarshal(&r)
+	return r.err
+}
 
-	idx := 6
-	l := int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	vr.Version = string(b[idx+2 : idx+2+l])
+func (vr *VersionRequest) unmarshal(r *fieldReader) {
+	vr.Tag = r.tag()
+	vr.MessageSize = r.u32("MessageSize")
+	vr.Version = r.str("Version")
+}
 
-	return nil
+// NewVersionRequest returns a VersionRequest with the NOTAG tag. The version
+// must be a 9P version string, such as "9P2000", and the message size must
+// permit reads and writes, that is, exceed IOHeaderSize.
+func NewVersionRequest(msize uint32, version string) (*VersionRequest, error) {
+	if !strings.HasPrefix(version, "9P") {
+		return nil, ErrInvalidVersion
+	}
+	if msize <= IOHeaderSize {
+		return nil, ErrMessageTooSmall
+	}
+	return &VersionRequest{
+		Tag:         NOTAG,
+		MessageSize: msize,
+		Version:     version,
+	}, nil
 }
 
 // VersionResponse is used to inform the client of maximum size and version,
@@ -329,22 +443,15 @@ func (vr *VersionResponse) Marshal(b []byte) error {
 }
 
 func (vr *VersionResponse) Unmarshal(b []byte) error {
-	t := 2 + 4 + 2
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	vr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	vr.MessageSize = binary.LittleEndian.Uint32(b[2:6])
-
-	idx := 6
-	l := int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	vr.Version = string(b[idx+2 : idx+2+l])
+	r := fieldReader{b: b}
+	vr.unmarshal(&r)
+	return r.err
+}
 
-	return nil
+func (vr *VersionResponse) unmarshal(r *fieldReader) {
+	vr.Tag = r.tag()
+	vr.MessageSize = r.u32("MessageSize")
+	vr.Version = r.str("Version")
 }
 
 // AuthRequest is used to request and authentication protocol connection from
@@ -385,30 +492,16 @@ func (ar *AuthRequest) Marshal(b []byte) error {
 }
 
 func (ar *AuthRequest) Unmarshal(b []byte) error {
-	t := 2 + 4 + 2 + 2
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	ar.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	ar.AuthFid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-
-	idx := 6
-	l := int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	ar.Username = string(b[idx+2 : idx+2+l])
-	idx += 2 + l
-
-	l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	ar.Service = string(b[idx+2 : idx+2+l])
+	r := fieldReader{b: b}
+	ar.unmarshal(&r)
+	return r.err
+}
 
-	return nil
+func (ar *AuthRequest) unmarshal(r *fieldReader) {
+	ar.Tag = r.tag()
+	ar.AuthFid = r.fid("AuthFid")
+	ar.Username = r.str("Username")
+	ar.Service = r.str("Service")
 }
 
 // AuthResponse is used to acknowledge the authentication protocol connection,
@@ -432,15 +525,14 @@ func (ar *AuthResponse) Marshal(b []byte) error {
 }
 
 func (ar *AuthResponse) Unmarshal(b []byte) error {
-	if len(b) < 2+13 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	ar.unmarshal(&r)
+	return r.err
+}
 
-	ar.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	ar.AuthQid.Type = QidType(b[2])
-	ar.AuthQid.Version = binary.LittleEndian.Uint32(b[3:7])
-	ar.AuthQid.Path = binary.LittleEndian.Uint64(b[7:15])
-	return nil
+func (ar *AuthResponse) unmarshal(r *fieldReader) {
+	ar.Tag = r.tag()
+	ar.AuthQid = r.qid("AuthQid")
 }
 
 // AttachRequest is used to establish a connection to a service as a user, and
@@ -485,31 +577,17 @@ func (ar *AttachRequest) Marshal(b []byte) error {
 }
 
 func (ar *AttachRequest) Unmarshal(b []byte) error {
-	t := 2 + 4 + 4 + 2 + 2
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	ar.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	ar.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	ar.AuthFid = Fid(binary.LittleEndian.Uint32(b[6:10]))
-
-	idx := 10
-	l := int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	ar.Username = string(b[idx+2 : idx+2+l])
-	idx += 2 + l
-
-	l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	ar.Service = string(b[idx+2 : idx+2+l])
+	r := fieldReader{b: b}
+	ar.unmarshal(&r)
+	return r.err
+}
 
-	return nil
+func (ar *AttachRequest) unmarshal(r *fieldReader) {
+	ar.Tag = r.tag()
+	ar.Fid = r.fid("Fid")
+	ar.AuthFid = r.fid("AuthFid")
+	ar.Username = r.str("Username")
+	ar.Service = r.str("Service")
 }
 
 // AttachResponse acknowledges an attach.
@@ -531,15 +609,14 @@ func (ar *AttachResponse) Marshal(b []byte) error {
 }
 
 func (ar *AttachResponse) Unmarshal(b []byte) error {
-	if len(b) < 2+13 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	ar.unmarshal(&r)
+	return r.err
+}
 
-	ar.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	ar.Qid.Type = QidType(b[2])
-	ar.Qid.Version = binary.LittleEndian.Uint32(b[3:7])
-	ar.Qid.Path = binary.LittleEndian.Uint64(b[7:15])
-	return nil
+func (ar *AttachResponse) unmarshal(r *fieldReader) {
+	ar.Tag = r.tag()
+	ar.Qid = r.qid("Qid")
 }
 
 // ErrorResponse is used when the server wants to report and error with the
@@ -562,20 +639,14 @@ func (er *ErrorResponse) Marshal(b []byte) error {
 }
 
 func (er *ErrorResponse) Unmarshal(b []byte) error {
-	t := 2 + 2
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	er.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-
-	l := int(binary.LittleEndian.Uint16(b[2:4]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	er.Error = string(b[4 : 4+l])
+	r := fieldReader{b: b}
+	er.unmarshal(&r)
+	return r.err
+}
 
-	return nil
+func (er *ErrorResponse) unmarshal(r *fieldReader) {
+	er.Tag = r.tag()
+	er.Error = r.str("Error")
 }
 
 // FlushRequest is used to cancel a pending request. The flushed tag can be
@@ -596,12 +667,14 @@ func (fr *FlushRequest) Marshal(b []byte) error {
 }
 
 func (fr *FlushRequest) Unmarshal(b []byte) error {
-	if len(b) < 2+2 {
-		return ErrPayloadTooShort
-	}
-	fr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	fr.OldTag = Tag(binary.LittleEndian.Uint16(b[2:4]))
-	return nil
+	r := fieldReader{b: b}
+	fr.unmarshal(&r)
+	return r.err
+}
+
+func (fr *FlushRequest) unmarshal(r *fieldReader) {
+	fr.Tag = r.tag()
+	fr.OldTag = Tag(r.u16("OldTag"))
 }
 
 // FlushResponse is used to indicate a successful flush. Do note that
@@ -618,11 +691,13 @@ func (fr *FlushResponse) Marshal(b []byte) error {
 }
 
 func (fr *FlushResponse) Unmarshal(b []byte) error {
-	if len(b) < 2 {
-		return ErrPayloadTooShort
-	}
-	fr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	return nil
+	r := fieldReader{b: b}
+	fr.unmarshal(&r)
+	return r.err
+}
+
+func (fr *FlushResponse) unmarshal(r *fieldReader) {
+	fr.Tag = r.tag()
 }
 
 // WalkRequest is used to walk into directories, starting from the current fid.
@@ -666,31 +741,37 @@ func (wr *WalkRequest) Marshal(b []byte) error {
 }
 
 func (wr *WalkRequest) Unmarshal(b []byte) error {
-	t := 2 + 4 + 4 + 2
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	wr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	wr.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	wr.NewFid = Fid(binary.LittleEndian.Uint32(b[6:10]))
+	r := fieldReader{b: b}
+	wr.unmarshal(&r)
+	return r.err
+}
 
-	l := int(binary.LittleEndian.Uint16(b[10:12]))
-	idx := 12
-	wr.Names = make([]string, l)
-	for i := range wr.Names {
-		if len(b) < t+2 {
-			return ErrPayloadTooShort
-		}
+func (wr *WalkRequest) unmarshal(r *fieldReader) {
+	wr.Tag = r.tag()
+	wr.Fid = r.fid("Fid")
+	wr.NewFid = r.fid("NewFid")
+	wr.Names = r.strs("Names")
+}
 
-		l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-		if len(b) < t+2+l {
-			return ErrPayloadTooShort
+// NewWalkRequest returns a WalkRequest. At most MaxWalkElements names are
+// permitted, and every name must be valid as defined by ValidName, with the
+// exception that ".." is permitted. No names means that newfid is to be a
+// clone of fid.
+func NewWalkRequest(tag Tag, fid, newfid Fid, names []string) (*WalkRequest, error) {
+	if len(names) > MaxWalkElements {
+		return nil, ErrTooManyNames
+	}
+	for _, name := range names {
+		if name != ".." && !ValidName(name) {
+			return nil, ErrInvalidName
 		}
-		wr.Names[i] = string(b[idx+2 : idx+2+l])
-		idx += 2 + l
-		t += 2 + l
 	}
-	return nil
+	return &WalkRequest{
+		Tag:    tag,
+		Fid:    fid,
+		NewFid: newfid,
+		Names:  names,
+	}, nil
 }
 
 // WalkResponse returns the qids for each successfully walked element. If the
@@ -719,25 +800,14 @@ func (wr *WalkResponse) Marshal(b []byte) error {
 }
 
 func (wr *WalkResponse) Unmarshal(b []byte) error {
-	t := 2 + 2
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	wr.unmarshal(&r)
+	return r.err
+}
 
-	wr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	l := int(binary.LittleEndian.Uint16(b[2:4]))
-	t += l * 13
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	wr.Qids = make([]Qid, l)
-	idx := 4
-	for i := range wr.Qids {
-		wr.Qids[i].Type = QidType(b[idx])
-		wr.Qids[i].Version = binary.LittleEndian.Uint32(b[idx+1 : idx+5])
-		wr.Qids[i].Path = binary.LittleEndian.Uint64(b[idx+5 : idx+13])
-	}
-	return nil
+func (wr *WalkResponse) unmarshal(r *fieldReader) {
+	wr.Tag = r.tag()
+	wr.Qids = r.qids("Qids")
 }
 
 // OpenRequest is used to open a fid for reading/writing/executing.
@@ -761,14 +831,15 @@ func (or *OpenRequest) Marshal(b []byte) error {
 }
 
 func (or *OpenRequest) Unmarshal(b []byte) error {
-	if len(b) < 2+4+1 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	or.unmarshal(&r)
+	return r.err
+}
 
-	or.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	or.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	or.Mode = OpenMode(b[6])
-	return nil
+func (or *OpenRequest) unmarshal(r *fieldReader) {
+	or.Tag = r.tag()
+	or.Fid = r.fid("Fid")
+	or.Mode = OpenMode(r.u8("Mode"))
 }
 
 // OpenResponse returns the qid of the file, as well as iounit, which is a
@@ -797,16 +868,15 @@ func (or *OpenResponse) Marshal(b []byte) error {
 }
 
 func (or *OpenResponse) Unmarshal(b []byte) error {
-	if len(b) < 2+13+4 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	or.unmarshal(&r)
+	return r.err
+}
 
-	or.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	or.Qid.Type = QidType(b[2])
-	or.Qid.Version = binary.LittleEndian.Uint32(b[3:7])
-	or.Qid.Path = binary.LittleEndian.Uint64(b[7:15])
-	or.IOUnit = binary.LittleEndian.Uint32(b[15:19])
-	return nil
+func (or *OpenResponse) unmarshal(r *fieldReader) {
+	or.Tag = r.tag()
+	or.Qid = r.qid("Qid")
+	or.IOUnit = r.u32("IOUnit")
 }
 
 // CreateRequest tries to create a file in the current directory with the
@@ -847,23 +917,32 @@ func (cr *CreateRequest) Marshal(b []byte) error {
 }
 
 func (cr *CreateRequest) Unmarshal(b []byte) error {
-	t := 2 + 4 + 2 + 4 + 1
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	cr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	cr.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	l := int(binary.LittleEndian.Uint16(b[6:8]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	cr.unmarshal(&r)
+	return r.err
+}
 
-	cr.Name = string(b[8 : 8+l])
-	idx := 8 + l
-	cr.Permissions = FileMode(binary.LittleEndian.Uint32(b[idx : idx+4]))
-	cr.Mode = OpenMode(b[idx+4])
-	return nil
+func (cr *CreateRequest) unmarshal(r *fieldReader) {
+	cr.Tag = r.tag()
+	cr.Fid = r.fid("Fid")
+	cr.Name = r.str("Name")
+	cr.Permissions = FileMode(r.u32("Permissions"))
+	cr.Mode = OpenMode(r.u8("Mode"))
+}
+
+// NewCreateRequest returns a CreateRequest. The name must be valid as defined
+// by ValidName.
+func NewCreateRequest(tag Tag, fid Fid, name string, perm FileMode, mode OpenMode) (*CreateRequest, error) {
+	if !ValidName(name) {
+		return nil, ErrInvalidName
+	}
+	return &CreateRequest{
+		Tag:         tag,
+		Fid:         fid,
+		Name:        name,
+		Permissions: perm,
+		Mode:        mode,
+	}, nil
 }
 
 // CreateResponse returns the qid of the file, as well as iounit, which is a
@@ -884,7 +963,7 @@ func (cr *CreateResponse) EncodedSize() int { return 2 + 13 + 4 }
 
 func (cr *CreateResponse) Marshal(b []byte) error {
 	binary.LittleEndian.PutUint16(b[0:2], uint16(cr.Tag))
-	b[3] = byte(cr.Qid.Type)
+	b[2] = byte(cr.Qid.Type)
 	binary.LittleEndian.PutUint32(b[3:7], cr.Qid.Version)
 	binary.LittleEndian.PutUint64(b[7:15], cr.Qid.Path)
 	binary.LittleEndian.PutUint32(b[15:19], cr.IOUnit)
@@ -892,15 +971,15 @@ func (cr *CreateResponse) Marshal(b []byte) error {
 }
 
 func (cr *CreateResponse) Unmarshal(b []byte) error {
-	if len(b) < 2+13+4 {
-		return ErrPayloadTooShort
-	}
-	cr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	cr.Qid.Type = QidType(b[3])
-	cr.Qid.Version = binary.LittleEndian.Uint32(b[3:7])
-	cr.Qid.Path = binary.LittleEndian.Uint64(b[7:15])
-	cr.IOUnit = binary.LittleEndian.Uint32(b[15:19])
-	return nil
+	r := fieldReader{b: b}
+	cr.unmarshal(&r)
+	return r.err
+}
+
+func (cr *CreateResponse) unmarshal(r *fieldReader) {
+	cr.Tag = r.tag()
+	cr.Qid = r.qid("Qid")
+	cr.IOUnit = r.u32("IOUnit")
 }
 
 // ReadRequest is used to read data from an open file.
@@ -928,14 +1007,34 @@ func (rr *ReadRequest) Marshal(b []byte) error {
 }
 
 func (rr *ReadRequest) Unmarshal(b []byte) error {
-	if len(b) < 2+4+8+4 {
-		return ErrPayloadTooShort
+	r := fieldReader{b: b}
+	rr.unmarshal(&r)
+	return r.err
+}
+
+func (rr *ReadRequest) unmarshal(r *fieldReader) {
+	rr.Tag = r.tag()
+	rr.Fid = r.fid("Fid")
+	rr.Offset = r.u64("Offset")
+	rr.Count = r.u32("Count")
+	if r.err == nil && rr.Offset+uint64(rr.Count) < rr.Offset {
+		r.fail("Offset", -1, ErrOffsetOverflow)
 	}
+}
 
-	rr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	rr.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	rr.Offset = binary.LittleEndian.Uint64(b[6:14])
-	rr.Count = binary.LittleEndian.Uint32(b[14:18])
+// CheckRead verifies that a ReadRequest for count bytes at offset does not
+// overflow the offset, and that the ReadResponse fits in msize. An msize of 0
+// means no limit, as for MaxDataBytes.
+func CheckRead(msize uint32, offset uint64, count uint32) error {
+	if offset+uint64(count) < offset {
+		return ErrOffsetOverflow
+	}
+	if msize == 0 {
+		msize = ^uint32(0)
+	}
+	if msize < ReadOverhead || count > msize-ReadOverhead {
+		return ErrCountTooBig
+	}
 	return nil
 }
 
@@ -943,7 +1042,8 @@ func (rr *ReadRequest) Unmarshal(b []byte) error {
 type ReadResponse struct {
 	Tag
 
-	// Data is the data that was read.
+	// Data is the data that was read. Unmarshal reuses the backing array of
+	// Data if it is large enough.
 	Data []byte
 }
 
@@ -957,18 +1057,17 @@ func (rr *ReadResponse) Marshal(b []byte) error {
 }
 
 func (rr *ReadResponse) Unmarshal(b []byte) error {
-	if len(b) < 2+4 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	rr.unmarshal(&r)
+	return r.err
+}
 
-	rr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	l := int(binary.LittleEndian.Uint32(b[2:6]))
-	if len(b) < 2+4+l {
-		return ErrPayloadTooShort
+func (rr *ReadResponse) unmarshal(r *fieldReader) {
+	rr.Tag = r.tag()
+	rr.Data = r.data("Data", rr.Data)
+	if r.err == nil && r.remaining() > 0 {
+		r.fail("Data", -1, ErrCountMismatch)
 	}
-	rr.Data = make([]byte, l)
-	copy(rr.Data, b[6:6+l])
-	return nil
 }
 
 // WriteRequest is used to write to an open file.
@@ -981,7 +1080,8 @@ type WriteRequest struct {
 	// Offset is used to continue a previous write or to seek.
 	Offset uint64
 
-	// Data is the data to write.
+	// Data is the data to write. Unmarshal reuses the backing array of Data
+	// if it is large enough.
 	Data []byte
 }
 
@@ -999,23 +1099,66 @@ func (wr *WriteRequest) Marshal(b []byte) error {
 }
 
 func (wr *WriteRequest) Unmarshal(b []byte) error {
-	t := 2 + 4 + 8 + 4
-	if len(b) < t {
-		return ErrPayloadTooShort
+	r := fieldReader{b: b}
+	wr.unmarshal(&r)
+	return r.err
+}
+
+func (wr *WriteRequest) unmarshal(r *fieldReader) {
+	wr.Tag = r.tag()
+	wr.Fid = r.fid("Fid")
+	wr.Offset = r.u64("Offset")
+	wr.Data = r.data("Data", wr.Data)
+	switch {
+	case r.err != nil:
+	case r.remaining() > 0:
+		r.fail("Data", -1, ErrCountMismatch)
+	case wr.Offset+uint64(len(wr.Data)) < wr.Offset:
+		r.fail("Offset", -1, ErrOffsetOverflow)
 	}
+}
 
-	wr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	wr.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	wr.Offset = binary.LittleEndian.Uint64(b[6:14])
+// CheckWrite verifies that a WriteRequest for count bytes at offset does not
+// overflow the offset, and that the WriteRequest fits in msize. An msize of 0
+// means no limit, as for MaxDataBytes.
+func CheckWrite(msize uint32, offset uint64, count uint32) error {
+	if offset+uint64(count) < offset {
+		return ErrOffsetOverflow
+	}
+	if msize == 0 {
+		msize = ^uint32(0)
+	}
+	if msize < WriteOverhead || count > msize-WriteOverhead {
+		return ErrCountTooBig
+	}
+	return nil
+}
 
-	l := int(binary.LittleEndian.Uint32(b[14:18]))
-	if len(b) < t+l {
-		return ErrPayloadTooShort
+// MaxDataBytes returns the largest amount of data that fits in a single
+// message of the provided type for msize. For Rread, it is the data of the
+// response, and for Tread, the largest count that can be requested, which is
+// the same. For Twrite, it is the data of the request. 0 is returned for
+// other message types, and if msize is too small for the message. An msize of
+// 0 means no limit, as for the Encoder and Decoder, leaving only the limit of
+// the 4 byte size field.
+func MaxDataBytes(mt MessageType, msize uint32) uint32 {
+	var overhead uint32
+	switch mt {
+	case Tread, Rread:
+		overhead = ReadOverhead
+	case Twrite:
+		overhead = WriteOverhead
+	default:
+		return 0
 	}
 
-	wr.Data = make([]byte, l)
-	copy(wr.Data, b[18:18+l])
-	return nil
+	if msize == 0 {
+		msize = ^uint32(0)
+	}
+	if msize < overhead {
+		return 0
+	}
+	return msize - overhead
 }
 
 // WriteResponse is used to inform of how much data was written.
@@ -1035,13 +1178,14 @@ func (wr *WriteResponse) Marshal(b []byte) error {
 }
 
 func (wr *WriteResponse) Unmarshal(b []byte) error {
-	if len(b) < 2+4 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	wr.unmarshal(&r)
+	return r.err
+}
 
-	wr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	wr.Count = binary.LittleEndian.Uint32(b[2:6])
-	return nil
+func (wr *WriteResponse) unmarshal(r *fieldReader) {
+	wr.Tag = r.tag()
+	wr.Count = r.u32("Count")
 }
 
 // ClunkRequest is used to clear a fid, allowing it to be reused.
@@ -1061,13 +1205,14 @@ func (cr *ClunkRequest) Marshal(b []byte) error {
 }
 
 func (cr *ClunkRequest) Unmarshal(b []byte) error {
-	if len(b) < 2+4 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	cr.unmarshal(&r)
+	return r.err
+}
 
-	cr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	cr.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	return nil
+func (cr *ClunkRequest) unmarshal(r *fieldReader) {
+	cr.Tag = r.tag()
+	cr.Fid = r.fid("Fid")
 }
 
 // ClunkResponse indicates a successful clunk.
@@ -1083,12 +1228,13 @@ func (cr *ClunkResponse) Marshal(b []byte) error {
 }
 
 func (cr *ClunkResponse) Unmarshal(b []byte) error {
-	if len(b) < 2 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	cr.unmarshal(&r)
+	return r.err
+}
 
-	cr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	return nil
+func (cr *ClunkResponse) unmarshal(r *fieldReader) {
+	cr.Tag = r.tag()
 }
 
 // RemoveRequest is used to clunk a fid and remove the file if possible.
@@ -1108,13 +1254,14 @@ func (rr *RemoveRequest) Marshal(b []byte) error {
 }
 
 func (rr *RemoveRequest) Unmarshal(b []byte) error {
-	if len(b) < 2+4 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	rr.unmarshal(&r)
+	return r.err
+}
 
-	rr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	rr.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	return nil
+func (rr *RemoveRequest) unmarshal(r *fieldReader) {
+	rr.Tag = r.tag()
+	rr.Fid = r.fid("Fid")
 }
 
 // RemoveResponse indicates a successful clunk, but not necessarily a successful remove.
@@ -1130,12 +1277,13 @@ func (rr *RemoveResponse) Marshal(b []byte) error {
 }
 
 func (rr *RemoveResponse) Unmarshal(b []byte) error {
-	if len(b) < 2 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	rr.unmarshal(&r)
+	return r.err
+}
 
-	rr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	return nil
+func (rr *RemoveResponse) unmarshal(r *fieldReader) {
+	rr.Tag = r.tag()
 }
 
 // StatRequest is used to retrieve the Stat struct of a file
@@ -1155,13 +1303,14 @@ func (sr *StatRequest) Marshal(b []byte) error {
 }
 
 func (sr *StatRequest) Unmarshal(b []byte) error {
-	if len(b) < 2+4 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	sr.unmarshal(&r)
+	return r.err
+}
 
-	sr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	sr.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	return nil
+func (sr *StatRequest) unmarshal(r *fieldReader) {
+	sr.Tag = r.tag()
+	sr.Fid = r.fid("Fid")
 }
 
 // StatResponse contains the Stat struct of a file.
@@ -1183,12 +1332,16 @@ func (sr *StatResponse) Marshal(b []byte) error {
 }
 
 func (sr *StatResponse) Unmarshal(b []byte) error {
-	if len(b) < 2+2 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	sr.unmarshal(&r)
+	return r.err
+}
 
-	sr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	return sr.Stat.Unmarshal(b[4:])
+func (sr *StatResponse) unmarshal(r *fieldReader) {
+	sr.Tag = r.tag()
+	// The size prefix of the stat is validated by Strict decoders.
+	r.take("Stat", -1, 2)
+	r.nested("Stat", sr.Stat.unmarshal)
 }
 
 // WriteStatRequest attempts to apply a Stat struct to a file. This requires a
@@ -1221,13 +1374,17 @@ func (wsr *WriteStatRequest) Marshal(b []byte) error {
 }
 
 func (wsr *WriteStatRequest) Unmarshal(b []byte) error {
-	if len(b) < 2+4+2 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	wsr.unmarshal(&r)
+	return r.err
+}
 
-	wsr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	wsr.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	return wsr.Stat.Unmarshal(b[8:])
+func (wsr *WriteStatRequest) unmarshal(r *fieldReader) {
+	wsr.Tag = r.tag()
+	wsr.Fid = r.fid("Fid")
+	// The size prefix of the stat is validated by Strict decoders.
+	r.take("Stat", -1, 2)
+	r.nested("Stat", wsr.Stat.unmarshal)
 }
 
 // WriteStatResponse indicates a successful application of a Stat structure.
@@ -1243,9 +1400,11 @@ func (wsr *WriteStatResponse) Marshal(b []byte) error {
 }
 
 func (wsr *WriteStatResponse) Unmarshal(b []byte) error {
-	if len(b) < 2 {
-		return ErrPayloadTooShort
-	}
-	wsr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	return nil
+	r := fieldReader{b: b}
+	wsr.unmarshal(&r)
+	return r.err
+}
+
+func (wsr *WriteStatResponse) unmarshal(r *fieldReader) {
+	wsr.Tag = r.tag()
 }
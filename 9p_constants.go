@@ -10,6 +10,15 @@ const (
 
 	// WriteOverhead is the total overhead in bytes for a 9P2000 write request.
 	WriteOverhead = HeaderSize + 2 + 4 + 8 + 4
+
+	// IOHeaderSize is the largest overhead of ReadOverhead and WriteOverhead.
+	// Limiting reads and writes to the message size minus IOHeaderSize ensures
+	// that both the request and the response fit in a message.
+	IOHeaderSize = WriteOverhead
+
+	// MaxWalkElements is the maximum amount of names in a WalkRequest, and of
+	// qids in a WalkResponse.
+	MaxWalkElements = 16
 )
 
 // Version is the 9P2000 version string.
@@ -91,3 +100,21 @@ const (
 	QTAPPEND QidType = 0x40
 	QTDIR    QidType = 0x80
 )
+
+// nineP2000Pairs lists the request and response types of 9P2000. Rerror, which
+// has no request, is not included.
+var nineP2000Pairs = []typePair{
+	{"version", Tversion, Rversion},
+	{"auth", Tauth, Rauth},
+	{"attach", Tattach, Rattach},
+	{"flush", Tflush, Rflush},
+	{"walk", Twalk, Rwalk},
+	{"open", Topen, Ropen},
+	{"create", Tcreate, Rcreate},
+	{"read", Tread, Rread},
+	{"write", Twrite, Rwrite},
+	{"clunk", Tclunk, Rclunk},
+	{"remove", Tremove, Rremove},
+	{"stat", Tstat, Rstat},
+	{"wstat", Twstat, Rwstat},
+}
@@ -2,7 +2,10 @@ package qp
 
 import (
 	"bytes"
+	"encoding/binary"
+	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -375,3 +378,633 @@ func TestReencode(t *testing.T) {
 		reencode(i, tt.input, tt.reference, t, NineP2000)
 	}
 }
+
+// TestStatSize verifies the double length prefix of Stat structs in
+// StatResponse and WriteStatRequest against a known-good encoding, laid out
+// as Plan 9's convD2M does it.
+func TestStatSize(t *testing.T) {
+	s := Stat{
+		Type:  'M',
+		Qid:   Qid{Type: QTDIR, Path: 0x1234},
+		Mode:  DMDIR | 0775,
+		Atime: 1000000000,
+		Mtime: 1000000000,
+		Name:  "usr",
+		UID:   "glenda",
+		GID:   "glenda",
+		MUID:  "glenda",
+	}
+
+	stat := []byte{
+		0x44, 0x0, // size
+		0x4d, 0x0, // type
+		0x0, 0x0, 0x0, 0x0, // dev
+		0x80, 0x0, 0x0, 0x0, 0x0, 0x34, 0x12, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // qid
+		0xfd, 0x1, 0x0, 0x80, // mode
+		0x0, 0xca, 0x9a, 0x3b, // atime
+		0x0, 0xca, 0x9a, 0x3b, // mtime
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // length
+		0x3, 0x0, 'u', 's', 'r', // name
+		0x6, 0x0, 'g', 'l', 'e', 'n', 'd', 'a', // uid
+		0x6, 0x0, 'g', 'l', 'e', 'n', 'd', 'a', // gid
+		0x6, 0x0, 'g', 'l', 'e', 'n', 'd', 'a', // muid
+	}
+
+	if StatSize(s) != 2+len(stat) {
+		t.Errorf("StatSize returned %d, expected %d", StatSize(s), 2+len(stat))
+	}
+
+	tests := []struct {
+		input     Message
+		reference []byte
+	}{
+		{
+			&StatResponse{Tag: 1, Stat: s},
+			append([]byte{0x4f, 0x0, 0x0, 0x0, 0x7d, 0x1, 0x0, 0x46, 0x0}, stat...),
+		}, {
+			&WriteStatRequest{Tag: 1, Fid: 2, Stat: s},
+			append([]byte{0x53, 0x0, 0x0, 0x0, 0x7e, 0x1, 0x0, 0x2, 0x0, 0x0, 0x0, 0x46, 0x0}, stat...),
+		},
+	}
+
+	for i, tt := range tests {
+		buf := new(bytes.Buffer)
+		e := Encoder{
+			Protocol:    NineP2000,
+			Writer:      buf,
+			MessageSize: 1024,
+		}
+		if err := e.WriteMessage(tt.input); err != nil {
+			t.Fatalf("test %d: unable to encode %T: %v", i, tt.input, err)
+		}
+		if bytes.Compare(buf.Bytes(), tt.reference) != 0 {
+			t.Errorf("test %d: encoded %T did not match reference.\n\tExpected: %v\n\tGot:      %v", i, tt.input, tt.reference, buf.Bytes())
+		}
+
+		d := Decoder{
+			Protocol:    NineP2000,
+			Reader:      buf,
+			MessageSize: 1024,
+		}
+		m, err := d.ReadMessage()
+		if err != nil {
+			t.Fatalf("test %d: unable to decode %T: %v", i, tt.input, err)
+		}
+		if !CompareMarshallables(tt.input, m) {
+			t.Errorf("test %d: %T did not decode correctly\n\tExpected: %#v\n\tGot:      %#v", i, tt.input, tt.input, m)
+		}
+	}
+}
+
+func TestQid(t *testing.T) {
+	q := NewQid(QTDIR, 3, 1<<40)
+	if q.Type != QTDIR || q.Version != 3 || q.Path != 1<<40 {
+		t.Errorf("NewQid constructed wrong Qid: %#v", q)
+	}
+
+	tests := []struct {
+		a, b  Qid
+		equal bool
+	}{
+		{NewQid(QTDIR, 3, 1<<40), q, true},
+		{NewQid(QTFILE, 3, 1<<40), q, false},
+		{NewQid(QTDIR, 4, 1<<40), q, false},
+		{NewQid(QTDIR, 3, 1), q, false},
+	}
+
+	for i, tt := range tests {
+		if tt.a.Equal(tt.b) != tt.equal {
+			t.Errorf("test %d: expected Equal to return %t for %#v and %#v", i, tt.equal, tt.a, tt.b)
+		}
+	}
+}
+
+func TestTagUint16(t *testing.T) {
+	for _, v := range []uint16{0, 1, 0x1234, 0xFFFE, 0xFFFF} {
+		if got := Tag(v).Uint16(); got != v {
+			t.Errorf("%#x: round trip returned %#x", v, got)
+		}
+	}
+	if NOTAG != Tag(0xFFFF) || NOTAG.Uint16() != 0xFFFF {
+		t.Errorf("NOTAG is %#x, expected 0xFFFF", NOTAG.Uint16())
+	}
+}
+
+func TestTagFromBody(t *testing.T) {
+	var tests []MessageTestEntry
+	tests = append(tests, MessageTestData...)
+	tests = append(tests, MessageTestDataDotu...)
+	tests = append(tests, MessageTestDataDote...)
+
+	for i, tt := range tests {
+		tag, err := TagFromBody(tt.reference)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if tag != tt.input.(Tagged).GetTag() {
+			t.Errorf("test %d: expected tag %d for %T, got %d", i, tt.input.(Tagged).GetTag(), tt.input, tag)
+		}
+	}
+
+	if _, err := TagFromBody([]byte{1}); err != ErrPayloadTooShort {
+		t.Errorf("expected ErrPayloadTooShort, got %v", err)
+	}
+}
+
+func TestUnmarshalReusesData(t *testing.T) {
+	encode := func(m Message) []byte {
+		b := make([]byte, m.EncodedSize())
+		if err := m.Marshal(b); err != nil {
+			t.Fatalf("unable to encode %T: %v", m, err)
+		}
+		return b
+	}
+
+	tests := []struct {
+		a, b Message
+		data func(Message) []byte
+	}{
+		{
+			&ReadResponse{Data: []byte("hello world")},
+			&ReadResponse{Data: []byte("goodbye")},
+			func(m Message) []byte { return m.(*ReadResponse).Data },
+		},
+		{
+			&WriteRequest{Data: []byte("hello world")},
+			&WriteRequest{Data: []byte("goodbye")},
+			func(m Message) []byte { return m.(*WriteRequest).Data },
+		},
+		{
+			&SimpleReadResponseDote{Data: []byte("hello world")},
+			&SimpleReadResponseDote{Data: []byte("goodbye")},
+			func(m Message) []byte { return m.(*SimpleReadResponseDote).Data },
+		},
+		{
+			&SimpleWriteRequestDote{Data: []byte("hello world")},
+			&SimpleWriteRequestDote{Data: []byte("goodbye")},
+			func(m Message) []byte { return m.(*SimpleWriteRequestDote).Data },
+		},
+	}
+
+	for i, tt := range tests {
+		m := ConstructNewMarshallable(tt.a).(Message)
+		if err := m.Unmarshal(encode(tt.a)); err != nil {
+			t.Fatalf("test %d: unable to decode: %v", i, err)
+		}
+		first := tt.data(m)
+
+		if err := m.Unmarshal(encode(tt.b)); err != nil {
+			t.Fatalf("test %d: unable to decode: %v", i, err)
+		}
+		second := tt.data(m)
+
+		if string(second) != string(tt.data(tt.b)) {
+			t.Errorf("test %d: expected %q, got %q", i, tt.data(tt.b), second)
+		}
+		if &first[0] != &second[0] {
+			t.Errorf("test %d: backing array was not reused", i)
+		}
+	}
+}
+
+func BenchmarkUnmarshalReadResponse(b *testing.B) {
+	in := &ReadResponse{Data: make([]byte, 8192)}
+	buf := make([]byte, in.EncodedSize())
+	in.Marshal(buf)
+
+	m := &ReadResponse{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := m.Unmarshal(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCheckReadWrite(t *testing.T) {
+	const msize = 8192
+	tests := []struct {
+		offset uint64
+		count  uint32
+		read   error
+		write  error
+	}{
+		{0, msize - IOHeaderSize, nil, nil},
+		{0, msize - ReadOverhead, nil, ErrCountTooBig},
+		{0, msize - ReadOverhead + 1, ErrCountTooBig, ErrCountTooBig},
+		{1<<64 - 1, 0, nil, nil},
+		{1<<64 - 1, 1, ErrOffsetOverflow, ErrOffsetOverflow},
+		{1<<64 - 100, 200, ErrOffsetOverflow, ErrOffsetOverflow},
+	}
+
+	for i, tt := range tests {
+		if err := CheckRead(msize, tt.offset, tt.count); err != tt.read {
+			t.Errorf("test %d: expected read error %v, got %v", i, tt.read, err)
+		}
+		if err := CheckWrite(msize, tt.offset, tt.count); err != tt.write {
+			t.Errorf("test %d: expected write error %v, got %v", i, tt.write, err)
+		}
+	}
+
+	if err := CheckRead(ReadOverhead-1, 0, 0); err != ErrCountTooBig {
+		t.Errorf("expected ErrCountTooBig for tiny message size, got %v", err)
+	}
+
+	// An msize of 0 permits any count that MaxDataBytes permits.
+	if err := CheckRead(0, 0, MaxDataBytes(Tread, 0)); err != nil {
+		t.Errorf("expected no read limit for msize 0, got %v", err)
+	}
+	if err := CheckWrite(0, 0, MaxDataBytes(Twrite, 0)); err != nil {
+		t.Errorf("expected no write limit for msize 0, got %v", err)
+	}
+	if err := CheckWrite(0, 0, MaxDataBytes(Twrite, 0)+1); err != ErrCountTooBig {
+		t.Errorf("expected ErrCountTooBig beyond the size field, got %v", err)
+	}
+
+	// Decoding rejects requests that overflow the offset.
+	rr := &ReadRequest{Offset: 1<<64 - 1, Count: 2}
+	b := make([]byte, rr.EncodedSize())
+	rr.Marshal(b)
+	if err := (&ReadRequest{}).Unmarshal(b); err != ErrOffsetOverflow {
+		t.Errorf("expected ErrOffsetOverflow decoding read, got %v", err)
+	}
+
+	wr := &WriteRequest{Offset: 1<<64 - 1, Data: []byte("hi")}
+	b = make([]byte, wr.EncodedSize())
+	wr.Marshal(b)
+	if err := (&WriteRequest{}).Unmarshal(b); err != ErrOffsetOverflow {
+		t.Errorf("expected ErrOffsetOverflow decoding write, got %v", err)
+	}
+}
+
+func TestCountMismatch(t *testing.T) {
+	// Marshal derives the count from the data.
+	rr := &ReadResponse{Tag: 1, Data: []byte("hello")}
+	b := make([]byte, rr.EncodedSize())
+	rr.Marshal(b)
+	if c := binary.LittleEndian.Uint32(b[2:6]); c != 5 {
+		t.Errorf("expected count 5, got %d", c)
+	}
+
+	tests := []struct {
+		count uint32
+		err   error
+	}{
+		{5, nil},
+		{4, ErrCountMismatch},
+		{0, ErrCountMismatch},
+		{6, ErrPayloadTooShort},
+	}
+	for i, tt := range tests {
+		binary.LittleEndian.PutUint32(b[2:6], tt.count)
+		if err := (&ReadResponse{}).Unmarshal(b); err != tt.err {
+			t.Errorf("test %d: expected %v decoding read response, got %v", i, tt.err, err)
+		}
+	}
+
+	wr := &WriteRequest{Tag: 1, Fid: 2, Offset: 3, Data: []byte("hello")}
+	b = make([]byte, wr.EncodedSize())
+	wr.Marshal(b)
+	for i, tt := range tests {
+		binary.LittleEndian.PutUint32(b[14:18], tt.count)
+		if err := (&WriteRequest{}).Unmarshal(b); err != tt.err {
+			t.Errorf("test %d: expected %v decoding write request, got %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestConstructors(t *testing.T) {
+	versionTests := []struct {
+		msize   uint32
+		version string
+		err     error
+	}{
+		{8192, Version, nil},
+		{8192, "9P2000.u", nil},
+		{8192, "", ErrInvalidVersion},
+		{8192, "HTTP/1.1", ErrInvalidVersion},
+		{IOHeaderSize, Version, ErrMessageTooSmall},
+	}
+	for i, tt := range versionTests {
+		m, err := NewVersionRequest(tt.msize, tt.version)
+		if err != tt.err {
+			t.Errorf("version test %d: expected error %v, got %v", i, tt.err, err)
+		}
+		if err == nil && (m.Tag != NOTAG || m.MessageSize != tt.msize || m.Version != tt.version) {
+			t.Errorf("version test %d: constructed wrong message: %#v", i, m)
+		}
+	}
+
+	walkTests := []struct {
+		names []string
+		err   error
+	}{
+		{nil, nil},
+		{[]string{"usr", "glenda", ".."}, nil},
+		{make([]string, MaxWalkElements+1), ErrTooManyNames},
+		{[]string{"usr", ""}, ErrInvalidName},
+		{[]string{"."}, ErrInvalidName},
+		{[]string{"usr/glenda"}, ErrInvalidName},
+	}
+	for i, tt := range walkTests {
+		m, err := NewWalkRequest(3, 1, 2, tt.names)
+		if err != tt.err {
+			t.Errorf("walk test %d: expected error %v, got %v", i, tt.err, err)
+		}
+		if err == nil && (m.Tag != 3 || m.Fid != 1 || m.NewFid != 2 || len(m.Names) != len(tt.names)) {
+			t.Errorf("walk test %d: constructed wrong message: %#v", i, m)
+		}
+	}
+
+	createTests := []struct {
+		name string
+		err  error
+	}{
+		{"lib", nil},
+		{"", ErrInvalidName},
+		{"..", ErrInvalidName},
+		{"a/b", ErrInvalidName},
+	}
+	for i, tt := range createTests {
+		m, err := NewCreateRequest(3, 1, tt.name, 0644, OWRITE)
+		if err != tt.err {
+			t.Errorf("create test %d: expected error %v, got %v", i, tt.err, err)
+		}
+		if err == nil && (m.Tag != 3 || m.Fid != 1 || m.Name != tt.name || m.Permissions != 0644 || m.Mode != OWRITE) {
+			t.Errorf("create test %d: constructed wrong message: %#v", i, m)
+		}
+	}
+}
+
+func TestModeConversion(t *testing.T) {
+	// Modes composed from the DM bits defined in stat(5) and the 9P2000.u
+	// specification, not captured from real servers.
+	tests := []struct {
+		name string
+		mode FileMode
+		qt   QidType
+		perm FileMode
+	}{
+		{"file", 0x000001a4, QTFILE, 0644},
+		{"directory", 0x800001ed, QTDIR, 0755},
+		{"append-only", 0x400001b6, QTAPPEND, 0666},
+		{"exclusive", 0x20000180, QTEXCL, 0600},
+		{"append-only exclusive", 0x600001b6, QTAPPEND | QTEXCL, 0666},
+		{"auth", 0x08000180, QTAUTH, 0600},
+		{"temporary", 0x04000180, QTTMP, 0600},
+		{"mount", 0x10000124, QTMOUNT, 0444},
+		{"symlink", 0x020001ff, QTSYMLINK, 0777},
+		{"hard link", 0x010001a4, QTLINK, 0644},
+		{"setuid", 0x000801ed, QTFILE, 0755},
+	}
+
+	for i, tt := range tests {
+		if qt := tt.mode.QidType(); qt != tt.qt {
+			t.Errorf("test %d (%s): expected qid type %#x, got %#x", i, tt.name, tt.qt, qt)
+		}
+		if perm := tt.mode.Perm(); perm != tt.perm {
+			t.Errorf("test %d (%s): expected permissions %#o, got %#o", i, tt.name, tt.perm, perm)
+		}
+		if m := tt.qt.FileMode(); m.QidType() != tt.qt || m&^0xFF000000 != 0 {
+			t.Errorf("test %d (%s): qid type %#x did not convert back from mode %#x", i, tt.name, tt.qt, m)
+		}
+	}
+}
+
+func TestStatValidate(t *testing.T) {
+	s := Stat{Name: "glenda.txt", UID: "glenda", GID: "glenda"}
+	if err := s.Validate(); err != nil {
+		t.Errorf("expected valid stat, got %v", err)
+	}
+	s.Name = strings.Repeat("a", 0x10000)
+	if err := s.Validate(); err != ErrStatTooBig {
+		t.Errorf("expected ErrStatTooBig for long name, got %v", err)
+	}
+	s.Name = strings.Repeat("a", 0xFFFF)
+	if err := s.Validate(); err != ErrStatTooBig {
+		t.Errorf("expected ErrStatTooBig for large stat, got %v", err)
+	}
+
+	sr := &StatResponse{Tag: 1, Stat: Stat{Name: "glenda.txt", UID: "glenda", GID: "glenda", MUID: "glenda"}}
+	b := make([]byte, sr.EncodedSize())
+	sr.Marshal(b)
+
+	tests := []struct {
+		off   int
+		delta int
+	}{
+		{2, 0},
+		{2, -1},
+		{4, -1},
+		{4, 1},
+	}
+	for i, tt := range tests {
+		// Frame the body, with one of the size prefixes of the stat changed.
+		c := make([]byte, HeaderSize, HeaderSize+len(b))
+		binary.LittleEndian.PutUint32(c[0:4], uint32(HeaderSize+len(b)))
+		c[4] = byte(Rstat)
+		c = append(c, b...)
+		p := c[HeaderSize+tt.off:]
+		binary.LittleEndian.PutUint16(p, binary.LittleEndian.Uint16(p)+uint16(tt.delta))
+		for _, strict := range []bool{false, true} {
+			var expected error
+			if strict && tt.delta != 0 {
+				expected = ErrStatSizeMismatch
+			}
+			d := &Decoder{Protocol: NineP2000, Reader: bytes.NewReader(c), MessageSize: 1024, Strict: strict}
+			if _, err := d.ReadMessage(); err != expected {
+				t.Errorf("test %d: strict %t: expected %v, got %v", i, strict, expected, err)
+			}
+		}
+	}
+}
+
+func TestNoTouchStat(t *testing.T) {
+	s := NewNoTouchStat()
+	s.Name = "glenda.txt"
+	req := &WriteStatRequest{Tag: 1, Fid: 2, Stat: s}
+
+	// The sentinels must survive a round trip.
+	b := make([]byte, req.EncodedSize())
+	if err := req.Marshal(b); err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	var m WriteStatRequest
+	if err := m.Unmarshal(b); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+
+	changed := map[string]bool{
+		"Name":   m.Stat.NameChanged(),
+		"UID":    m.Stat.UIDChanged(),
+		"GID":    m.Stat.GIDChanged(),
+		"Mode":   m.Stat.ModeChanged(),
+		"Atime":  m.Stat.AtimeChanged(),
+		"Mtime":  m.Stat.MtimeChanged(),
+		"Length": m.Stat.LengthChanged(),
+	}
+	for field, c := range changed {
+		if c != (field == "Name") {
+			t.Errorf("%s: expected changed to be %t, got %t", field, field == "Name", c)
+		}
+	}
+
+	// Zero values are changes, not sentinels.
+	s = NewNoTouchStat()
+	s.Mode = 0
+	s.Length = 0
+	if !s.ModeChanged() || !s.LengthChanged() {
+		t.Errorf("expected zero mode and length to be changes")
+	}
+}
+
+func TestTypes(t *testing.T) {
+	tests := []struct {
+		name  string
+		p     Protocol
+		count int
+	}{
+		{"9P2000", NineP2000, 27},
+		{"9P2000.u", NineP2000Dotu, 27},
+		{"9P2000.e", NineP2000Dote, 33},
+	}
+
+	for _, tt := range tests {
+		tl, ok := tt.p.(TypeLister)
+		if !ok {
+			t.Errorf("%s: protocol does not implement TypeLister", tt.name)
+			continue
+		}
+
+		types := tl.Types()
+		if len(types) != tt.count {
+			t.Errorf("%s: expected %d types, got %d", tt.name, tt.count, len(types))
+		}
+
+		listed := make(map[MessageType]bool)
+		for _, mt := range types {
+			listed[mt] = true
+			if _, named := messageTypeNames[mt]; !named {
+				t.Errorf("%s: listed type %v has no name", tt.name, mt)
+			}
+			m, err := tt.p.Message(mt)
+			if err != nil {
+				t.Errorf("%s: listed type %v has no message: %v", tt.name, mt, err)
+				continue
+			}
+			if mt2, err := tt.p.MessageType(m); err != nil || mt2 != mt {
+				t.Errorf("%s: message of %v reports type %v (err: %v)", tt.name, mt, mt2, err)
+			}
+		}
+
+		// Every type the protocol knows must be listed.
+		for i := 0; i < 256; i++ {
+			mt := MessageType(i)
+			if _, err := tt.p.Message(mt); err == nil && !listed[mt] {
+				t.Errorf("%s: type %v is not listed", tt.name, mt)
+			}
+		}
+	}
+}
+
+func TestMaxDataBytes(t *testing.T) {
+	tests := []struct {
+		mt       MessageType
+		msize    uint32
+		expected uint32
+	}{
+		{Tread, 8192, 8192 - 11},
+		{Rread, 8192, 8192 - 11},
+		{Twrite, 8192, 8192 - 23},
+		{Twalk, 8192, 0},
+		{Rread, 11, 0},
+		{Twrite, 22, 0},
+		{Rread, 0, 1<<32 - 1 - 11},
+		{Twrite, 0, 1<<32 - 1 - 23},
+	}
+
+	for i, tt := range tests {
+		n := MaxDataBytes(tt.mt, tt.msize)
+		if n != tt.expected {
+			t.Errorf("test %d: expected %d, got %d", i, tt.expected, n)
+		}
+	}
+
+	// A maximal message must fit exactly in msize.
+	rr := &ReadResponse{Data: make([]byte, MaxDataBytes(Rread, 8192))}
+	if size := HeaderSize + rr.EncodedSize(); size != 8192 {
+		t.Errorf("maximal ReadResponse is %d bytes, expected 8192", size)
+	}
+	wr := &WriteRequest{Data: make([]byte, MaxDataBytes(Twrite, 8192))}
+	if size := HeaderSize + wr.EncodedSize(); size != 8192 {
+		t.Errorf("maximal WriteRequest is %d bytes, expected 8192", size)
+	}
+}
+
+// randomValue fills v with random values, respecting the limits of the
+// protocol: strings are printable and short, and slices hold at most
+// MaxWalkElements elements, or up to 256 bytes.
+func randomValue(r *rand.Rand, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			randomValue(r, v.Field(i))
+		}
+	case reflect.String:
+		b := make([]byte, r.Intn(32))
+		for i := range b {
+			b[i] = byte('!' + r.Intn('~'-'!'))
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		n := r.Intn(MaxWalkElements + 1)
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			n = r.Intn(257)
+		}
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		for i := 0; i < n; i++ {
+			randomValue(r, v.Index(i))
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			randomValue(r, v.Index(i))
+		}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(r.Uint64())
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+		v.SetInt(r.Int63())
+	case reflect.Bool:
+		v.SetBool(r.Intn(2) == 1)
+	default:
+		panic("unsupported kind " + v.Kind().String())
+	}
+}
+
+func TestRandomRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, p := range []Protocol{NineP2000, NineP2000Dotu, NineP2000Dote} {
+		for mt := 0; mt < 256; mt++ {
+			if _, err := p.Message(MessageType(mt)); err != nil {
+				continue
+			}
+			for i := 0; i < 100; i++ {
+				m, _ := p.Message(MessageType(mt))
+				randomValue(r, reflect.ValueOf(m).Elem())
+
+				var buf bytes.Buffer
+				if err := (&Encoder{Protocol: p, Writer: &buf}).WriteMessage(m); err != nil {
+					t.Fatalf("%T: encode failed: %v\n\t%#v", m, err, m)
+				}
+				d := &Decoder{Protocol: p, Reader: &buf, MessageSize: 1 << 20, Strict: true}
+				got, err := d.ReadMessage()
+				if err != nil {
+					t.Fatalf("%T: decode failed: %v\n\t%#v", m, err, m)
+				}
+				if !Equal(got, m) {
+					t.Fatalf("%T: round trip differs:\n%s", m, Diff(got, m))
+				}
+			}
+		}
+	}
+}
@@ -2,8 +2,21 @@ package qp
 
 import "errors"
 
-// ErrUnknownMessageType is used to indicate an unknown type of message.
-var ErrUnknownMessageType = errors.New("unknown message type")
+var (
+	// ErrUnknownMessageType is used to indicate an unknown type of message.
+	ErrUnknownMessageType = errors.New("unknown message type")
+
+	// ErrInvalidVersion indicates that a version string is not a 9P version.
+	ErrInvalidVersion = errors.New("invalid version")
+
+	// ErrTooManyNames indicates that a walk has more than MaxWalkElements
+	// names.
+	ErrTooManyNames = errors.New("too many walk names")
+
+	// ErrInvalidName indicates that a file name is empty, "." or "..", or
+	// contains a slash.
+	ErrInvalidName = errors.New("invalid file name")
+)
 
 // nineP2000 implements the conversions for 9P2000.
 type nineP2000 struct{}
@@ -131,3 +144,8 @@ func (nineP2000) MessageType(d Message) (MessageType, error) {
 		return 0, ErrUnknownMessageType
 	}
 }
+
+// Types returns the message types of 9P2000.
+func (nineP2000) Types() []MessageType {
+	return append(pairTypes(nineP2000Pairs), Rerror)
+}
@@ -39,12 +39,14 @@ func (sr *SessionRequestDote) Marshal(b []byte) error {
 }
 
 func (sr *SessionRequestDote) Unmarshal(b []byte) error {
-	if len(b) < 2+8 {
-		return ErrPayloadTooShort
-	}
-	sr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	copy(sr.Key[:], b[2:10])
-	return nil
+	r := fieldReader{b: b}
+	sr.unmarshal(&r)
+	return r.err
+}
+
+func (sr *SessionRequestDote) unmarshal(r *fieldReader) {
+	sr.Tag = r.tag()
+	copy(sr.Key[:], r.take("Key", -1, len(sr.Key)))
 }
 
 // SessionResponseDote is used to indicate a successful session restore.
@@ -60,11 +62,13 @@ func (sr *SessionResponseDote) Marshal(b []byte) error {
 }
 
 func (sr *SessionResponseDote) Unmarshal(b []byte) error {
-	if len(b) < 2 {
-		return ErrPayloadTooShort
-	}
-	sr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	return nil
+	r := fieldReader{b: b}
+	sr.unmarshal(&r)
+	return r.err
+}
+
+func (sr *SessionResponseDote) unmarshal(r *fieldReader) {
+	sr.Tag = r.tag()
 }
 
 // SimpleReadRequestDote is used to quickly read a file. The request is
@@ -104,28 +108,15 @@ func (srr *SimpleReadRequestDote) Marshal(b []byte) error {
 }
 
 func (srr *SimpleReadRequestDote) Unmarshal(b []byte) error {
-	t := 2 + 4 + 2
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	srr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	srr.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	l := int(binary.LittleEndian.Uint16(b[6:8]))
-	idx := 8
-	srr.Names = make([]string, l)
-	for i := range srr.Names {
-		if len(b) < t+2 {
-			return ErrPayloadTooShort
-		}
-		l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-		if len(b) < t+2+l {
-			return ErrPayloadTooShort
-		}
-		srr.Names[i] = string(b[idx+2 : idx+2+l])
-		idx += 2 + l
-		t += 2 + l
-	}
-	return nil
+	r := fieldReader{b: b}
+	srr.unmarshal(&r)
+	return r.err
+}
+
+func (srr *SimpleReadRequestDote) unmarshal(r *fieldReader) {
+	srr.Tag = r.tag()
+	srr.Fid = r.fid("Fid")
+	srr.Names = r.strs("Names")
 }
 
 // SimpleReadResponseDote is used to return the read data.
@@ -147,18 +138,14 @@ func (srr *SimpleReadResponseDote) Marshal(b []byte) error {
 }
 
 func (srr *SimpleReadResponseDote) Unmarshal(b []byte) error {
-	if len(b) < 2+4 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	srr.unmarshal(&r)
+	return r.err
+}
 
-	srr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	l := int(binary.LittleEndian.Uint32(b[2:6]))
-	if len(b) < 2+4+l {
-		return ErrPayloadTooShort
-	}
-	srr.Data = make([]byte, l)
-	copy(srr.Data, b[6:6+l])
-	return nil
+func (srr *SimpleReadResponseDote) unmarshal(r *fieldReader) {
+	srr.Tag = r.tag()
+	srr.Data = r.data("Data", srr.Data)
 }
 
 // SimpleWriteRequestDote is used to quickly create a file if it doesn't
@@ -203,34 +190,16 @@ func (swr *SimpleWriteRequestDote) Marshal(b []byte) error {
 }
 
 func (swr *SimpleWriteRequestDote) Unmarshal(b []byte) error {
-	t := 2 + 4 + 2 + 4
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	swr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	swr.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	l := int(binary.LittleEndian.Uint16(b[6:8]))
-	idx := 8
-	swr.Names = make([]string, l)
-	for i := range swr.Names {
-		if len(b) < t+2 {
-			return ErrPayloadTooShort
-		}
-		l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-		if len(b) < t+2+l {
-			return ErrPayloadTooShort
-		}
-		swr.Names[i] = string(b[idx+2 : idx+2+l])
-		idx += 2 + l
-		t += 2 + l
-	}
-	l = int(binary.LittleEndian.Uint32(b[idx : idx+4]))
-	if len(b) < t+l {
-		return ErrPayloadTooShort
-	}
-	swr.Data = make([]byte, l)
-	copy(swr.Data, b[idx+4:idx+4+l])
-	return nil
+	r := fieldReader{b: b}
+	swr.unmarshal(&r)
+	return r.err
+}
+
+func (swr *SimpleWriteRequestDote) unmarshal(r *fieldReader) {
+	swr.Tag = r.tag()
+	swr.Fid = r.fid("Fid")
+	swr.Names = r.strs("Names")
+	swr.Data = r.data("Data", swr.Data)
 }
 
 // SimpleWriteResponseDote is used to inform of how much data was written.
@@ -249,11 +218,12 @@ func (swr *SimpleWriteResponseDote) Marshal(b []byte) error {
 }
 
 func (swr *SimpleWriteResponseDote) Unmarshal(b []byte) error {
-	if len(b) < 2+4 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	swr.unmarshal(&r)
+	return r.err
+}
 
-	swr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	swr.Count = binary.LittleEndian.Uint32(b[2:6])
-	return nil
+func (swr *SimpleWriteResponseDote) unmarshal(r *fieldReader) {
+	swr.Tag = r.tag()
+	swr.Count = r.u32("Count")
 }
@@ -12,3 +12,11 @@ const (
 	Tswrite
 	Rswrite
 )
+
+// nineP2000DotePairs lists the request and response types that 9P2000.e adds
+// to 9P2000.
+var nineP2000DotePairs = []typePair{
+	{"session", Tsession, Rsession},
+	{"sread", Tsread, Rsread},
+	{"swrite", Tswrite, Rswrite},
+}
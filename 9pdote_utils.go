@@ -43,3 +43,8 @@ func (nineP2000Dote) MessageType(d Message) (MessageType, error) {
 		return NineP2000.MessageType(d)
 	}
 }
+
+// Types returns the message types of 9P2000.e.
+func (nineP2000Dote) Types() []MessageType {
+	return append(NineP2000.Types(), pairTypes(nineP2000DotePairs)...)
+}
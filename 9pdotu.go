@@ -79,6 +79,38 @@ type StatDotu struct {
 	MUIDno uint32
 }
 
+// Validate verifies that the StatDotu can be encoded consistently, like
+// Stat.Validate.
+func (s *StatDotu) Validate() error {
+	for _, str := range []string{s.Name, s.UID, s.GID, s.MUID, s.Extensions} {
+		if len(str) > 0xFFFF {
+			return ErrStatTooBig
+		}
+	}
+	if s.EncodedSize()-2 > 0xFFFF {
+		return ErrStatTooBig
+	}
+	return nil
+}
+
+// Stat returns the 9P2000 fields of the StatDotu as a Stat, dropping the
+// 9P2000.u extensions.
+func (s *StatDotu) Stat() Stat {
+	return Stat{
+		Type:   s.Type,
+		Dev:    s.Dev,
+		Qid:    s.Qid,
+		Mode:   s.Mode,
+		Atime:  s.Atime,
+		Mtime:  s.Mtime,
+		Length: s.Length,
+		Name:   s.Name,
+		UID:    s.UID,
+		GID:    s.GID,
+		MUID:   s.MUID,
+	}
+}
+
 func (s *StatDotu) EncodedSize() int {
 	return 2 + 2 + 4 + 13 + 4 + 4 + 4 + 8 + 2 + 2 + 2 + 2 + 2 + 4 + 4 + 4 +
 	 len(s.Name) + len(s.UID) + len(s.GID) + len(s.MUID) + len(s.Extensions)
@@ -141,78 +173,29 @@ func (s *StatDotu) Marshal(b []byte) error {
 }
 
 func (s *StatDotu) Unmarshal(b []byte) error {
-	t := 2 + 2 + 4 + 13 + 4 + 4 + 4 + 8 + 2 + 2 + 2 + 2 + 2 + 4 + 4 + 4
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-
-	// Well then, let's get started...
-	s.Type = binary.LittleEndian.Uint16(b[2:4])
-	s.Dev = binary.LittleEndian.Uint32(b[4:8])
-
-	// Decode the qid
-	s.Qid.Type = QidType(b[8])
-	s.Qid.Version = binary.LittleEndian.Uint32(b[9:13])
-	s.Qid.Path = binary.LittleEndian.Uint64(b[13:21])
-
-	// More of the main struct
-	s.Mode = FileMode(binary.LittleEndian.Uint32(b[21:25]))
-	s.Atime = binary.LittleEndian.Uint32(b[25:29])
-	s.Mtime = binary.LittleEndian.Uint32(b[29:33])
-	s.Length = binary.LittleEndian.Uint64(b[33:41])
-
-	// And now the variable part.
-
-	// Name
-	idx := 41
-	l := int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	if len(b) < t+l {
-		return ErrPayloadTooShort
-	}
-	s.Name = string(b[idx+2 : idx+2+l])
-	idx += 2 + l
-	t += l
-
-	// UID
-	l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	if len(b) < t+int(l) {
-		return ErrPayloadTooShort
-	}
-	s.UID = string(b[idx+2 : idx+2+l])
-	idx += 2 + l
-	t += l
-
-	// GID
-	l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	if len(b) < t+l {
-		return ErrPayloadTooShort
-	}
-	s.GID = string(b[idx+2 : idx+2+l])
-	idx += 2 + l
-	t += l
-
-	// MUID
-	l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	if len(b) < t+l {
-		return ErrPayloadTooShort
-	}
-	s.MUID = string(b[idx+2 : idx+2+l])
-	idx += 2 + l
-	t += l
-
-	// Extensions
-	l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	if len(b) < t+l {
-		return ErrPayloadTooShort
-	}
-	s.Extensions = string(b[idx+2 : idx+2+l])
-	idx += 2 + l
+	r := fieldReader{b: b}
+	s.unmarshal(&r)
+	return r.err
+}
 
-	// UIDno, GIDno, MUIDno
-	s.UIDno = binary.LittleEndian.Uint32(b[idx : idx+4])
-	s.GIDno = binary.LittleEndian.Uint32(b[idx+4 : idx+8])
-	s.MUIDno = binary.LittleEndian.Uint32(b[idx+8 : idx+12])
-	return nil
+func (s *StatDotu) unmarshal(r *fieldReader) {
+	// The size prefix is implied by the fields, and is not validated here.
+	r.take("", -1, 2)
+	s.Type = r.u16("Type")
+	s.Dev = r.u32("Dev")
+	s.Qid = r.qid("Qid")
+	s.Mode = FileMode(r.u32("Mode"))
+	s.Atime = r.u32("Atime")
+	s.Mtime = r.u32("Mtime")
+	s.Length = r.u64("Length")
+	s.Name = r.str("Name")
+	s.UID = r.str("UID")
+	s.GID = r.str("GID")
+	s.MUID = r.str("MUID")
+	s.Extensions = r.str("Extensions")
+	s.UIDno = r.u32("UIDno")
+	s.GIDno = r.u32("GIDno")
+	s.MUIDno = r.u32("MUIDno")
 }
 
 // AuthRequestDotu is the 9P2000.u version of AuthRequestDotu. It adds UIDno,
@@ -254,30 +237,17 @@ func (ar *AuthRequestDotu) Marshal(b []byte) error {
 }
 
 func (ar *AuthRequestDotu) Unmarshal(b []byte) error {
-	t := 2 + 4 + 2 + 2 + 4
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	ar.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	ar.AuthFid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-
-	l := int(binary.LittleEndian.Uint16(b[6:8]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	ar.Username = string(b[8 : 8+l])
-
-	idx := 8 + l
-	l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	ar.Service = string(b[idx+2 : idx+2+l])
+	r := fieldReader{b: b}
+	ar.unmarshal(&r)
+	return r.err
+}
 
-	ar.UIDno = binary.LittleEndian.Uint32(b[idx+2+l : idx+2+l+4])
-	return nil
+func (ar *AuthRequestDotu) unmarshal(r *fieldReader) {
+	ar.Tag = r.tag()
+	ar.AuthFid = r.fid("AuthFid")
+	ar.Username = r.str("Username")
+	ar.Service = r.str("Service")
+	ar.UIDno = r.u32("UIDno")
 }
 
 // AttachRequestDotu is the 9P2000.u version of AttachRequestDotu. It adds
@@ -324,31 +294,18 @@ func (ar *AttachRequestDotu) Marshal(b []byte) error {
 }
 
 func (ar *AttachRequestDotu) Unmarshal(b []byte) error {
-	t := 2 + 4 + 4 + 2 + 2 + 4
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	ar.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	ar.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	ar.AuthFid = Fid(binary.LittleEndian.Uint32(b[6:10]))
-
-	l := int(binary.LittleEndian.Uint16(b[10:12]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	ar.Username = string(b[12 : 12+l])
-
-	idx := 12 + l
-	l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	ar.Service = string(b[idx+2 : idx+2+l])
+	r := fieldReader{b: b}
+	ar.unmarshal(&r)
+	return r.err
+}
 
-	ar.UIDno = binary.LittleEndian.Uint32(b[idx+2+l : idx+2+l+4])
-	return nil
+func (ar *AttachRequestDotu) unmarshal(r *fieldReader) {
+	ar.Tag = r.tag()
+	ar.Fid = r.fid("Fid")
+	ar.AuthFid = r.fid("AuthFid")
+	ar.Username = r.str("Username")
+	ar.Service = r.str("Service")
+	ar.UIDno = r.u32("UIDno")
 }
 
 // ErrorResponseDotu is the 9P2000.u version of ErrorResponse. It adds Errno
@@ -378,21 +335,15 @@ func (er *ErrorResponseDotu) Marshal(b []byte) error {
 }
 
 func (er *ErrorResponseDotu) Unmarshal(b []byte) error {
-	t := 2 + 2 + 4
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	er.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-
-	l := int(binary.LittleEndian.Uint16(b[2:4]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	er.Error = string(b[4 : 4+l])
+	r := fieldReader{b: b}
+	er.unmarshal(&r)
+	return r.err
+}
 
-	er.Errno = binary.LittleEndian.Uint32(b[4+l : 4+l+4])
-	return nil
+func (er *ErrorResponseDotu) unmarshal(r *fieldReader) {
+	er.Tag = r.tag()
+	er.Error = r.str("Error")
+	er.Errno = r.u32("Errno")
 }
 
 // CreateRequestDotu is the 9P2000.u version of CreateRequest. It adds
@@ -440,34 +391,18 @@ func (cr *CreateRequestDotu) Marshal(b []byte) error {
 }
 
 func (cr *CreateRequestDotu) Unmarshal(b []byte) error {
-	t := 2 + 4 + 2 + 4 + 1 + 2
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	cr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	cr.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-
-	l := int(binary.LittleEndian.Uint16(b[6:8]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-
-	idx := 8
-	cr.Name = string(b[idx : idx+l])
-	idx += l
-
-	cr.Permissions = FileMode(binary.LittleEndian.Uint32(b[idx : idx+4]))
-	cr.Mode = OpenMode(b[idx+4])
+	r := fieldReader{b: b}
+	cr.unmarshal(&r)
+	return r.err
+}
 
-	idx += 5
-	l = int(binary.LittleEndian.Uint16(b[idx : idx+2]))
-	t += l
-	if len(b) < t {
-		return ErrPayloadTooShort
-	}
-	cr.Extensions = string(b[idx+2 : idx+2+l])
-	return nil
+func (cr *CreateRequestDotu) unmarshal(r *fieldReader) {
+	cr.Tag = r.tag()
+	cr.Fid = r.fid("Fid")
+	cr.Name = r.str("Name")
+	cr.Permissions = FileMode(r.u32("Permissions"))
+	cr.Mode = OpenMode(r.u8("Mode"))
+	cr.Extensions = r.str("Extensions")
 }
 
 // StatResponseDotu is the 9P2000.u version of StatResponse. It uses a
@@ -490,12 +425,16 @@ func (sr *StatResponseDotu) Marshal(b []byte) error {
 }
 
 func (sr *StatResponseDotu) Unmarshal(b []byte) error {
-	if len(b) < 2+2 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	sr.unmarshal(&r)
+	return r.err
+}
 
-	sr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	return sr.Stat.Unmarshal(b[4:])
+func (sr *StatResponseDotu) unmarshal(r *fieldReader) {
+	sr.Tag = r.tag()
+	// The size prefix of the stat is validated by Strict decoders.
+	r.take("Stat", -1, 2)
+	r.nested("Stat", sr.Stat.unmarshal)
 }
 
 // WriteStatRequestDotu is the 9P2000.u version of WriteStatRequest. It uses a
@@ -515,13 +454,17 @@ func (wsr *WriteStatRequestDotu) EncodedSize() int {
 }
 
 func (wsr *WriteStatRequestDotu) Unmarshal(b []byte) error {
-	if len(b) < 2+4+2 {
-		return ErrPayloadTooShort
-	}
+	r := fieldReader{b: b}
+	wsr.unmarshal(&r)
+	return r.err
+}
 
-	wsr.Tag = Tag(binary.LittleEndian.Uint16(b[0:2]))
-	wsr.Fid = Fid(binary.LittleEndian.Uint32(b[2:6]))
-	return wsr.Stat.Unmarshal(b[8:])
+func (wsr *WriteStatRequestDotu) unmarshal(r *fieldReader) {
+	wsr.Tag = r.tag()
+	wsr.Fid = r.fid("Fid")
+	// The size prefix of the stat is validated by Strict decoders.
+	r.take("Stat", -1, 2)
+	r.nested("Stat", wsr.Stat.unmarshal)
 }
 
 func (wsr *WriteStatRequestDotu) Marshal(b []byte) error {
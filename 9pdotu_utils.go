@@ -43,3 +43,9 @@ func (nineP2000Dotu) MessageType(d Message) (MessageType, error) {
 		return NineP2000.MessageType(d)
 	}
 }
+
+// Types returns the message types of 9P2000.u, which are the same as those of
+// 9P2000.
+func (nineP2000Dotu) Types() []MessageType {
+	return NineP2000.Types()
+}
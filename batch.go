@@ -0,0 +1,113 @@
+package qp
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// BatchDecoder decodes a sequence of framed messages, such as a large capture
+// file, for high throughput. Unlike a Decoder, it reads as much as fits into
+// a single reused buffer at a time, and decodes all complete messages in the
+// buffer before reading again. Messages are iterated in the style of
+// bufio.Scanner:
+//
+//	bd := NewBatchDecoder(NineP2000, r, 65536)
+//	for bd.Next() {
+//		m := bd.Message()
+//		...
+//	}
+//	if err := bd.Err(); err != nil {
+//		...
+//	}
+//
+// Decoded messages do not refer to the buffer, and may be retained. Messages
+// larger than the buffer fail with a *MessageTooBigError. BatchDecoder is not
+// thread safe.
+type BatchDecoder struct {
+	p Protocol
+	r io.Reader
+
+	// buf[start:end] holds the data read but not yet decoded.
+	buf        []byte
+	start, end int
+
+	m   Message
+	err error
+}
+
+// NewBatchDecoder returns a BatchDecoder reading from r with a buffer of the
+// provided size, which must be at least the largest message in the stream.
+func NewBatchDecoder(p Protocol, r io.Reader, size int) *BatchDecoder {
+	if size < HeaderSize {
+		size = HeaderSize
+	}
+	return &BatchDecoder{p: p, r: r, buf: make([]byte, size)}
+}
+
+// Next decodes the next message, which is then available through Message. It
+// returns false at the end of the stream or on the first error, after which
+// Err returns the error.
+func (bd *BatchDecoder) Next() bool {
+	bd.m = nil
+	if bd.err != nil {
+		return false
+	}
+
+	for {
+		if avail := bd.end - bd.start; avail >= HeaderSize {
+			b := bd.buf[bd.start:bd.end]
+			s := binary.LittleEndian.Uint32(b[0:4])
+			switch {
+			case s < HeaderSize:
+				bd.err = ErrMessageTooSmall
+				return false
+			case uint64(s) > uint64(len(bd.buf)):
+				bd.err = &MessageTooBigError{Size: int(s), Max: len(bd.buf)}
+				return false
+			case int(s) <= avail:
+				bd.m, bd.err = DecodeBody(bd.p, MessageType(b[4]), b[HeaderSize:s])
+				bd.start += int(s)
+				return bd.err == nil
+			}
+		}
+
+		if !bd.fill() {
+			return false
+		}
+	}
+}
+
+// fill moves the remaining data to the start of the buffer, and reads more
+// data after it.
+func (bd *BatchDecoder) fill() bool {
+	if bd.start > 0 {
+		bd.end = copy(bd.buf, bd.buf[bd.start:bd.end])
+		bd.start = 0
+	}
+
+	n, err := io.ReadAtLeast(bd.r, bd.buf[bd.end:], 1)
+	bd.end += n
+	if err != nil {
+		if err == io.EOF && bd.end > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		bd.err = err
+		return false
+	}
+	return true
+}
+
+// Message returns the message decoded by the last call to Next.
+func (bd *BatchDecoder) Message() Message {
+	return bd.m
+}
+
+// Err returns the error that stopped Next, or nil if the end of the stream
+// was reached. io.ErrUnexpectedEOF is returned if the stream ends with an
+// incomplete message.
+func (bd *BatchDecoder) Err() error {
+	if bd.err == io.EOF {
+		return nil
+	}
+	return bd.err
+}
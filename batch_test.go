@@ -0,0 +1,103 @@
+package qp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBatchDecoder(t *testing.T) {
+	stream := new(bytes.Buffer)
+	for _, tt := range MessageTestData {
+		stream.Write(tt.container)
+	}
+	raw := stream.Bytes()
+
+	readers := map[string]func() io.Reader{
+		"simple":  func() io.Reader { return bytes.NewReader(raw) },
+		"onebyte": func() io.Reader { return iotest.OneByteReader(bytes.NewReader(raw)) },
+	}
+	for name, r := range readers {
+		bd := NewBatchDecoder(NineP2000, r(), 8192)
+		i := 0
+		for ; bd.Next(); i++ {
+			if i >= len(MessageTestData) {
+				t.Fatalf("%s: too many messages", name)
+			}
+			tt := MessageTestData[i]
+			if !CompareMarshallables(tt.input, bd.Message()) {
+				t.Errorf("%s: test %d: failed on %T\n\tExpected: %#v\n\tGot:      %#v", name, i, tt.input, tt.input, bd.Message())
+			}
+		}
+		if err := bd.Err(); err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		if i != len(MessageTestData) {
+			t.Errorf("%s: expected %d messages, got %d", name, len(MessageTestData), i)
+		}
+	}
+
+	bd := NewBatchDecoder(NineP2000, bytes.NewReader(raw[:len(raw)-1]), 8192)
+	for bd.Next() {
+	}
+	if err := bd.Err(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF for truncated stream, got %v", err)
+	}
+
+	bd = NewBatchDecoder(NineP2000, bytes.NewReader(raw), 16)
+	for bd.Next() {
+	}
+	if err := bd.Err(); !errors.Is(err, ErrMessageTooBig) {
+		t.Errorf("expected ErrMessageTooBig for small buffer, got %v", err)
+	}
+}
+
+// syntheticCapture returns a capture of n messages from MessageTestData.
+func syntheticCapture(n int) []byte {
+	stream := new(bytes.Buffer)
+	for i := 0; i < n; i++ {
+		stream.Write(MessageTestData[i%len(MessageTestData)].container)
+	}
+	return stream.Bytes()
+}
+
+const captureMessages = 10000
+
+func BenchmarkBatchDecoder(b *testing.B) {
+	raw := syntheticCapture(captureMessages)
+	r := bytes.NewReader(raw)
+
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(raw)
+		bd := NewBatchDecoder(NineP2000, r, 65536)
+		for bd.Next() {
+		}
+		if err := bd.Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBatchDecoderLoop(b *testing.B) {
+	// The same capture decoded with a Decoder in a loop, for comparison.
+	raw := syntheticCapture(captureMessages)
+	r := bytes.NewReader(raw)
+
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(raw)
+		d := &Decoder{Protocol: NineP2000, Reader: r, MessageSize: 65536}
+		for {
+			if _, err := d.ReadMessage(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
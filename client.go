@@ -0,0 +1,1073 @@
+package qp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoTagsAvailable indicates that all tags are in use by outstanding
+	// requests.
+	ErrNoTagsAvailable = errors.New("no tags available")
+
+	// ErrNoFidsAvailable indicates that all fids are in use.
+	ErrNoFidsAvailable = errors.New("no fids available")
+
+	// ErrPartialWalk indicates that a walk did not reach the last name, such
+	// as when a file along the path does not exist.
+	ErrPartialWalk = errors.New("walk did not reach the file")
+
+	// ErrWalkTooManyQids indicates that a WalkResponse holds more qids than
+	// the WalkRequest had names.
+	ErrWalkTooManyQids = errors.New("walk response has more qids than requested names")
+
+	// ErrUntaggedMessage indicates that a message does not permit setting its
+	// tag, and can therefore not be sent by a Client.
+	ErrUntaggedMessage = errors.New("message tag cannot be set")
+
+	// ErrUnexpectedResponse indicates that the server replied with a message
+	// that is not a valid response to the request.
+	ErrUnexpectedResponse = errors.New("unexpected response")
+
+	// ErrRequestTimeout indicates that no response arrived for a request
+	// within the timeout.
+	ErrRequestTimeout = errors.New("request timed out")
+
+	// ErrUnmatchedResponse indicates that the server sent a response with a
+	// tag that does not belong to any request.
+	ErrUnmatchedResponse = errors.New("response does not match any request")
+
+	// ErrDuplicateResponse indicates that the server sent a response for a
+	// request that had already been answered.
+	ErrDuplicateResponse = errors.New("duplicate response")
+)
+
+// ProtocolError is a protocol violation by the server detected by a Client.
+// Err is ErrUnmatchedResponse, ErrDuplicateResponse, or ErrUnexpectedResponse
+// for a response of a type that is not valid for the request.
+type ProtocolError struct {
+	// Response is the offending response.
+	Response Message
+
+	// Err describes the violation.
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("tag %d: %v", MessageTag(e.Response), e.Err)
+}
+
+// Unwrap returns Err.
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// WalkError is returned by WalkPath when the walk fails, recording how far it
+// got.
+type WalkError struct {
+	// Path is the path that was walked.
+	Path string
+
+	// Walked is the number of names of the path that were walked.
+	Walked int
+
+	// Err is the cause, such as ErrPartialWalk or a *ServerError.
+	Err error
+}
+
+func (e *WalkError) Error() string {
+	return fmt.Sprintf("walk %q: stopped after %d names: %v", e.Path, e.Walked, e.Err)
+}
+
+// Unwrap returns Err.
+func (e *WalkError) Unwrap() error {
+	return e.Err
+}
+
+// ServerError is an error reported by the server through an ErrorResponse or
+// ErrorResponseDotu.
+type ServerError struct {
+	// Message is the error string. It is called "ename" in the official
+	// implementation.
+	Message string
+
+	// Errno is the error code for 9P2000.u, or 0 if not available.
+	Errno uint32
+}
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+// responseError returns the error carried by an error response, or nil if the
+// message is not an error response.
+func responseError(m Message) error {
+	switch m := BaseMessage(m).(type) {
+	case *ErrorResponse:
+		return &ServerError{Message: m.Error}
+	case *ErrorResponseDotu:
+		return &ServerError{Message: m.Error, Errno: m.Errno}
+	default:
+		return nil
+	}
+}
+
+// TagPool allocates unique tags for outstanding requests. NOTAG is never
+// handed out. TagPool is thread safe.
+type TagPool struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	next  Tag
+	limit int
+	inUse map[Tag]bool
+}
+
+// NewTagPool returns an empty TagPool.
+func NewTagPool() *TagPool {
+	tp := &TagPool{inUse: make(map[Tag]bool)}
+	tp.cond = sync.NewCond(&tp.lock)
+	return tp
+}
+
+// SetLimit limits the amount of tags that can be in use at once. A limit of 0
+// removes the limit.
+func (tp *TagPool) SetLimit(limit int) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	tp.limit = limit
+	tp.cond.Broadcast()
+}
+
+// Get allocates a tag, returning ErrNoTagsAvailable if all tags are in use, or
+// if the limit has been reached.
+func (tp *TagPool) Get() (Tag, error) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return tp.get(true)
+}
+
+// Wait allocates a tag, blocking while the limit is reached. It returns
+// ErrNoTagsAvailable if all tags are in use.
+func (tp *TagPool) Wait() (Tag, error) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	for tp.limit > 0 && len(tp.inUse) >= tp.limit {
+		tp.cond.Wait()
+	}
+	return tp.get(false)
+}
+
+// getUnlimited allocates a tag regardless of the limit, returning
+// ErrNoTagsAvailable if all tags are in use.
+func (tp *TagPool) getUnlimited() (Tag, error) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return tp.get(false)
+}
+
+// get allocates a tag, ignoring the limit unless limited is set. lock must be
+// held.
+func (tp *TagPool) get(limited bool) (Tag, error) {
+	if limited && tp.limit > 0 && len(tp.inUse) >= tp.limit {
+		return NOTAG, ErrNoTagsAvailable
+	}
+
+	for i := 0; i < int(NOTAG); i++ {
+		t := tp.next
+		tp.next++
+		if tp.next == NOTAG {
+			tp.next = 0
+		}
+
+		if !tp.inUse[t] {
+			tp.inUse[t] = true
+			return t, nil
+		}
+	}
+
+	return NOTAG, ErrNoTagsAvailable
+}
+
+// Put returns a tag to the pool.
+func (tp *TagPool) Put(t Tag) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	delete(tp.inUse, t)
+	tp.cond.Signal()
+}
+
+// FidPool allocates unique fids. NOFID is never handed out. FidPool is thread
+// safe.
+type FidPool struct {
+	lock  sync.Mutex
+	next  Fid
+	inUse map[Fid]bool
+}
+
+// NewFidPool returns an empty FidPool.
+func NewFidPool() *FidPool {
+	return &FidPool{inUse: make(map[Fid]bool)}
+}
+
+// Get allocates a fid, returning ErrNoFidsAvailable if all fids are in use.
+func (fp *FidPool) Get() (Fid, error) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+
+	if uint64(len(fp.inUse)) >= uint64(NOFID) {
+		return NOFID, ErrNoFidsAvailable
+	}
+	for {
+		f := fp.next
+		fp.next++
+		if fp.next == NOFID {
+			fp.next = 0
+		}
+
+		if !fp.inUse[f] {
+			fp.inUse[f] = true
+			return f, nil
+		}
+	}
+}
+
+// Put returns a fid to the pool. It must only be called once the fid has
+// been clunked or removed.
+func (fp *FidPool) Put(f Fid) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	delete(fp.inUse, f)
+}
+
+// InUse returns the number of allocated fids that have not been returned,
+// which helps in finding fid leaks.
+func (fp *FidPool) InUse() int {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	return len(fp.inUse)
+}
+
+// allocated returns the allocated fids in increasing order.
+func (fp *FidPool) allocated() []Fid {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	fids := make([]Fid, 0, len(fp.inUse))
+	for f := range fp.inUse {
+		fids = append(fids, f)
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	return fids
+}
+
+// Client is a multiplexing 9P client. It permits any amount of concurrent
+// requests on a single Session, assigning tags to the requests and routing
+// the responses back by their tag. Protocol negotiation must have been
+// completed before the Client is created. Client is thread safe.
+type Client struct {
+	session *Session
+	tags    *TagPool
+	fids    *FidPool
+
+	// pendingLock protects pending, done, onProtocolError and err.
+	pendingLock sync.Mutex
+
+	// pending maps the tags of outstanding requests to the channel awaiting
+	// the response.
+	pending map[Tag]chan Message
+
+	// done holds the tags of requests that are no longer pending, until the
+	// tag is reused. The value is true if the request was answered, and false
+	// if it timed out, in which case a late response is not a violation.
+	done map[Tag]bool
+
+	// onProtocolError is called for protocol violations by the server.
+	onProtocolError func(error)
+
+	// err is the error that terminated the read loop, if any.
+	err error
+
+	// iounitLock protects iounits.
+	iounitLock sync.Mutex
+
+	// iounits holds the nonzero IOUnits of fids opened by OpenFile, until the
+	// fid is released.
+	iounits map[Fid]uint32
+}
+
+// NewClient returns a Client operating on the provided Session, and starts
+// reading responses. The Client stops when the Decoder fails, which usually
+// happens when the connection is closed.
+func NewClient(s *Session) *Client {
+	c := &Client{
+		session: s,
+		tags:    NewTagPool(),
+		fids:    NewFidPool(),
+		pending: make(map[Tag]chan Message),
+		done:    make(map[Tag]bool),
+		iounits: make(map[Fid]uint32),
+	}
+	go c.run()
+	return c
+}
+
+// run reads responses and routes them to their pending requests.
+func (c *Client) run() {
+	for {
+		m, err := c.session.Decoder.ReadMessage()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		// Responses with NOTAG, such as a stray VersionResponse, and responses
+		// without a tag, never match a request.
+		t := MessageTag(m)
+		c.pendingLock.Lock()
+		ch, ok := c.pending[t]
+		delete(c.pending, t)
+
+		var perr error
+		answered, done := c.done[t]
+		switch {
+		case t.IsNoTag():
+			perr = &ProtocolError{Response: m, Err: ErrUnmatchedResponse}
+		case ok, done && !answered:
+			c.done[t] = true
+		case done:
+			perr = &ProtocolError{Response: m, Err: ErrDuplicateResponse}
+		default:
+			perr = &ProtocolError{Response: m, Err: ErrUnmatchedResponse}
+		}
+		h := c.onProtocolError
+		c.pendingLock.Unlock()
+
+		if ok {
+			ch <- m
+		} else if perr != nil && h != nil {
+			h(perr)
+		}
+	}
+}
+
+// OnProtocolError sets a handler called with a *ProtocolError when the server
+// sends a response that does not match any outstanding request, or a second
+// response to a request. Such responses are dropped. The handler is called
+// from the goroutine reading responses, so no responses are processed until
+// it returns. It may close the Session to terminate the Client. A late
+// response to a request that timed out is not a violation. A nil handler
+// ignores violations, which is the default.
+func (c *Client) OnProtocolError(h func(error)) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	c.onProtocolError = h
+}
+
+// fail terminates all outstanding requests with the provided error.
+func (c *Client) fail(err error) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	c.err = err
+	for t, ch := range c.pending {
+		close(ch)
+		delete(c.pending, t)
+	}
+}
+
+// Send assigns a tag to the request, sends it and waits for the response.
+// ErrorResponses are returned as a response like any other message. If the
+// request is of a type known to ResponseTypeValid, a response of an invalid
+// type is rejected with a *ProtocolError wrapping ErrUnexpectedResponse. The
+// Encoder is flushed after writing the request.
+func (c *Client) Send(m Message) (Message, error) {
+	return c.send(m, 0)
+}
+
+// request sends a request like Send, unwrapping a response that carries
+// extensions, so that the helpers can handle it by its concrete type.
+func (c *Client) request(m Message) (Message, error) {
+	resp, err := c.Send(m)
+	return BaseMessage(resp), err
+}
+
+// SendWithTimeout is like Send, but returns ErrRequestTimeout if no response
+// arrives within the timeout. The request is then cancelled with a
+// FlushRequest in the background, and its tag is only reused once the flush
+// has completed. A response arriving after the timeout is discarded.
+func (c *Client) SendWithTimeout(m Message, timeout time.Duration) (Message, error) {
+	return c.send(m, timeout)
+}
+
+// SetMaxInflight limits the amount of outstanding requests. Once the limit is
+// reached, Send blocks until a response arrives for one of the outstanding
+// requests. Requests that timed out remain outstanding until their flush has
+// completed. FlushRequests are exempt from the limit, as they are needed to
+// release timed out requests. A limit of 0 removes the limit.
+func (c *Client) SetMaxInflight(n int) {
+	c.tags.SetLimit(n)
+}
+
+// send implements Send and SendWithTimeout. A timeout of 0 waits
+// indefinitely.
+func (c *Client) send(m Message, timeout time.Duration) (Message, error) {
+	tm, ok := m.(Tagged)
+	if !ok {
+		return nil, ErrUntaggedMessage
+	}
+
+	var t Tag
+	var err error
+	if _, flush := BaseMessage(m).(*FlushRequest); flush {
+		t, err = c.tags.getUnlimited()
+	} else {
+		t, err = c.tags.Wait()
+	}
+	if err != nil {
+		return nil, err
+	}
+	tm.SetTag(t)
+	reqType, _ := messageType(c.session.Encoder.protocol(), m)
+
+	ch := make(chan Message, 1)
+	c.pendingLock.Lock()
+	if c.err != nil {
+		c.pendingLock.Unlock()
+		c.tags.Put(t)
+		return nil, c.err
+	}
+	c.pending[t] = ch
+	delete(c.done, t)
+	c.pendingLock.Unlock()
+
+	if err = c.session.Encoder.WriteMessage(m); err == nil {
+		err = c.session.Encoder.Flush()
+	}
+	if err != nil {
+		c.pendingLock.Lock()
+		delete(c.pending, t)
+		c.pendingLock.Unlock()
+		c.tags.Put(t)
+		return nil, err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case resp, ok := <-ch:
+		return c.receive(t, reqType, resp, ok)
+	case <-expired:
+	}
+
+	c.pendingLock.Lock()
+	_, pending := c.pending[t]
+	if pending {
+		delete(c.pending, t)
+		c.done[t] = false
+	}
+	c.pendingLock.Unlock()
+
+	if !pending {
+		// The response arrived, or the Client failed, while timing out.
+		resp, ok := <-ch
+		return c.receive(t, reqType, resp, ok)
+	}
+
+	go func() {
+		c.Send(&FlushRequest{OldTag: t})
+		c.tags.Put(t)
+	}()
+	return nil, ErrRequestTimeout
+}
+
+// receive releases the tag of a completed request, returning the response, or
+// the error that terminated the Client if the response channel was closed. The
+// type of the response is verified if the request type is known.
+func (c *Client) receive(t Tag, reqType MessageType, resp Message, ok bool) (Message, error) {
+	c.tags.Put(t)
+	if !ok {
+		c.pendingLock.Lock()
+		defer c.pendingLock.Unlock()
+		return nil, c.err
+	}
+
+	if _, known := responseTypes[reqType]; known {
+		repType, err := messageType(c.session.Decoder.protocol(), resp)
+		if err != nil || !ResponseTypeValid(reqType, repType) {
+			return nil, &ProtocolError{Response: resp, Err: ErrUnexpectedResponse}
+		}
+	}
+	return resp, nil
+}
+
+// clunk clunks fid and releases it to Fids like Clunk, ignoring the outcome.
+func (c *Client) clunk(fid Fid) {
+	c.Clunk(fid)
+}
+
+// Clunk clunks fid and releases it to Fids. The server clunks fid even if it
+// responds with an error, so fid is released in either case, and must not be
+// used again. If the server responds with an error, it is returned as a
+// *ServerError.
+func (c *Client) Clunk(fid Fid) error {
+	defer c.release(fid)
+
+	resp, err := c.request(&ClunkRequest{Fid: fid})
+	if err != nil {
+		return err
+	}
+
+	switch resp := resp.(type) {
+	case *ClunkResponse:
+		return nil
+	default:
+		if err = responseError(resp); err != nil {
+			return err
+		}
+		return ErrUnexpectedResponse
+	}
+}
+
+// release forgets the IOUnit of fid, and releases it to Fids.
+func (c *Client) release(fid Fid) {
+	c.iounitLock.Lock()
+	delete(c.iounits, fid)
+	c.iounitLock.Unlock()
+	c.fids.Put(fid)
+}
+
+// IOUnit returns the IOUnit returned by the server when fid was opened by
+// OpenFile, or 0 if the server provided none. A nonzero IOUnit limits the
+// data of each ReadRequest and WriteRequest for the fid.
+func (c *Client) IOUnit(fid Fid) uint32 {
+	c.iounitLock.Lock()
+	defer c.iounitLock.Unlock()
+	return c.iounits[fid]
+}
+
+// CloseAll clunks and releases every fid allocated from Fids that has not
+// been released, such as when shutting down, so that no fids are leaked on
+// the server. The first error encountered is returned, but all fids are
+// clunked regardless.
+func (c *Client) CloseAll() error {
+	var first error
+	for _, fid := range c.fids.allocated() {
+		if err := c.Clunk(fid); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// AuthAttach executes the authentication protocol and attaches fid to the
+// root of the service. It sends an AuthRequest for afid, and calls auth with
+// the authentication file, which must execute the out-of-band authentication
+// protocol. If the server does not require authentication, indicated by an
+// ErrorResponse to the AuthRequest, auth is not called, and the attach is
+// performed with an AuthFid of NOFID. The Qid of the root is returned on
+// success.
+//
+// Both fids must be allocated from Fids, and AuthAttach takes ownership of
+// them: afid is always released before returning, after being clunked if the
+// server accepted the AuthRequest, and fid is released if the attach fails.
+func (c *Client) AuthAttach(afid, fid Fid, username, service string, auth func(rw io.ReadWriter) error) (Qid, error) {
+	resp, err := c.request(&AuthRequest{
+		AuthFid:  afid,
+		Username: username,
+		Service:  service,
+	})
+	if err == nil {
+		switch resp.(type) {
+		case *AuthResponse:
+			defer c.clunk(afid)
+			err = auth(&authFile{c: c, fid: afid})
+		case *ErrorResponse, *ErrorResponseDotu:
+			c.release(afid)
+			afid = NOFID
+		default:
+			c.release(afid)
+			err = ErrUnexpectedResponse
+		}
+	} else {
+		c.release(afid)
+	}
+
+	if err == nil {
+		resp, err = c.request(&AttachRequest{
+			Fid:      fid,
+			AuthFid:  afid,
+			Username: username,
+			Service:  service,
+		})
+		if err == nil {
+			if r, ok := resp.(*AttachResponse); ok {
+				return r.Qid, nil
+			}
+			if err = responseError(resp); err == nil {
+				err = ErrUnexpectedResponse
+			}
+		}
+	}
+
+	c.release(fid)
+	return Qid{}, err
+}
+
+// Fids returns the FidPool of the Client, from which Attach allocates fids.
+// Callers that pick fids themselves, such as for AuthAttach, must allocate
+// them from the pool as well to avoid collisions.
+func (c *Client) Fids() *FidPool {
+	return c.fids
+}
+
+// Attach allocates a fid from Fids and attaches it to the root of the
+// service, returning the fid and the Qid of the root. afid is the
+// authentication fid, or NOFID if no authentication is used. If the server
+// responds with an error, it is returned as a *ServerError, and the fid is
+// released.
+func (c *Client) Attach(afid Fid, username, service string) (Fid, Qid, error) {
+	fid, err := c.fids.Get()
+	if err != nil {
+		return NOFID, Qid{}, err
+	}
+
+	resp, err := c.request(&AttachRequest{
+		Fid:      fid,
+		AuthFid:  afid,
+		Username: username,
+		Service:  service,
+	})
+	if err == nil {
+		if r, ok := resp.(*AttachResponse); ok {
+			return fid, r.Qid, nil
+		}
+		if err = responseError(resp); err == nil {
+			err = ErrUnexpectedResponse
+		}
+	}
+
+	c.fids.Put(fid)
+	return NOFID, Qid{}, err
+}
+
+// OpenFile walks from fid along path, a slash separated list of names, to a fid
+// allocated from Fids with WalkPath, and opens it with the provided mode. The
+// new fid, the Qid of the file and the IOUnit of the open are returned. A
+// nonzero IOUnit is kept until the fid is released, and limits the chunk sizes
+// of reads and writes on the fid. If any step fails, the new fid is clunked and
+// released, and the error is returned, which is a *WalkError wrapping
+// ErrPartialWalk if the path could not be walked fully.
+func (c *Client) OpenFile(fid Fid, path string, mode OpenMode) (Fid, Qid, uint32, error) {
+	newfid, _, err := c.WalkPath(fid, path)
+	if err != nil {
+		return NOFID, Qid{}, 0, err
+	}
+
+	resp, err := c.request(&OpenRequest{Fid: newfid, Mode: mode})
+	if err == nil {
+		if r, ok := resp.(*OpenResponse); ok {
+			if r.IOUnit != 0 {
+				c.iounitLock.Lock()
+				c.iounits[newfid] = r.IOUnit
+				c.iounitLock.Unlock()
+			}
+			return newfid, r.Qid, r.IOUnit, nil
+		}
+		if err = responseError(resp); err == nil {
+			err = ErrUnexpectedResponse
+		}
+	}
+
+	c.Clunk(newfid)
+	return NOFID, Qid{}, 0, err
+}
+
+// Remove removes the file represented by fid. The server clunks fid even if
+// the remove fails, so fid is released to Fids in either case, and must not
+// be clunked or used again. If the server responds with an error, it is
+// returned as a *ServerError.
+func (c *Client) Remove(fid Fid) error {
+	defer c.release(fid)
+
+	resp, err := c.request(&RemoveRequest{Fid: fid})
+	if err != nil {
+		return err
+	}
+
+	switch resp := resp.(type) {
+	case *RemoveResponse:
+		return nil
+	default:
+		if err = responseError(resp); err != nil {
+			return err
+		}
+		return ErrUnexpectedResponse
+	}
+}
+
+// WalkPath walks from fid along path, a slash separated list of names, to a
+// fid allocated from Fids. The walk is split into as many WalkRequests as
+// MaxWalkElements requires, each moving the new fid further. The new fid and
+// the qids of all walked names are returned. If any walk fails, the new fid
+// is clunked if a previous walk created it, and released, and a *WalkError is
+// returned together with the qids of the names that were walked. An empty
+// path clones fid.
+func (c *Client) WalkPath(fid Fid, path string) (Fid, []Qid, error) {
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	newfid, err := c.fids.Get()
+	if err != nil {
+		return NOFID, nil, err
+	}
+
+	// The first walk creates newfid, later walks move it.
+	var walked []Qid
+	from := fid
+	for first := true; first || len(names) > 0; first = false {
+		chunk := names
+		if len(chunk) > MaxWalkElements {
+			chunk = chunk[:MaxWalkElements]
+		}
+		names = names[len(chunk):]
+
+		qids, err := c.walk(from, newfid, chunk)
+		walked = append(walked, qids...)
+		if err != nil {
+			if first {
+				c.fids.Put(newfid)
+			} else {
+				c.Clunk(newfid)
+			}
+			return NOFID, walked, &WalkError{Path: path, Walked: len(walked), Err: err}
+		}
+		from = newfid
+	}
+	return newfid, walked, nil
+}
+
+// walk walks from fid to newfid along names, which must not exceed
+// MaxWalkElements, returning the qids of the walked names. If the walk fails,
+// newfid is not affected.
+func (c *Client) walk(fid, newfid Fid, names []string) ([]Qid, error) {
+	req, err := NewWalkRequest(0, fid, newfid, names)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.request(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp := resp.(type) {
+	case *WalkResponse:
+		if err = ValidateWalkReply(req, resp); err != nil {
+			return nil, err
+		}
+		if len(resp.Qids) != len(names) {
+			return resp.Qids, ErrPartialWalk
+		}
+		return resp.Qids, nil
+	default:
+		if err = responseError(resp); err != nil {
+			return nil, err
+		}
+		return nil, ErrUnexpectedResponse
+	}
+}
+
+// ValidateWalkReply verifies that a WalkResponse is a valid reply to a
+// WalkRequest, returning ErrWalkTooManyQids if it holds more qids than the
+// request had names. A reply with fewer qids is valid, and indicates a
+// partial walk.
+func ValidateWalkReply(req *WalkRequest, resp *WalkResponse) error {
+	if len(resp.Qids) > len(req.Names) {
+		return ErrWalkTooManyQids
+	}
+	return nil
+}
+
+// authFile exposes an authentication fid as an io.ReadWriter.
+type authFile struct {
+	c      *Client
+	fid    Fid
+	offset uint64
+}
+
+func (a *authFile) Read(p []byte) (int, error) {
+	count := len(p)
+	if max := a.c.maxRead(a.fid); count > max {
+		count = max
+	}
+
+	data, err := a.c.read(a.fid, a.offset, uint32(count))
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, data)
+	a.offset += uint64(n)
+	return n, nil
+}
+
+func (a *authFile) Write(p []byte) (int, error) {
+	if len(p) > a.c.maxWrite(a.fid) {
+		return 0, ErrMessageTooBig
+	}
+
+	n, err := a.c.write(a.fid, a.offset, p)
+	if err != nil {
+		return 0, err
+	}
+	a.offset += uint64(n)
+	if int(n) < len(p) {
+		return int(n), io.ErrShortWrite
+	}
+	return int(n), nil
+}
+
+// maxRead returns the largest amount of data that can be requested by a
+// single ReadRequest for fid, which is limited by its IOUnit if nonzero.
+func (c *Client) maxRead(fid Fid) int {
+	return c.limitIOUnit(fid, MaxDataBytes(Rread, c.session.Decoder.messageSize()))
+}
+
+// maxWrite returns the largest amount of data that can be sent in a single
+// WriteRequest for fid, which is limited by its IOUnit if nonzero.
+func (c *Client) maxWrite(fid Fid) int {
+	return c.limitIOUnit(fid, MaxDataBytes(Twrite, c.session.Encoder.messageSize()))
+}
+
+// limitIOUnit limits max to the IOUnit of fid, if nonzero.
+func (c *Client) limitIOUnit(fid Fid, max uint32) int {
+	if iounit := c.IOUnit(fid); iounit != 0 && iounit < max {
+		max = iounit
+	}
+	return int(max)
+}
+
+// read sends a single ReadRequest, returning the read data.
+func (c *Client) read(fid Fid, offset uint64, count uint32) ([]byte, error) {
+	resp, err := c.request(&ReadRequest{
+		Fid:    fid,
+		Offset: offset,
+		Count:  count,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp := resp.(type) {
+	case *ReadResponse:
+		return resp.Data, nil
+	default:
+		if err = responseError(resp); err != nil {
+			return nil, err
+		}
+		return nil, ErrUnexpectedResponse
+	}
+}
+
+// write sends a single WriteRequest, returning the amount of data written.
+func (c *Client) write(fid Fid, offset uint64, data []byte) (uint32, error) {
+	resp, err := c.request(&WriteRequest{
+		Fid:    fid,
+		Offset: offset,
+		Data:   data,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	switch resp := resp.(type) {
+	case *WriteResponse:
+		return resp.Count, nil
+	default:
+		if err = responseError(resp); err != nil {
+			return 0, err
+		}
+		return 0, ErrUnexpectedResponse
+	}
+}
+
+// ReadAll reads up to count bytes from an open fid, starting at offset. The
+// read is split into as many ReadRequests as the message size and the IOUnit
+// of fid require, and stops early if the server returns no data, indicating
+// the end of the file. ErrMessageTooBig is returned if the message size leaves
+// no room for data.
+func (c *Client) ReadAll(fid Fid, offset uint64, count int) ([]byte, error) {
+	max := c.maxRead(fid)
+	if max <= 0 {
+		return nil, ErrMessageTooBig
+	}
+
+	var b []byte
+	for len(b) < count {
+		chunk := count - len(b)
+		if chunk > max {
+			chunk = max
+		}
+
+		data, err := c.read(fid, offset, uint32(chunk))
+		if err != nil {
+			return b, err
+		}
+		if len(data) == 0 {
+			break
+		}
+		if len(data) > chunk {
+			data = data[:chunk]
+		}
+
+		b = append(b, data...)
+		offset += uint64(len(data))
+	}
+	return b, nil
+}
+
+// WriteAll writes data to an open fid, starting at offset. The write is split
+// into as many WriteRequests as the message size and the IOUnit of fid require.
+// If the server writes less than requested, the remainder is written at the
+// following offset. io.ErrShortWrite is returned if the server stops accepting
+// data. ErrMessageTooBig is returned if the message size leaves no room for
+// data. The amount of data written is returned.
+func (c *Client) WriteAll(fid Fid, offset uint64, data []byte) (int, error) {
+	max := c.maxWrite(fid)
+	if max <= 0 {
+		return 0, ErrMessageTooBig
+	}
+
+	var written int
+	for written < len(data) {
+		chunk := data[written:]
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+
+		n, err := c.write(fid, offset, chunk)
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+		if int(n) > len(chunk) {
+			n = uint32(len(chunk))
+		}
+
+		written += int(n)
+		offset += uint64(n)
+	}
+	return written, nil
+}
+
+// Stat sends a StatRequest for fid, returning the Stat of the file. The
+// size prefix wrapping the stat in the StatResponse is handled by decoding. If
+// 9P2000.u was negotiated, the StatDotu of the response is converted with
+// StatDotu.Stat. If the server responds with an error, it is returned as a
+// *ServerError.
+func (c *Client) Stat(fid Fid) (Stat, error) {
+	resp, err := c.request(&StatRequest{Fid: fid})
+	if err != nil {
+		return Stat{}, err
+	}
+
+	switch resp := resp.(type) {
+	case *StatResponse:
+		return resp.Stat, nil
+	case *StatResponseDotu:
+		return resp.Stat.Stat(), nil
+	default:
+		if err = responseError(resp); err != nil {
+			return Stat{}, err
+		}
+		return Stat{}, ErrUnexpectedResponse
+	}
+}
+
+// ReadDir reads all entries of an open directory fid, issuing ReadRequests at
+// increasing offsets until the server returns no data. Servers should only
+// return whole entries in each ReadResponse, but entries split across
+// responses are handled by carrying the partial entry over to the next read.
+// ErrPayloadTooShort is returned if the directory ends with a partial entry.
+func (c *Client) ReadDir(fid Fid) ([]Stat, error) {
+	var (
+		stats  []Stat
+		buf    []byte
+		offset uint64
+		dotu   = c.dotuStats()
+	)
+	for {
+		data, err := c.read(fid, offset, uint32(c.maxRead(fid)))
+		if err != nil {
+			return stats, err
+		}
+		if len(data) == 0 {
+			break
+		}
+		offset += uint64(len(data))
+		buf = append(buf, data...)
+
+		for len(buf) >= 2 {
+			l := 2 + int(binary.LittleEndian.Uint16(buf[0:2]))
+			if len(buf) < l {
+				break
+			}
+
+			st, err := unmarshalDirEntry(buf[:l], dotu)
+			if err != nil {
+				return stats, err
+			}
+			stats = append(stats, st)
+			buf = buf[l:]
+		}
+	}
+
+	if len(buf) > 0 {
+		return stats, ErrPayloadTooShort
+	}
+	return stats, nil
+}
+
+// dotuStats tells if the negotiated protocol uses 9P2000.u stats, in which case
+// directory entries are encoded as StatDotu.
+func (c *Client) dotuStats() bool {
+	m, err := c.session.Encoder.protocol().Message(Rstat)
+	if err != nil {
+		return false
+	}
+	_, ok := m.(*StatResponseDotu)
+	return ok
+}
+
+// unmarshalDirEntry decodes a directory entry as a Stat, or as a StatDotu
+// converted to a Stat if dotu is set.
+func unmarshalDirEntry(b []byte, dotu bool) (Stat, error) {
+	if !dotu {
+		var st Stat
+		err := st.Unmarshal(b)
+		return st, err
+	}
+	var st StatDotu
+	if err := st.Unmarshal(b); err != nil {
+		return Stat{}, err
+	}
+	return st.Stat(), nil
+}
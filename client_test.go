@@ -0,0 +1,1299 @@
+package qp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubServer serves requests from rw by calling handler, replying with the
+// returned message tagged with the tag of the request. A nil response sends
+// nothing.
+func stubServer(rw io.ReadWriter, handler func(Message) Message) {
+	stubServerProtocol(rw, NineP2000, handler)
+}
+
+// stubServerProtocol is like stubServer, but speaks protocol p.
+func stubServerProtocol(rw io.ReadWriter, p Protocol, handler func(Message) Message) {
+	s := NewSession(rw, p, 8192)
+	for {
+		m, err := s.Decoder.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		resp := handler(m)
+		if resp == nil {
+			continue
+		}
+		resp.(Tagged).SetTag(MessageTag(m))
+		if err = s.Encoder.WriteMessage(resp); err != nil {
+			return
+		}
+	}
+}
+
+// newTestClient returns a Client connected to a stub server using handler.
+func newTestClient(handler func(Message) Message) (*Client, net.Conn) {
+	return newTestClientProtocol(NineP2000, handler)
+}
+
+// newTestClientProtocol is like newTestClient, but speaks protocol p.
+func newTestClientProtocol(p Protocol, handler func(Message) Message) (*Client, net.Conn) {
+	c1, c2 := net.Pipe()
+	go stubServerProtocol(c2, p, handler)
+	return NewClient(NewSession(c1, p, 8192)), c1
+}
+
+func TestTagPool(t *testing.T) {
+	tp := NewTagPool()
+	seen := make(map[Tag]bool)
+	for i := 0; i < int(NOTAG); i++ {
+		tag, err := tp.Get()
+		if err != nil {
+			t.Fatalf("unable to allocate tag %d: %v", i, err)
+		}
+		if tag == NOTAG || seen[tag] {
+			t.Fatalf("allocated invalid or duplicate tag %d", tag)
+		}
+		seen[tag] = true
+	}
+
+	if _, err := tp.Get(); err != ErrNoTagsAvailable {
+		t.Errorf("expected ErrNoTagsAvailable, got %v", err)
+	}
+
+	tp.Put(1234)
+	if tag, err := tp.Get(); err != nil || tag != 1234 {
+		t.Errorf("expected tag 1234, got %d (err: %v)", tag, err)
+	}
+}
+
+func TestClientAuthAttach(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		written []byte
+		attach  *AttachRequest
+		clunked []Fid
+	)
+
+	root := Qid{Type: QTDIR, Path: 1}
+	c, conn := newTestClient(func(m Message) Message {
+		lock.Lock()
+		defer lock.Unlock()
+		switch m := m.(type) {
+		case *AuthRequest:
+			return &AuthResponse{AuthQid: Qid{Type: QTAUTH}}
+		case *WriteRequest:
+			written = append(written, m.Data...)
+			return &WriteResponse{Count: uint32(len(m.Data))}
+		case *ReadRequest:
+			return &ReadResponse{Data: []byte("ok")}
+		case *AttachRequest:
+			attach = m
+			return &AttachResponse{Qid: root}
+		case *ClunkRequest:
+			clunked = append(clunked, m.Fid)
+			return &ClunkResponse{}
+		}
+		return &ErrorResponse{Error: "unexpected request"}
+	})
+	defer conn.Close()
+
+	afid, _ := c.Fids().Get()
+	fid, _ := c.Fids().Get()
+	qid, err := c.AuthAttach(afid, fid, "glenda", "", func(rw io.ReadWriter) error {
+		if _, err := rw.Write([]byte("hello")); err != nil {
+			return err
+		}
+		b := make([]byte, 16)
+		n, err := rw.Read(b)
+		if err != nil {
+			return err
+		}
+		if string(b[:n]) != "ok" {
+			t.Errorf("expected to read \"ok\" from auth file, got %q", b[:n])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("auth attach failed: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if qid != root {
+		t.Errorf("expected root qid %v, got %v", root, qid)
+	}
+	if bytes.Compare(written, []byte("hello")) != 0 {
+		t.Errorf("expected \"hello\" written to auth file, got %q", written)
+	}
+	if attach == nil || attach.AuthFid != afid || attach.Fid != fid {
+		t.Errorf("attach did not reference the auth fid: %#v", attach)
+	}
+	if len(clunked) != 1 || clunked[0] != afid {
+		t.Errorf("expected auth fid to be clunked, got %v", clunked)
+	}
+	if fids := c.Fids().allocated(); len(fids) != 1 || fids[0] != fid {
+		t.Errorf("expected only fid %d to be allocated, got %v", fid, fids)
+	}
+}
+
+func TestClientAuthAttachNoAuth(t *testing.T) {
+	var (
+		lock   sync.Mutex
+		attach *AttachRequest
+	)
+
+	c, conn := newTestClient(func(m Message) Message {
+		lock.Lock()
+		defer lock.Unlock()
+		switch m := m.(type) {
+		case *AuthRequest:
+			return &ErrorResponse{Error: "authentication not required"}
+		case *AttachRequest:
+			attach = m
+			return &AttachResponse{}
+		}
+		return &ErrorResponse{Error: "unexpected request"}
+	})
+	defer conn.Close()
+
+	afid, _ := c.Fids().Get()
+	fid, _ := c.Fids().Get()
+	_, err := c.AuthAttach(afid, fid, "glenda", "", func(rw io.ReadWriter) error {
+		t.Errorf("auth called for server not requiring authentication")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("auth attach failed: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if attach == nil || attach.AuthFid != NOFID {
+		t.Errorf("attach did not use NOFID: %#v", attach)
+	}
+	if fids := c.Fids().allocated(); len(fids) != 1 || fids[0] != fid {
+		t.Errorf("expected only fid %d to be allocated, got %v", fid, fids)
+	}
+}
+
+func TestClientAuthAttachFailure(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		clunked []Fid
+	)
+
+	c, conn := newTestClient(func(m Message) Message {
+		lock.Lock()
+		defer lock.Unlock()
+		switch m := m.(type) {
+		case *AuthRequest:
+			return &AuthResponse{AuthQid: Qid{Type: QTAUTH}}
+		case *AttachRequest:
+			return &ErrorResponse{Error: "permission denied"}
+		case *ClunkRequest:
+			clunked = append(clunked, m.Fid)
+			return &ClunkResponse{}
+		}
+		return &ErrorResponse{Error: "unexpected request"}
+	})
+	defer conn.Close()
+
+	afid, _ := c.Fids().Get()
+	fid, _ := c.Fids().Get()
+	_, err := c.AuthAttach(afid, fid, "glenda", "", func(rw io.ReadWriter) error {
+		return nil
+	})
+	var se *ServerError
+	if !errors.As(err, &se) || se.Message != "permission denied" {
+		t.Errorf("expected server error, got %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(clunked) != 1 || clunked[0] != afid {
+		t.Errorf("expected auth fid to be clunked, got %v", clunked)
+	}
+	if n := c.Fids().InUse(); n != 0 {
+		t.Errorf("expected all fids to be released, got %d in use", n)
+	}
+}
+
+// fileServer returns a handler serving reads and writes on a single file,
+// accepting at most maxWrite bytes per write.
+func fileServer(lock *sync.Mutex, file *[]byte, maxWrite int, reads, writes *[]uint64) func(Message) Message {
+	return func(m Message) Message {
+		lock.Lock()
+		defer lock.Unlock()
+		switch m := m.(type) {
+		case *ReadRequest:
+			*reads = append(*reads, m.Offset)
+			if m.Offset >= uint64(len(*file)) {
+				return &ReadResponse{}
+			}
+			end := m.Offset + uint64(m.Count)
+			if end > uint64(len(*file)) {
+				end = uint64(len(*file))
+			}
+			return &ReadResponse{Data: (*file)[m.Offset:end]}
+		case *WriteRequest:
+			*writes = append(*writes, m.Offset)
+			data := m.Data
+			if len(data) > maxWrite {
+				data = data[:maxWrite]
+			}
+			if end := int(m.Offset) + len(data); end > len(*file) {
+				*file = append(*file, make([]byte, end-len(*file))...)
+			}
+			copy((*file)[m.Offset:], data)
+			return &WriteResponse{Count: uint32(len(data))}
+		}
+		return &ErrorResponse{Error: "unexpected request"}
+	}
+}
+
+func TestClientReadWriteAll(t *testing.T) {
+	var (
+		lock          sync.Mutex
+		file          []byte
+		reads, writes []uint64
+	)
+
+	data := make([]byte, 20000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go stubServer(c2, fileServer(&lock, &file, 3000, &reads, &writes))
+	c := NewClient(NewSession(c1, NineP2000, 4096))
+
+	n, err := c.WriteAll(1, 0, data)
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if n != len(data) {
+		t.Errorf("expected %d bytes written, got %d", len(data), n)
+	}
+
+	lock.Lock()
+	if bytes.Compare(file, data) != 0 {
+		t.Errorf("file content did not match written data")
+	}
+	// The server only accepts 3000 bytes at a time, so every write is short.
+	for i, off := range writes {
+		if off != uint64(i*3000) {
+			t.Errorf("write %d: expected offset %d, got %d", i, i*3000, off)
+		}
+	}
+	lock.Unlock()
+
+	b, err := c.ReadAll(1, 0, len(data)+1000)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if bytes.Compare(b, data) != 0 {
+		t.Errorf("read data did not match file content")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	// The last read hits the end of the file.
+	max := 4096 - ReadOverhead
+	for i, off := range reads {
+		expected := i * max
+		if expected > len(data) {
+			expected = len(data)
+		}
+		if off != uint64(expected) {
+			t.Errorf("read %d: expected offset %d, got %d", i, expected, off)
+		}
+	}
+}
+
+func TestClientReadWriteAllMessageSize(t *testing.T) {
+	var (
+		lock          sync.Mutex
+		file          []byte
+		reads, writes []uint64
+	)
+
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go stubServer(c2, fileServer(&lock, &file, len(data), &reads, &writes))
+
+	// A message size of 0 means no limit, so a single message suffices.
+	c := NewClient(NewSession(c1, NineP2000, 0))
+	if n, err := c.WriteAll(1, 0, data); err != nil || n != len(data) {
+		t.Fatalf("write failed: wrote %d bytes, %v", n, err)
+	}
+	b, err := c.ReadAll(1, 0, len(data))
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if bytes.Compare(b, data) != 0 {
+		t.Errorf("read data did not match written data")
+	}
+	lock.Lock()
+	if len(reads) != 1 || len(writes) != 1 {
+		t.Errorf("expected a single read and write, got %d and %d", len(reads), len(writes))
+	}
+	lock.Unlock()
+
+	// A message size of 16 leaves no room for data.
+	c = NewClient(NewSession(c1, NineP2000, 16))
+	if _, err = c.WriteAll(1, 0, data); err != ErrMessageTooBig {
+		t.Errorf("expected ErrMessageTooBig for write, got %v", err)
+	}
+	if _, err = c.ReadAll(1, 0, len(data)); !errors.Is(err, ErrMessageTooBig) {
+		t.Errorf("expected ErrMessageTooBig for read, got %v", err)
+	}
+}
+
+func TestClientIOUnit(t *testing.T) {
+	var (
+		lock          sync.Mutex
+		file          []byte
+		reads, writes []uint64
+	)
+
+	data := make([]byte, 2000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	files := fileServer(&lock, &file, len(data), &reads, &writes)
+	c, conn := newTestClient(func(m Message) Message {
+		switch m.(type) {
+		case *WalkRequest:
+			return &WalkResponse{Qids: []Qid{NewQid(QTFILE, 0, 1)}}
+		case *OpenRequest:
+			return &OpenResponse{Qid: NewQid(QTFILE, 0, 1), IOUnit: 512}
+		case *ClunkRequest:
+			return &ClunkResponse{}
+		}
+		return files(m)
+	})
+	defer conn.Close()
+
+	fid, _, iounit, err := c.OpenFile(0, "file", ORDWR)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if iounit != 512 || c.IOUnit(fid) != 512 {
+		t.Fatalf("expected IOUnit 512, got %d and %d", iounit, c.IOUnit(fid))
+	}
+
+	if _, err = c.WriteAll(fid, 0, data); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	w := NewFileWriter(c, fid, uint64(len(data)))
+	if _, err = w.Write(data); err != nil {
+		t.Fatalf("file write failed: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("file close failed: %v", err)
+	}
+
+	if _, err = c.ReadAll(fid, 0, len(data)); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	r := NewFileReader(c, fid, uint64(len(data)))
+	if _, err = r.Read(make([]byte, len(data))); err != nil {
+		t.Fatalf("file read failed: %v", err)
+	}
+
+	// Although the message size permits more, every request carries at most
+	// 512 bytes.
+	lock.Lock()
+	expectedWrites := []uint64{0, 512, 1024, 1536, 2000, 2512, 3024, 3536}
+	if !reflect.DeepEqual(writes, expectedWrites) {
+		t.Errorf("expected writes at %v, got %v", expectedWrites, writes)
+	}
+	expectedReads := []uint64{0, 512, 1024, 1536, 2000}
+	if !reflect.DeepEqual(reads, expectedReads) {
+		t.Errorf("expected reads at %v, got %v", expectedReads, reads)
+	}
+	lock.Unlock()
+
+	if err = c.Clunk(fid); err != nil {
+		t.Fatalf("clunk failed: %v", err)
+	}
+	if c.IOUnit(fid) != 0 {
+		t.Errorf("expected IOUnit to be forgotten after clunk, got %d", c.IOUnit(fid))
+	}
+}
+
+func TestClientReadDir(t *testing.T) {
+	var (
+		dir   []byte
+		stats []Stat
+	)
+	for i, name := range []string{"bin", "lib", "usr", "a-rather-long-file-name"} {
+		st := Stat{
+			Qid:  NewQid(QTFILE, 0, uint64(i)),
+			Mode: 0644,
+			Name: name,
+			UID:  "glenda",
+			GID:  "glenda",
+			MUID: "glenda",
+		}
+		b := make([]byte, st.EncodedSize())
+		if err := st.Marshal(b); err != nil {
+			t.Fatalf("unable to encode stat: %v", err)
+		}
+		dir = append(dir, b...)
+		stats = append(stats, st)
+	}
+
+	// Every read returns at most 37 bytes, splitting entries awkwardly.
+	c, conn := newTestClient(func(m Message) Message {
+		req, ok := m.(*ReadRequest)
+		if !ok {
+			return &ErrorResponse{Error: "unexpected request"}
+		}
+		if req.Offset >= uint64(len(dir)) {
+			return &ReadResponse{}
+		}
+		end := req.Offset + 37
+		if end > uint64(len(dir)) {
+			end = uint64(len(dir))
+		}
+		return &ReadResponse{Data: dir[req.Offset:end]}
+	})
+	defer conn.Close()
+
+	result, err := c.ReadDir(1)
+	if err != nil {
+		t.Fatalf("read dir failed: %v", err)
+	}
+	if len(result) != len(stats) {
+		t.Fatalf("expected %d entries, got %d", len(stats), len(result))
+	}
+	for i := range stats {
+		if result[i] != stats[i] {
+			t.Errorf("entry %d: expected %#v, got %#v", i, stats[i], result[i])
+		}
+	}
+}
+
+func TestClientSendWithTimeout(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		flushed []Tag
+	)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	// The Server handles requests concurrently, so flushes are processed
+	// while a slow request is still being handled.
+	srv := NewServer(NewSession(c2, NineP2000, 8192))
+	srv.Workers = 4
+	srv.Handle(Tclunk, func(m Message) (Message, error) {
+		if m.(*ClunkRequest).Fid == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return &ClunkResponse{}, nil
+	})
+	srv.Handle(Tflush, func(m Message) (Message, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		flushed = append(flushed, m.(*FlushRequest).OldTag)
+		return &FlushResponse{}, nil
+	})
+	go srv.Serve()
+
+	c := NewClient(NewSession(c1, NineP2000, 8192))
+
+	slow := &ClunkRequest{Fid: 1}
+	if _, err := c.SendWithTimeout(slow, 50*time.Millisecond); err != ErrRequestTimeout {
+		t.Fatalf("expected ErrRequestTimeout, got %v", err)
+	}
+
+	resp, err := c.SendWithTimeout(&ClunkRequest{Fid: 2}, time.Second)
+	if err != nil {
+		t.Fatalf("fast request failed: %v", err)
+	}
+	if _, ok := resp.(*ClunkResponse); !ok {
+		t.Errorf("expected ClunkResponse, got %T", resp)
+	}
+
+	// Wait for the late response to the slow request to arrive.
+	time.Sleep(300 * time.Millisecond)
+
+	lock.Lock()
+	if len(flushed) != 1 || flushed[0] != slow.Tag {
+		t.Errorf("expected flush of tag %d, got %v", slow.Tag, flushed)
+	}
+	lock.Unlock()
+
+	c.pendingLock.Lock()
+	if len(c.pending) != 0 {
+		t.Errorf("expected no pending requests, got %d", len(c.pending))
+	}
+	c.pendingLock.Unlock()
+
+	c.tags.lock.Lock()
+	if len(c.tags.inUse) != 0 {
+		t.Errorf("expected all tags to be released, got %v", c.tags.inUse)
+	}
+	c.tags.lock.Unlock()
+}
+
+func TestClientMaxInflight(t *testing.T) {
+	received := make(chan Fid, 2)
+	c, conn := newTestClient(func(m Message) Message {
+		switch m := m.(type) {
+		case *ClunkRequest:
+			received <- m.Fid
+			if m.Fid == 1 {
+				// Never answered, so the slot is only released by a flush.
+				return nil
+			}
+			return &ClunkResponse{}
+		case *FlushRequest:
+			return &FlushResponse{}
+		}
+		return &ErrorResponse{Error: "unexpected request"}
+	})
+	defer conn.Close()
+	c.SetMaxInflight(1)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.SendWithTimeout(&ClunkRequest{Fid: 1}, 100*time.Millisecond)
+		errc <- err
+	}()
+	if fid := <-received; fid != 1 {
+		t.Fatalf("expected fid 1, got %d", fid)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Send(&ClunkRequest{Fid: 2})
+		done <- err
+	}()
+
+	select {
+	case fid := <-received:
+		t.Fatalf("request for fid %d sent while at the limit", fid)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := <-errc; err != ErrRequestTimeout {
+		t.Fatalf("expected ErrRequestTimeout, got %v", err)
+	}
+
+	// The flush of the first request releases its slot.
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("second request failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("second request still blocked after flush")
+	}
+	if fid := <-received; fid != 2 {
+		t.Errorf("expected fid 2, got %d", fid)
+	}
+}
+
+func TestClientProtocolError(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	// The server answers every request twice, followed by a response with a
+	// tag that was never used.
+	go func() {
+		s := NewSession(c2, NineP2000, 8192)
+		for {
+			m, err := s.Decoder.ReadMessage()
+			if err != nil {
+				return
+			}
+			for _, tag := range []Tag{MessageTag(m), MessageTag(m), 77} {
+				if err = s.Encoder.WriteMessage(&ClunkResponse{Tag: tag}); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	errs := make(chan error, 2)
+	c := NewClient(NewSession(c1, NineP2000, 8192))
+	c.OnProtocolError(func(err error) { errs <- err })
+
+	if _, err := c.Send(&ClunkRequest{Fid: 1}); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	for i, expected := range []error{ErrDuplicateResponse, ErrUnmatchedResponse} {
+		select {
+		case err := <-errs:
+			var perr *ProtocolError
+			if !errors.As(err, &perr) || !errors.Is(err, expected) {
+				t.Errorf("test %d: expected ProtocolError for %v, got %v", i, expected, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("test %d: handler not called for %v", i, expected)
+		}
+	}
+}
+
+func TestClientAttach(t *testing.T) {
+	root := NewQid(QTDIR, 0, 1)
+	c, conn := newTestClient(func(m Message) Message {
+		req, ok := m.(*AttachRequest)
+		if !ok {
+			return &ErrorResponse{Error: "unexpected request"}
+		}
+		if req.AuthFid != NOFID || req.Username != "glenda" {
+			return &ErrorResponse{Error: "permission denied"}
+		}
+		return &AttachResponse{Qid: root}
+	})
+	defer conn.Close()
+
+	fid, qid, err := c.Attach(NOFID, "glenda", "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	if qid != root {
+		t.Errorf("expected root qid %v, got %v", root, qid)
+	}
+
+	_, _, err = c.Attach(NOFID, "bob", "")
+	var se *ServerError
+	if !errors.As(err, &se) || se.Message != "permission denied" {
+		t.Errorf("expected ServerError, got %v", err)
+	}
+
+	// The fid of the failed attach is released, but not the first one.
+	next, err := c.Fids().Get()
+	if err != nil {
+		t.Fatalf("unable to allocate fid: %v", err)
+	}
+	if next == fid || next == NOFID {
+		t.Errorf("allocated fid %d collides with attached fid %d", next, fid)
+	}
+}
+
+func TestClientNoTag(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	// The server sends a stray VersionResponse with NOTAG before every
+	// response.
+	go func() {
+		s := NewSession(c2, NineP2000, 8192)
+		for {
+			m, err := s.Decoder.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = s.Encoder.WriteMessage(&VersionResponse{Tag: NOTAG, MessageSize: 8192, Version: Version}); err != nil {
+				return
+			}
+			if err = s.Encoder.WriteMessage(&ClunkResponse{Tag: MessageTag(m)}); err != nil {
+				return
+			}
+		}
+	}()
+
+	errs := make(chan error, 1)
+	c := NewClient(NewSession(c1, NineP2000, 8192))
+	c.OnProtocolError(func(err error) { errs <- err })
+
+	resp, err := c.Send(&ClunkRequest{Fid: 100})
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if _, ok := resp.(*ClunkResponse); !ok {
+		t.Errorf("expected ClunkResponse, got %T", resp)
+	}
+
+	select {
+	case err := <-errs:
+		var perr *ProtocolError
+		if !errors.As(err, &perr) || !errors.Is(err, ErrUnmatchedResponse) || MessageTag(perr.Response) != NOTAG {
+			t.Errorf("expected unmatched NOTAG response, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("handler not called for NOTAG response")
+	}
+
+	if !NOTAG.IsNoTag() || NOTAG.Valid() || Tag(0).IsNoTag() || !Tag(0).Valid() {
+		t.Errorf("unexpected NOTAG classification")
+	}
+}
+
+func TestClientOpenFile(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		fids    = make(map[Fid]bool)
+		walks   int
+		clunked []Fid
+	)
+
+	c, conn := newTestClient(func(m Message) Message {
+		lock.Lock()
+		defer lock.Unlock()
+		switch m := m.(type) {
+		case *WalkRequest:
+			walks++
+			if !fids[m.Fid] {
+				return &ErrorResponse{Error: "unknown fid"}
+			}
+			var qids []Qid
+			for i, name := range m.Names {
+				if name == "missing" {
+					if i == 0 {
+						return &ErrorResponse{Error: "file not found"}
+					}
+					return &WalkResponse{Qids: qids}
+				}
+				qids = append(qids, NewQid(QTDIR, 0, uint64(i)))
+			}
+			fids[m.NewFid] = true
+			return &WalkResponse{Qids: qids}
+		case *OpenRequest:
+			if !fids[m.Fid] {
+				return &ErrorResponse{Error: "unknown fid"}
+			}
+			return &OpenResponse{Qid: NewQid(QTFILE, 0, 42), IOUnit: 4096}
+		case *ClunkRequest:
+			delete(fids, m.Fid)
+			clunked = append(clunked, m.Fid)
+			return &ClunkResponse{}
+		}
+		return &ErrorResponse{Error: "unexpected request"}
+	})
+	defer conn.Close()
+
+	root, err := c.Fids().Get()
+	if err != nil {
+		t.Fatalf("unable to allocate fid: %v", err)
+	}
+	lock.Lock()
+	fids[root] = true
+	lock.Unlock()
+
+	// 20 names require two walks.
+	names := make([]string, 20)
+	for i := range names {
+		names[i] = "d"
+	}
+	fid, qid, iounit, err := c.OpenFile(root, "/"+strings.Join(names, "/"), OREAD)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if qid != NewQid(QTFILE, 0, 42) || iounit != 4096 {
+		t.Errorf("unexpected open result: %v, %d", qid, iounit)
+	}
+	lock.Lock()
+	if walks != 2 || !fids[fid] {
+		t.Errorf("expected 2 walks to fid %d, got %d walks and fids %v", fid, walks, fids)
+	}
+	lock.Unlock()
+
+	// The second walk fails midway, so the fid created by the first walk
+	// must be clunked.
+	names[18] = "missing"
+	_, _, _, err = c.OpenFile(root, strings.Join(names, "/"), OREAD)
+	if !errors.Is(err, ErrPartialWalk) {
+		t.Errorf("expected ErrPartialWalk, got %v", err)
+	}
+	lock.Lock()
+	if len(clunked) != 1 || clunked[0] == fid || fids[clunked[0]] {
+		t.Errorf("expected the intermediate fid to be clunked, got %v", clunked)
+	}
+	lock.Unlock()
+
+	// A failing first walk creates no fid, so nothing is clunked.
+	_, _, _, err = c.OpenFile(root, "missing", OREAD)
+	var se *ServerError
+	if !errors.As(err, &se) || se.Message != "file not found" {
+		t.Errorf("expected ServerError, got %v", err)
+	}
+	lock.Lock()
+	if len(clunked) != 1 {
+		t.Errorf("expected no further clunks, got %v", clunked)
+	}
+	lock.Unlock()
+}
+
+func TestClientWalkPath(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		fids    = make(map[Fid]int)
+		clunked int
+	)
+
+	// Every name is a directory, except "missing".
+	c, conn := newTestClient(func(m Message) Message {
+		lock.Lock()
+		defer lock.Unlock()
+		switch m := m.(type) {
+		case *WalkRequest:
+			depth, ok := fids[m.Fid]
+			if !ok {
+				return &ErrorResponse{Error: "unknown fid"}
+			}
+			var qids []Qid
+			for _, name := range m.Names {
+				if name == "missing" {
+					break
+				}
+				depth++
+				qids = append(qids, NewQid(QTDIR, 0, uint64(depth)))
+			}
+			if len(qids) == 0 && len(m.Names) > 0 {
+				return &ErrorResponse{Error: "file not found"}
+			}
+			if len(qids) == len(m.Names) {
+				fids[m.NewFid] = depth
+			}
+			return &WalkResponse{Qids: qids}
+		case *ClunkRequest:
+			delete(fids, m.Fid)
+			clunked++
+			return &ClunkResponse{}
+		}
+		return &ErrorResponse{Error: "unexpected request"}
+	})
+	defer conn.Close()
+
+	root, err := c.Fids().Get()
+	if err != nil {
+		t.Fatalf("unable to allocate fid: %v", err)
+	}
+	lock.Lock()
+	fids[root] = 0
+	lock.Unlock()
+
+	path := func(depth int, missing bool) string {
+		names := make([]string, depth)
+		for i := range names {
+			names[i] = "d"
+		}
+		if missing {
+			names = append(names, "missing", "d")
+		}
+		return strings.Join(names, "/")
+	}
+
+	tests := []struct {
+		depth   int
+		missing bool
+		clunks  int
+	}{
+		{0, false, 0},
+		{5, false, 0},
+		{16, false, 0},
+		{40, false, 0},
+		{0, true, 0},
+		{3, true, 0},
+		{16, true, 1},
+		{20, true, 1},
+		{35, true, 1},
+	}
+	for i, tt := range tests {
+		lock.Lock()
+		clunked = 0
+		lock.Unlock()
+
+		fid, qids, err := c.WalkPath(root, path(tt.depth, tt.missing))
+		if len(qids) != tt.depth {
+			t.Errorf("test %d: expected %d qids, got %d", i, tt.depth, len(qids))
+		}
+		for j, qid := range qids {
+			if qid.Path != uint64(j+1) {
+				t.Errorf("test %d: qid %d has path %d", i, j, qid.Path)
+				break
+			}
+		}
+
+		if !tt.missing {
+			if err != nil {
+				t.Errorf("test %d: walk failed: %v", i, err)
+				continue
+			}
+			lock.Lock()
+			if fids[fid] != tt.depth {
+				t.Errorf("test %d: expected fid at depth %d, got %d", i, tt.depth, fids[fid])
+			}
+			lock.Unlock()
+			c.Clunk(fid)
+			continue
+		}
+
+		var we *WalkError
+		if !errors.As(err, &we) || we.Walked != tt.depth {
+			t.Errorf("test %d: expected WalkError after %d names, got %v", i, tt.depth, err)
+		}
+		if fid != NOFID {
+			t.Errorf("test %d: expected NOFID, got %d", i, fid)
+		}
+		lock.Lock()
+		if clunked != tt.clunks {
+			t.Errorf("test %d: expected %d clunks, got %d", i, tt.clunks, clunked)
+		}
+		lock.Unlock()
+	}
+
+	if n := c.Fids().InUse(); n != 1 {
+		t.Errorf("expected all walked fids to be released, %d in use", n)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(fids) != 1 {
+		t.Errorf("expected only the root fid to remain, got %v", fids)
+	}
+}
+
+func TestClientWalkTooManyQids(t *testing.T) {
+	req := &WalkRequest{Fid: 1, NewFid: 2, Names: []string{"a", "b", "c"}}
+	tests := []struct {
+		qids int
+		err  error
+	}{
+		{0, nil},
+		{3, nil},
+		{4, ErrWalkTooManyQids},
+		{16, ErrWalkTooManyQids},
+	}
+	for i, tt := range tests {
+		resp := &WalkResponse{Qids: make([]Qid, tt.qids)}
+		if err := ValidateWalkReply(req, resp); err != tt.err {
+			t.Errorf("test %d: expected %v, got %v", i, tt.err, err)
+		}
+	}
+
+	// A server claiming 16 qids for a walk of 3 names.
+	c, conn := newTestClient(func(m Message) Message {
+		switch m.(type) {
+		case *WalkRequest:
+			return &WalkResponse{Qids: make([]Qid, 16)}
+		case *ClunkRequest:
+			return &ClunkResponse{}
+		}
+		return &ErrorResponse{Error: "unexpected request"}
+	})
+	defer conn.Close()
+
+	if _, _, _, err := c.OpenFile(0, "a/b/c", OREAD); !errors.Is(err, ErrWalkTooManyQids) {
+		t.Errorf("expected ErrWalkTooManyQids, got %v", err)
+	}
+	if n := c.Fids().InUse(); n != 0 {
+		t.Errorf("expected the new fid to be released, %d in use", n)
+	}
+}
+
+func TestClientUnexpectedResponseType(t *testing.T) {
+	c, conn := newTestClient(func(m Message) Message {
+		switch m.(type) {
+		case *WalkRequest:
+			return &ReadResponse{}
+		case *ClunkRequest:
+			return &ErrorResponse{Error: "unknown fid"}
+		}
+		return &ErrorResponse{Error: "unexpected request"}
+	})
+	defer conn.Close()
+
+	_, err := c.Send(&WalkRequest{Fid: 1, NewFid: 2})
+	var pe *ProtocolError
+	if !errors.As(err, &pe) || pe.Err != ErrUnexpectedResponse {
+		t.Errorf("expected ProtocolError for wrong response type, got %v", err)
+	}
+
+	// An error is a valid response to any request.
+	resp, err := c.Send(&ClunkRequest{Fid: 1})
+	if err != nil {
+		t.Errorf("expected error response, got %v", err)
+	}
+	if _, ok := resp.(*ErrorResponse); !ok {
+		t.Errorf("expected ErrorResponse, got %T", resp)
+	}
+}
+
+func TestClientExtendedResponses(t *testing.T) {
+	extra := []byte{1, 2, 3}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go stubServer(c2, func(m Message) Message {
+		var resp Message
+		switch m := m.(type) {
+		case *WalkRequest:
+			resp = &WalkResponse{Qids: make([]Qid, len(m.Names))}
+		case *ClunkRequest:
+			if m.Fid == 100 {
+				resp = &ErrorResponse{Error: "unknown fid"}
+			} else {
+				resp = &ClunkResponse{}
+			}
+		default:
+			resp = &ErrorResponse{Error: "unexpected request"}
+		}
+		return &ExtendedMessage{Message: resp, Extra: extra}
+	})
+
+	s := NewSession(c1, NineP2000, 8192)
+	s.Decoder.PreserveExtensions = true
+	c := NewClient(s)
+
+	// Send returns the extensions, while the helpers see the wrapped
+	// responses.
+	resp, err := c.Send(&ClunkRequest{Fid: 1})
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if em, ok := resp.(*ExtendedMessage); !ok || !bytes.Equal(em.Extra, extra) {
+		t.Errorf("expected extended response, got %#v", resp)
+	}
+
+	root, _ := c.Fids().Get()
+	fid, qids, err := c.WalkPath(root, "usr/glenda")
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if len(qids) != 2 {
+		t.Errorf("expected 2 qids, got %d", len(qids))
+	}
+	if err = c.Clunk(fid); err != nil {
+		t.Errorf("clunk failed: %v", err)
+	}
+	if err = c.Clunk(100); err == nil || err.Error() != "unknown fid" {
+		t.Errorf("expected server error, got %v", err)
+	}
+}
+
+func TestClientRemove(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		requests []MessageType
+	)
+	c, conn := newTestClient(func(m Message) Message {
+		lock.Lock()
+		defer lock.Unlock()
+		mt, _ := NineP2000.MessageType(m)
+		requests = append(requests, mt)
+		if r, ok := m.(*RemoveRequest); ok {
+			if r.Fid == 0 {
+				return &RemoveResponse{}
+			}
+			return &ErrorResponse{Error: "permission denied"}
+		}
+		return &ErrorResponse{Error: "unexpected request"}
+	})
+	defer conn.Close()
+
+	tests := []struct {
+		err string
+	}{
+		{""},
+		{"permission denied"},
+	}
+	for i, tt := range tests {
+		fid, err := c.Fids().Get()
+		if err != nil {
+			t.Fatalf("test %d: unable to allocate fid: %v", i, err)
+		}
+
+		err = c.Remove(fid)
+		if tt.err == "" && err != nil {
+			t.Errorf("test %d: remove failed: %v", i, err)
+		}
+		if tt.err != "" {
+			var se *ServerError
+			if !errors.As(err, &se) || se.Message != tt.err {
+				t.Errorf("test %d: expected server error %q, got %v", i, tt.err, err)
+			}
+		}
+
+		// The fid is released without being clunked.
+		c.Fids().lock.Lock()
+		inUse := c.Fids().inUse[fid]
+		c.Fids().lock.Unlock()
+		if inUse {
+			t.Errorf("test %d: fid %d was not released", i, fid)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(requests, []MessageType{Tremove, Tremove}) {
+		t.Errorf("expected only remove requests, got %v", requests)
+	}
+}
+
+func TestClientStat(t *testing.T) {
+	stats := map[Fid]Stat{
+		1: {Qid: NewQid(QTFILE, 0, 1), Mode: 0644, Length: 5, Name: "a.txt", UID: "glenda", GID: "glenda", MUID: "glenda"},
+		2: {Qid: NewQid(QTDIR, 0, 2), Mode: DMDIR | 0755, Name: "dir", UID: "glenda", GID: "glenda", MUID: "glenda"},
+	}
+	c, conn := newTestClient(func(m Message) Message {
+		req, ok := m.(*StatRequest)
+		if !ok {
+			return &ErrorResponse{Error: "unexpected request"}
+		}
+		st, ok := stats[req.Fid]
+		if !ok {
+			return &ErrorResponse{Error: "unknown fid"}
+		}
+		return &StatResponse{Stat: st}
+	})
+	defer conn.Close()
+
+	for fid, expected := range stats {
+		st, err := c.Stat(fid)
+		if err != nil {
+			t.Errorf("fid %d: stat failed: %v", fid, err)
+			continue
+		}
+		if !Equal(&st, &expected) {
+			t.Errorf("fid %d: unexpected stat:\n%s", fid, Diff(&st, &expected))
+		}
+	}
+
+	var se *ServerError
+	if _, err := c.Stat(3); !errors.As(err, &se) || se.Message != "unknown fid" {
+		t.Errorf("expected server error, got %v", err)
+	}
+}
+
+func TestClientStatDotu(t *testing.T) {
+	var (
+		dir   []byte
+		stats []StatDotu
+	)
+	for i, name := range []string{"bin", "lib", "dev"} {
+		st := StatDotu{
+			Qid:        NewQid(QTFILE, 0, uint64(i)),
+			Mode:       0644,
+			Name:       name,
+			UID:        "glenda",
+			GID:        "glenda",
+			MUID:       "glenda",
+			Extensions: "c 1 3",
+			UIDno:      1000,
+			GIDno:      1000,
+			MUIDno:     1000,
+		}
+		b := make([]byte, st.EncodedSize())
+		if err := st.Marshal(b); err != nil {
+			t.Fatalf("unable to encode stat: %v", err)
+		}
+		dir = append(dir, b...)
+		stats = append(stats, st)
+	}
+
+	c, conn := newTestClientProtocol(NineP2000Dotu, func(m Message) Message {
+		switch m := m.(type) {
+		case *StatRequest:
+			return &StatResponseDotu{Stat: stats[0]}
+		case *ReadRequest:
+			if m.Offset >= uint64(len(dir)) {
+				return &ReadResponse{}
+			}
+			return &ReadResponse{Data: dir[m.Offset:]}
+		}
+		return &ErrorResponseDotu{Error: "unexpected request"}
+	})
+	defer conn.Close()
+
+	st, err := c.Stat(1)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if expected := stats[0].Stat(); st != expected {
+		t.Errorf("unexpected stat:\n%s", Diff(&st, &expected))
+	}
+
+	result, err := c.ReadDir(1)
+	if err != nil {
+		t.Fatalf("read dir failed: %v", err)
+	}
+	if len(result) != len(stats) {
+		t.Fatalf("expected %d entries, got %d", len(stats), len(result))
+	}
+	for i := range stats {
+		if expected := stats[i].Stat(); result[i] != expected {
+			t.Errorf("entry %d: expected %#v, got %#v", i, expected, result[i])
+		}
+	}
+}
+
+func TestClientCloseAll(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		clunked []Fid
+	)
+	c, conn := newTestClient(func(m Message) Message {
+		lock.Lock()
+		defer lock.Unlock()
+		switch m := m.(type) {
+		case *ClunkRequest:
+			clunked = append(clunked, m.Fid)
+			return &ClunkResponse{}
+		case *RemoveRequest:
+			return &RemoveResponse{}
+		}
+		return &ErrorResponse{Error: "unexpected request"}
+	})
+	defer conn.Close()
+
+	var fids []Fid
+	for i := 0; i < 6; i++ {
+		fid, err := c.Fids().Get()
+		if err != nil {
+			t.Fatalf("unable to allocate fid: %v", err)
+		}
+		fids = append(fids, fid)
+	}
+	if n := c.Fids().InUse(); n != 6 {
+		t.Errorf("expected 6 fids in use, got %d", n)
+	}
+
+	if err := c.Clunk(fids[1]); err != nil {
+		t.Fatalf("clunk failed: %v", err)
+	}
+	if err := c.Clunk(fids[4]); err != nil {
+		t.Fatalf("clunk failed: %v", err)
+	}
+	if err := c.Remove(fids[2]); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if n := c.Fids().InUse(); n != 3 {
+		t.Errorf("expected 3 fids in use, got %d", n)
+	}
+
+	if err := c.CloseAll(); err != nil {
+		t.Fatalf("close all failed: %v", err)
+	}
+	if n := c.Fids().InUse(); n != 0 {
+		t.Errorf("expected no fids in use, got %d", n)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	expected := []Fid{fids[1], fids[4], fids[0], fids[3], fids[5]}
+	if !reflect.DeepEqual(clunked, expected) {
+		t.Errorf("expected clunks of %v, got %v", expected, clunked)
+	}
+}
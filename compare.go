@@ -0,0 +1,95 @@
+package qp
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Equal reports whether two messages are of the same type and have equal
+// fields. Unlike reflect.DeepEqual, a nil slice is equal to an empty slice.
+func Equal(a, b Message) bool {
+	return Diff(a, b) == ""
+}
+
+// Diff returns a description of the differences between two messages, with
+// one line per differing field, or an empty string if the messages are equal
+// as defined by Equal. It is intended for test output.
+func Diff(a, b Message) string {
+	var diffs []string
+	diff(&diffs, "", reflect.ValueOf(a), reflect.ValueOf(b))
+	return strings.Join(diffs, "\n")
+}
+
+// diff appends the differences between a and b to diffs, with field names
+// relative to path.
+func diff(diffs *[]string, path string, a, b reflect.Value) {
+	name := path
+	if name == "" {
+		name = "message"
+	}
+
+	if !a.IsValid() || !b.IsValid() {
+		if a.IsValid() != b.IsValid() {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %v != %v", name, a, b))
+		}
+		return
+	}
+
+	if a.Type() != b.Type() {
+		*diffs = append(*diffs, fmt.Sprintf("%s: type %v != %v", name, a.Type(), b.Type()))
+		return
+	}
+
+	switch a.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			if a.IsNil() != b.IsNil() {
+				*diffs = append(*diffs, fmt.Sprintf("%s: %v != %v", name, a, b))
+			}
+			return
+		}
+		diff(diffs, path, a.Elem(), b.Elem())
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			field := a.Type().Field(i).Name
+			if path != "" {
+				field = path + "." + field
+			}
+			diff(diffs, field, a.Field(i), b.Field(i))
+		}
+	case reflect.Slice, reflect.Array:
+		if a.Kind() == reflect.Slice && a.Type().Elem().Kind() == reflect.Uint8 {
+			if !bytes.Equal(a.Bytes(), b.Bytes()) {
+				*diffs = append(*diffs, fmt.Sprintf("%s: %v != %v", name, a, b))
+			}
+			return
+		}
+		if a.Len() != b.Len() {
+			*diffs = append(*diffs, fmt.Sprintf("%s: length %d != %d", name, a.Len(), b.Len()))
+			return
+		}
+		for i := 0; i < a.Len(); i++ {
+			diff(diffs, fmt.Sprintf("%s[%d]", name, i), a.Index(i), b.Index(i))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if a.Int() != b.Int() {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %v != %v", name, a, b))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if a.Uint() != b.Uint() {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %v != %v", name, a, b))
+		}
+	case reflect.String:
+		if a.String() != b.String() {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %q != %q", name, a.String(), b.String()))
+		}
+	case reflect.Bool:
+		if a.Bool() != b.Bool() {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %v != %v", name, a, b))
+		}
+	default:
+		*diffs = append(*diffs, fmt.Sprintf("%s: cannot compare %v", name, a.Kind()))
+	}
+}
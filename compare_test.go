@@ -0,0 +1,38 @@
+package qp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEqual(t *testing.T) {
+	for i, tt := range MessageTestData {
+		other := ConstructNewMarshallable(tt.input).(Message)
+		if err := other.Unmarshal(tt.reference); err != nil {
+			t.Fatalf("test %d: unable to decode %T: %v", i, tt.input, err)
+		}
+		if !Equal(tt.input, other) {
+			t.Errorf("test %d: %T not equal to itself after decoding:\n%s", i, tt.input, Diff(tt.input, other))
+		}
+	}
+
+	if !Equal(&ReadResponse{Tag: 1}, &ReadResponse{Tag: 1, Data: []byte{}}) {
+		t.Errorf("nil data not equal to empty data")
+	}
+	if !Equal(&WalkRequest{Tag: 1}, &WalkRequest{Tag: 1, Names: []string{}}) {
+		t.Errorf("nil names not equal to empty names")
+	}
+
+	a := &ReadResponse{Tag: 1, Data: []byte("hello")}
+	b := &ReadResponse{Tag: 2, Data: []byte("hello")}
+	if Equal(a, b) {
+		t.Errorf("messages with different tags reported equal")
+	}
+	if d := Diff(a, b); !strings.HasPrefix(d, "Tag: ") || strings.Contains(d, "\n") {
+		t.Errorf("expected a single difference in Tag, got %q", d)
+	}
+
+	if Equal(&ClunkResponse{Tag: 1}, &RemoveResponse{Tag: 1}) {
+		t.Errorf("messages of different types reported equal")
+	}
+}
@@ -1,10 +1,15 @@
 package qp
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"sync"
+	"time"
 )
 
 var (
@@ -14,81 +19,1110 @@ var (
 	// ErrMessageTooBig indicates that the message, when encoded and wrapped in
 	// container, does not fit in the configured message size.
 	ErrMessageTooBig = errors.New("message size larger than buffer")
+
+	// ErrMessageTooSmall indicates that the size field of a message is smaller
+	// than the message header, meaning that the stream is corrupt.
+	ErrMessageTooSmall = errors.New("message size smaller than header")
+
+	// ErrFieldTooBig indicates that a string or list in a decoded message
+	// exceeded the limits configured on the decoder. It is returned wrapped
+	// in a *DecodeError naming the field.
+	ErrFieldTooBig = errors.New("message field larger than limit")
+
+	// ErrIdleTimeout indicates that no message arrived within the configured
+	// idle timeout. The stream is still intact.
+	ErrIdleTimeout = errors.New("idle timeout")
+
+	// ErrMessageStalled indicates that the configured idle timeout expired
+	// while a message was only partially received. The stream is no longer
+	// usable.
+	ErrMessageStalled = errors.New("message stalled")
+
+	// ErrStreamCorrupt indicates that a message was only partially written,
+	// leaving the peer with a truncated message. The connection is no longer
+	// usable, and must be closed.
+	ErrStreamCorrupt = errors.New("stream corrupted by partial write")
+
+	// ErrSizeMismatch indicates that the size field of a message does not
+	// match the length of the frame it was decoded from.
+	ErrSizeMismatch = errors.New("message size does not match frame")
+
+	// ErrTrailingData indicates that a message body contained data after the
+	// last field of the message.
+	ErrTrailingData = errors.New("trailing data after message")
+
+	// ErrQueueClosed indicates that a message was enqueued after the write
+	// queue of the Encoder was closed.
+	ErrQueueClosed = errors.New("write queue closed")
+
+	// ErrCountTooBig indicates that the count of a read or write does not fit
+	// in the message size.
+	ErrCountTooBig = errors.New("count larger than message size permits")
+
+	// ErrOffsetOverflow indicates that the offset and count of a read or write
+	// exceed the largest possible offset.
+	ErrOffsetOverflow = errors.New("offset and count overflow")
+
+	// ErrCountMismatch indicates that the count of a read response or write
+	// request does not match the amount of data in the message.
+	ErrCountMismatch = errors.New("count does not match data length")
+
+	// ErrChecksumMismatch indicates that the checksum of a received message
+	// does not match its content, meaning that it was corrupted in transit.
+	ErrChecksumMismatch = errors.New("message checksum mismatch")
+
+	// ErrInvalidAlign indicates that the alignment of an Encoder or Decoder
+	// is larger than padding permits.
+	ErrInvalidAlign = errors.New("invalid alignment")
+
+	// ErrInvalidPadding indicates that the padding of a received message does
+	// not match the alignment of the Decoder.
+	ErrInvalidPadding = errors.New("invalid message padding")
+
+	// ErrEncoderClosed indicates that a message was written to, or was being
+	// written to, an Encoder that has been closed.
+	ErrEncoderClosed = errors.New("encoder closed")
+
+	// ErrStatSizeMismatch indicates that the size prefixes of an encoded stat
+	// do not match the size of its fields.
+	ErrStatSizeMismatch = errors.New("stat size does not match content")
+
+	// ErrStatTooBig indicates that a stat, or one of its strings, is too
+	// large for its 16-bit size prefix.
+	ErrStatTooBig = errors.New("stat too big")
+
+	// ErrBodyTooSmall indicates that the size field of a message leaves less
+	// room for the body than the fixed fields of its type require.
+	ErrBodyTooSmall = errors.New("message body smaller than its fixed fields")
+
+	// ErrTypeMismatch indicates that a decoded message is of a different type
+	// than the message it was to be decoded into.
+	ErrTypeMismatch = errors.New("message type mismatch")
 )
 
+// checksumSize is the size of the checksum appended to messages when
+// checksums are enabled.
+const checksumSize = 4
+
+// maxAlign is the largest alignment supported, as the length of the padding
+// is stored in a single byte.
+const maxAlign = 255
+
+// MessageTooBigError is returned when a message exceeds the message size. It
+// matches ErrMessageTooBig when used with errors.Is.
+type MessageTooBigError struct {
+	// Size is the size of the message, including the header. Sizes that do
+	// not fit in an int are reported as the largest int.
+	Size int
+
+	// Max is the message size that was exceeded.
+	Max int
+}
+
+func (e *MessageTooBigError) Error() string {
+	return fmt.Sprintf("%s: %d > %d", ErrMessageTooBig, e.Size, e.Max)
+}
+
+// Is reports whether target is ErrMessageTooBig.
+func (e *MessageTooBigError) Is(target error) bool {
+	return target == ErrMessageTooBig
+}
+
+// maxInt is the largest value of an int.
+const maxInt = int(^uint(0) >> 1)
+
+// tooBig returns a *MessageTooBigError for a message of size s exceeding max.
+// Sizes that do not fit in an int, which are possible with an 8 byte size
+// field, are reported as the largest int.
+func tooBig(s uint64, max int) error {
+	size := maxInt
+	if s < uint64(maxInt) {
+		size = int(s)
+	}
+	return &MessageTooBigError{Size: size, Max: max}
+}
+
+// UnknownMessageError is returned when encoding a message that has no message
+// type in the Protocol, such as a message of another dialect. It matches
+// ErrUnknownMessageType when used with errors.Is.
+type UnknownMessageError struct {
+	// Message is the message that could not be encoded.
+	Message Message
+}
+
+func (e *UnknownMessageError) Error() string {
+	return fmt.Sprintf("%s: %T", ErrUnknownMessageType, e.Message)
+}
+
+// Is reports whether target is ErrUnknownMessageType.
+func (e *UnknownMessageError) Is(target error) bool {
+	return target == ErrUnknownMessageType
+}
+
+// messageType looks up the message type of m, or of the message wrapped by an
+// *ExtendedMessage, naming the type of m in the error if it is unknown. It
+// must be called before m is marshalled.
+func messageType(p Protocol, m Message) (MessageType, error) {
+	m = BaseMessage(m)
+	mt, err := p.MessageType(m)
+	if err == ErrUnknownMessageType {
+		return 0, &UnknownMessageError{Message: m}
+	}
+	return mt, err
+}
+
 // Protocol defines a protocol message encoder/decoder
 type Protocol interface {
 	MessageType(Message) (MessageType, error)
 	Message(MessageType) (Message, error)
 }
 
+// TypeLister is optionally implemented by a Protocol to enumerate the message
+// types it supports, such as for generating test data or documentation. All
+// protocols in this package implement it.
+type TypeLister interface {
+	// Types returns the supported message types. A message for each can be
+	// obtained with Message.
+	Types() []MessageType
+}
+
 // Default is the protocol used by the raw Encode and Decode functions.
 var Default = NineP2000
 
 // MessageType is the type of the contained message.
 type MessageType byte
 
+// typePair is a request type and the type of its response. Their names are
+// name prefixed with T and R respectively.
+type typePair struct {
+	name     string
+	req, rep MessageType
+}
+
+// pairTypes returns the request and response types of pairs.
+func pairTypes(pairs []typePair) []MessageType {
+	types := make([]MessageType, 0, 2*len(pairs))
+	for _, p := range pairs {
+		types = append(types, p.req, p.rep)
+	}
+	return types
+}
+
+// messageTypeNames maps the message types of all supported protocols to their
+// names, and responseTypes maps their request types to the type of their
+// response. Both are built from the type pairs of the protocols.
+var messageTypeNames, responseTypes = typeTables(nineP2000Pairs, nineP2000DotePairs)
+
+// typeTables builds the name and response type tables for the provided type
+// pairs, and Rerror, which has no request.
+func typeTables(pairs ...[]typePair) (map[MessageType]string, map[MessageType]MessageType) {
+	names := map[MessageType]string{Rerror: "Rerror"}
+	responses := make(map[MessageType]MessageType)
+	for _, ps := range pairs {
+		for _, p := range ps {
+			names[p.req] = "T" + p.name
+			names[p.rep] = "R" + p.name
+			responses[p.req] = p.rep
+		}
+	}
+	return names, responses
+}
+
+// String returns the name of the message type, such as "Twalk", or
+// "MessageType(n)" if the type is unknown.
+func (mt MessageType) String() string {
+	if name, ok := messageTypeNames[mt]; ok {
+		return name
+	}
+	return fmt.Sprintf("MessageType(%d)", byte(mt))
+}
+
+// ParseMessageType returns the message type with the provided name, such as
+// "Twalk". The name is case sensitive. The boolean is false if no message type
+// has the provided name.
+func ParseMessageType(name string) (MessageType, bool) {
+	for mt, n := range messageTypeNames {
+		if n == name {
+			return mt, true
+		}
+	}
+	return 0, false
+}
+
+// ResponseTypeValid reports whether a response of type rep is a valid reply
+// to a request of type req, which is the matching response type, or Rerror.
+// It returns false if req is not a request type of 9P2000, 9P2000.u or
+// 9P2000.e.
+func ResponseTypeValid(req, rep MessageType) bool {
+	expected, ok := responseTypes[req]
+	return ok && (rep == expected || rep == Rerror)
+}
+
+// DecodeExact decodes a single framed message that occupies exactly all of b,
+// using the Default protocol. ErrSizeMismatch is returned if the size field
+// does not equal len(b), and ErrTrailingData if the message body is not fully
+// consumed by the message fields.
+func DecodeExact(b []byte) (Message, error) {
+	return decodeFrame(Default, b)
+}
+
+// DecodeAll decodes all framed messages in b, such as a captured session
+// dump, using the provided protocol. If b ends with an incomplete message,
+// the messages decoded so far are returned together with
+// ErrPayloadTooShort.
+func DecodeAll(p Protocol, b []byte) ([]Message, error) {
+	var msgs []Message
+	for len(b) > 0 {
+		if len(b) < HeaderSize {
+			return msgs, ErrPayloadTooShort
+		}
+
+		s := binary.LittleEndian.Uint32(b[0:4])
+		if s < HeaderSize {
+			return msgs, ErrMessageTooSmall
+		}
+		if uint64(s) > uint64(len(b)) {
+			return msgs, ErrPayloadTooShort
+		}
+
+		m, err := decodeFrame(p, b[:s])
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, m)
+		b = b[s:]
+	}
+	return msgs, nil
+}
+
+// DecodeAt decodes the framed message starting at offset off of r, using the
+// Default protocol. The total size of the message is returned, so that the
+// next message can be found at off plus the size. io.EOF is returned if off
+// is at the end of r, and io.ErrUnexpectedEOF if the message is truncated. A
+// message larger than msize fails with a *MessageTooBigError before its body
+// is read. Like the MessageSize of a Decoder, an msize of 0 means no limit,
+// in which case the body is allocated from the size field alone, so it should
+// only be used with trusted input.
+func DecodeAt(r io.ReaderAt, off int64, msize uint32) (Message, int, error) {
+	hdr := make([]byte, HeaderSize)
+	n, err := r.ReadAt(hdr, off)
+	if n < len(hdr) {
+		if err == io.EOF && n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+
+	s := binary.LittleEndian.Uint32(hdr[0:4])
+	if s < HeaderSize {
+		return nil, 0, ErrMessageTooSmall
+	}
+	if msize > 0 && s > msize {
+		return nil, 0, &MessageTooBigError{Size: int(s), Max: int(msize)}
+	}
+
+	b := make([]byte, s)
+	copy(b, hdr)
+	n, err = r.ReadAt(b[HeaderSize:], off+HeaderSize)
+	if n < len(b)-HeaderSize {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+
+	m, err := decodeFrame(Default, b)
+	if err != nil {
+		return nil, 0, err
+	}
+	return m, int(s), nil
+}
+
+// SkipMessage reads the header of the next framed message from r, and
+// discards its body without decoding it, such as for a message type that is
+// not supported. The type of the skipped message is returned, and r is left
+// at the start of the next message. io.EOF is returned if r is at the end,
+// and io.ErrUnexpectedEOF if the message is truncated.
+func SkipMessage(r io.Reader) (MessageType, error) {
+	hdr := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, err
+	}
+
+	s := binary.LittleEndian.Uint32(hdr[0:4])
+	if s < HeaderSize {
+		return 0, ErrMessageTooSmall
+	}
+
+	body := int64(s) - HeaderSize
+	if n, err := io.CopyN(ioutil.Discard, r, body); n < body {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return MessageType(hdr[4]), nil
+}
+
+// DecodeInto reads the next framed message from r, and decodes it into m,
+// which allows callers to reuse messages of known types. The type of the
+// message must match the type of m in protocol p, or ErrTypeMismatch is
+// returned. The whole message is consumed from r in either case. Errors from
+// decoding the body are returned as a *DecodeError. A message larger than
+// msize fails with a *MessageTooBigError before its body is read, leaving r
+// at the body. Like the MessageSize of a Decoder, an msize of 0 means no
+// limit, in which case the body is allocated from the size field alone, so it
+// should only be used with trusted input.
+func DecodeInto(p Protocol, r io.Reader, m Message, msize uint32) error {
+	expected, err := p.MessageType(m)
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, HeaderSize)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return err
+	}
+
+	s := binary.LittleEndian.Uint32(hdr[0:4])
+	if s < HeaderSize {
+		return ErrMessageTooSmall
+	}
+	if msize > 0 && s > msize {
+		return &MessageTooBigError{Size: int(s), Max: int(msize)}
+	}
+
+	b := make([]byte, s-HeaderSize)
+	if _, err = io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	mt := MessageType(hdr[4])
+	if mt != expected {
+		return ErrTypeMismatch
+	}
+	fr := fieldReader{b: b}
+	if err = unmarshalFields(m, &fr); err != nil {
+		return &DecodeError{Type: mt, Field: fr.field, Err: err}
+	}
+	return nil
+}
+
+// MinSize returns the smallest possible body size of messages of type mt in
+// protocol p, which is the size with all variable-length fields, such as
+// strings and lists, empty. It is the EncodedSize of the empty message
+// returned by p.Message.
+func MinSize(p Protocol, mt MessageType) (int, error) {
+	m, err := p.Message(mt)
+	if err != nil {
+		return 0, err
+	}
+	return m.EncodedSize(), nil
+}
+
+// EncodeBody encodes a message without the size and type header, for use with
+// transports that provide their own framing. The message type is returned
+// alongside the body, and must be conveyed to DecodeBody.
+func EncodeBody(p Protocol, m Message) (MessageType, []byte, error) {
+	mt, err := messageType(p, m)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	b := make([]byte, m.EncodedSize())
+	if err = m.Marshal(b); err != nil {
+		return 0, nil, err
+	}
+	return mt, b, nil
+}
+
+// DecodeBody decodes a message body of the provided type, as returned by
+// EncodeBody. Errors from decoding the body are returned as a *DecodeError.
+func DecodeBody(p Protocol, mt MessageType, body []byte) (Message, error) {
+	m, err := p.Message(mt)
+	if err != nil {
+		return nil, err
+	}
+	fr := fieldReader{b: body}
+	if err = unmarshalFields(m, &fr); err != nil {
+		return nil, &DecodeError{Type: mt, Field: fr.field, Err: err}
+	}
+	return m, nil
+}
+
+// DecodeTypedBody reads a message body of bodyLen bytes from r, and decodes
+// it as a message of the provided type, for transports that convey the type
+// and length of the message out of band. The whole body is consumed from r
+// even if it cannot be decoded. io.ErrUnexpectedEOF is returned if r ends
+// before the body is complete.
+func DecodeTypedBody(p Protocol, mt MessageType, r io.Reader, bodyLen int) (Message, error) {
+	if bodyLen < 0 {
+		return nil, ErrMessageTooSmall
+	}
+
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF && bodyLen > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return DecodeBody(p, mt, body)
+}
+
+// FramedMessage is a message paired with the Protocol used to encode it. It
+// implements io.WriterTo, allowing a message to be written directly to an
+// io.Writer, such as with FramedMessage{NineP2000, m}.WriteTo(conn).
+type FramedMessage struct {
+	Protocol Protocol
+	Message  Message
+}
+
+// WriteTo encodes the message with its size and type header and writes it to
+// w with a single call to Write. The output is identical to that of
+// Encoder.WriteMessage with a 4 byte size field and no message size limit.
+func (f FramedMessage) WriteTo(w io.Writer) (int64, error) {
+	e := Encoder{Protocol: f.Protocol}
+	buf, err := e.encode(f.Message, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(buf)
+	if err == nil && n < len(buf) {
+		err = io.ErrShortWrite
+	}
+	return int64(n), err
+}
+
+// decodeFrame decodes a single framed message that occupies exactly all of b.
+func decodeFrame(p Protocol, b []byte) (Message, error) {
+	if len(b) < HeaderSize {
+		return nil, ErrPayloadTooShort
+	}
+
+	s := binary.LittleEndian.Uint32(b[0:4])
+	if s < HeaderSize {
+		return nil, ErrMessageTooSmall
+	}
+	if uint64(s) != uint64(len(b)) {
+		return nil, ErrSizeMismatch
+	}
+
+	body := b[HeaderSize:]
+	m, err := DecodeBody(p, MessageType(b[4]), body)
+	if err != nil {
+		return nil, err
+	}
+	if m.EncodedSize() != len(body) {
+		return nil, ErrTrailingData
+	}
+	return m, nil
+}
+
 // Message is an interface describing an item that can encode itself to a
-// writer, decode itself from a reader. It is also capable of getting the
-// message tag, which is merely a convenience feature to save a type assert
-// for access to the tag.
+// writer, decode itself from a reader. Messages that carry a tag, which
+// includes all messages of the supported protocols, also implement Tagged.
 type Message interface {
 	Marshal(b []byte) error
 	Unmarshal(b []byte) error
 	EncodedSize() int
+}
+
+// Tagged is implemented by messages that carry a tag. Messages without a tag
+// can be encoded and decoded, but cannot be sent by a Client.
+type Tagged interface {
 	GetTag() Tag
+	SetTag(Tag)
+}
+
+// MessageTag returns the tag of a message, or NOTAG if the message does not
+// implement Tagged.
+func MessageTag(m Message) Tag {
+	if tm, ok := m.(Tagged); ok {
+		return tm.GetTag()
+	}
+	return NOTAG
+}
+
+// ExtendedMessage is a message followed by extension bytes that are not part
+// of its fields, as returned by a Decoder with PreserveExtensions set. It
+// encodes as the message with Extra appended to its body, and has the message
+// type of the wrapped message.
+type ExtendedMessage struct {
+	Message
+
+	// Extra holds the extension bytes following the fields of Message.
+	Extra []byte
+}
+
+// BaseMessage returns the message wrapped by m if it is an *ExtendedMessage,
+// and m itself otherwise. It allows handling messages by their concrete type
+// regardless of whether they carry extensions.
+func BaseMessage(m Message) Message {
+	if em, ok := m.(*ExtendedMessage); ok {
+		return em.Message
+	}
+	return m
+}
+
+func (em *ExtendedMessage) EncodedSize() int {
+	return em.Message.EncodedSize() + len(em.Extra)
+}
+
+func (em *ExtendedMessage) Marshal(b []byte) error {
+	n := em.Message.EncodedSize()
+	if err := em.Message.Marshal(b[:n]); err != nil {
+		return err
+	}
+	copy(b[n:], em.Extra)
+	return nil
+}
+
+func (em *ExtendedMessage) Unmarshal(b []byte) error {
+	if err := em.Message.Unmarshal(b); err != nil {
+		return err
+	}
+	em.Extra = append(em.Extra[:0], b[em.Message.EncodedSize():]...)
+	return nil
+}
+
+// GetTag returns the tag of the wrapped message, or NOTAG if it has none.
+func (em *ExtendedMessage) GetTag() Tag {
+	return MessageTag(em.Message)
+}
+
+// SetTag sets the tag of the wrapped message, if it has one.
+func (em *ExtendedMessage) SetTag(t Tag) {
+	if tm, ok := em.Message.(Tagged); ok {
+		tm.SetTag(t)
+	}
 }
 
 // Encoder handles writes encoded messages to an io.Writer. Encoder is thread
 // safe, and may be called in parallel from arbitrary goroutines.
+//
+// If the Writer buffers data, such as a *bufio.Writer, written messages may
+// not reach the peer until Flush is called. Callers that wait for a response
+// after writing a request must call Flush before reading, or the response
+// may never arrive. Setting AutoFlush removes the need for this, while
+// FlushDelay bounds how long messages stay buffered.
 type Encoder struct {
-	// Protocol is the protocol codec used for encoding messages.
+	// Protocol is the protocol codec used for encoding messages. It must be
+	// changed with SetProtocol if WriteMessage may be running.
 	Protocol Protocol
 
 	// Writer is the writer to encode messages to.
 	Writer io.Writer
 
 	// MessageSize is the maximum message size negotiated for the protocol. It
-	// is used to enforce a limit on writes.
+	// is used to enforce a limit on writes. It must be changed with
+	// SetMessageSize if WriteMessage may be running.
 	MessageSize uint32
 
+	// AutoFlush makes the Encoder flush the Writer after every message, if
+	// the Writer has a Flush method.
+	AutoFlush bool
+
+	// FlushDelay makes the Encoder flush the Writer once FlushDelay has passed
+	// since the first message written after the previous flush, if the Writer
+	// has a Flush method and AutoFlush is not set. This bounds the time small
+	// messages sit in the buffer, while still coalescing bursts of messages
+	// into fewer writes. The pending flush is cancelled by Flush and Close.
+	// An error from a delayed flush is returned by the next call to Flush.
+	// The default of 0 disables delayed flushing.
+	FlushDelay time.Duration
+
+	// SizeWidth is the width in bytes of the size field in the message
+	// header, which must be 4 or 8. The default of 0 means 4, as required by
+	// 9P. A width of 8 is not 9P compatible, but permits messages larger than
+	// 4GB for experimental framing.
+	SizeWidth int
+
+	// Checksum appends a CRC-32 (IEEE) checksum of the header and body to
+	// every message, which is included in the size field. This is not 9P
+	// compatible, and can only be used when the peer decodes with
+	// Decoder.Checksum set, such as over transports that may corrupt data.
+	Checksum bool
+
+	// Align pads every message to a multiple of Align bytes, with the padding
+	// included in the size field. The padding is between 1 and Align bytes
+	// long, and its last byte holds its length, so that a Decoder with the
+	// same Align can strip it. Align must be at most 255. The default of 0
+	// disables padding. This is not 9P compatible.
+	Align int
+
+	// Stats, if set, records the size of every encoded message, including its
+	// header.
+	Stats *SizeStats
+
 	// writeLock is used to synchronize writes. Without it, messages would end
 	// up interleaved and incomprehensible.
 	writeLock sync.Mutex
+
+	// corrupt is set when a message has been partially written.
+	corrupt bool
+
+	// scratch is the buffer used to encode messages for WriteMessage. It is
+	// protected by writeLock.
+	scratch []byte
+
+	// queueLock protects queue and queueClosed, and orders enqueued messages.
+	queueLock   sync.Mutex
+	queue       chan queuedWrite
+	queueDone   chan struct{}
+	queueClosed bool
+
+	// queueErrLock protects queueErr.
+	queueErrLock sync.Mutex
+
+	// queueErr is the first error encountered while writing queued messages.
+	queueErr error
+
+	// closeLock protects closed. It is separate from writeLock, so that Close
+	// does not wait for a blocked write.
+	closeLock sync.Mutex
+	closed    bool
+
+	// timerLock protects flushTimer, flushGen and flushErr. It is separate
+	// from writeLock, so that Close can cancel the timer without waiting for
+	// a blocked write.
+	timerLock sync.Mutex
+
+	// flushTimer is the pending delayed flush, if any. flushGen identifies
+	// the pending timer, so that a timer that fires after being cancelled
+	// does nothing.
+	flushTimer *time.Timer
+	flushGen   uint64
+
+	// flushErr is the error of the last delayed flush.
+	flushErr error
+
+	// configLock protects Protocol and MessageSize, so that they can be
+	// changed with SetProtocol and SetMessageSize while WriteMessage is
+	// running.
+	configLock sync.Mutex
+}
+
+// SetProtocol changes the Protocol of the encoder. Unlike assigning to
+// Protocol, it may be called concurrently with WriteMessage. The new Protocol
+// is used for all messages whose encoding starts after the call.
+func (e *Encoder) SetProtocol(p Protocol) {
+	e.configLock.Lock()
+	defer e.configLock.Unlock()
+	e.Protocol = p
+}
+
+// protocol returns the current Protocol.
+func (e *Encoder) protocol() Protocol {
+	e.configLock.Lock()
+	defer e.configLock.Unlock()
+	return e.Protocol
+}
+
+// SetMessageSize changes the MessageSize of the encoder. Unlike assigning to
+// MessageSize, it may be called concurrently with WriteMessage. The new size
+// applies to all messages whose encoding starts after the call.
+func (e *Encoder) SetMessageSize(msize uint32) {
+	e.configLock.Lock()
+	defer e.configLock.Unlock()
+	e.MessageSize = msize
+}
+
+// messageSize returns the current MessageSize.
+func (e *Encoder) messageSize() uint32 {
+	e.configLock.Lock()
+	defer e.configLock.Unlock()
+	return e.MessageSize
+}
+
+// configure changes both the Protocol and the MessageSize of the encoder in
+// one step, so that no message is encoded with only one of them changed.
+func (e *Encoder) configure(p Protocol, msize uint32) {
+	e.configLock.Lock()
+	defer e.configLock.Unlock()
+	e.Protocol = p
+	e.MessageSize = msize
+}
+
+// queuedWrite is an entry in the write queue of an Encoder. If done is set,
+// the entry is a marker that is closed when all preceding entries have been
+// written.
+type queuedWrite struct {
+	buf  []byte
+	done chan struct{}
+}
+
+// sizeWidth returns the width of the size field for a SizeWidth setting.
+func sizeWidth(w int) int {
+	if w == 8 {
+		return 8
+	}
+	return 4
+}
+
+// putSize encodes a message size into a size field of width len(b).
+func putSize(b []byte, s uint64) {
+	if len(b) == 8 {
+		binary.LittleEndian.PutUint64(b, s)
+		return
+	}
+	binary.LittleEndian.PutUint32(b, uint32(s))
+}
+
+// getSize decodes a message size from a size field of width len(b).
+func getSize(b []byte) uint64 {
+	if len(b) == 8 {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return uint64(binary.LittleEndian.Uint32(b))
+}
+
+// encode encodes a message with its header into buf, which is grown if too
+// small. The encoded message is returned.
+func (e *Encoder) encode(m Message, buf []byte) ([]byte, error) {
+	mt, err := messageType(e.protocol(), m)
+	if err != nil {
+		return nil, err
+	}
+
+	w := sizeWidth(e.SizeWidth)
+	size := m.EncodedSize() + w + 1
+	if e.Checksum {
+		size += checksumSize
+	}
+	pad := 0
+	if e.Align > 0 {
+		if e.Align > maxAlign {
+			return nil, ErrInvalidAlign
+		}
+		pad = e.Align - size%e.Align
+		size += pad
+	}
+	if msize := e.messageSize(); msize > 0 && size > int(msize) {
+		return nil, &MessageTooBigError{Size: size, Max: int(msize)}
+	}
+
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	putSize(buf[:w], uint64(len(buf)))
+	buf[w] = byte(mt)
+
+	end := size - pad
+	body := end
+	if e.Checksum {
+		body -= checksumSize
+	}
+	if err = m.Marshal(buf[w+1 : body]); err != nil {
+		return nil, err
+	}
+	if e.Checksum {
+		binary.LittleEndian.PutUint32(buf[body:end], crc32.ChecksumIEEE(buf[:body]))
+	}
+	if pad > 0 {
+		for i := end; i < size-1; i++ {
+			buf[i] = 0
+		}
+		buf[size-1] = byte(pad)
+	}
+	if e.Stats != nil {
+		e.Stats.Record(mt, uint64(size))
+	}
+	return buf, nil
+}
+
+// write writes an encoded message with a single call to Write, flushing the
+// Writer afterwards if AutoFlush is set.
+func (e *Encoder) write(buf []byte) error {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+	_, err := e.writeLocked(buf)
+	return err
+}
+
+// writeLocked is like write, but writeLock must be held. The amount of bytes
+// written is returned.
+func (e *Encoder) writeLocked(buf []byte) (int, error) {
+	if e.isClosed() {
+		return 0, ErrEncoderClosed
+	}
+	if e.corrupt {
+		return 0, ErrStreamCorrupt
+	}
+
+	n, err := e.Writer.Write(buf)
+	if err != nil && e.isClosed() {
+		// The write was interrupted by Close.
+		return n, ErrEncoderClosed
+	}
+	if n > 0 && n < len(buf) {
+		e.corrupt = true
+		return n, ErrStreamCorrupt
+	}
+	switch {
+	case err != nil:
+	case e.AutoFlush:
+		err = e.flush()
+	case e.FlushDelay > 0:
+		e.scheduleFlush()
+	}
+	return n, err
+}
+
+// scheduleFlush starts the delayed flush timer if the Writer has a Flush
+// method and no flush is pending.
+func (e *Encoder) scheduleFlush() {
+	if _, ok := e.Writer.(interface {
+		Flush() error
+	}); !ok {
+		return
+	}
+
+	e.timerLock.Lock()
+	defer e.timerLock.Unlock()
+	if e.flushTimer != nil {
+		return
+	}
+	e.flushGen++
+	gen := e.flushGen
+	e.flushTimer = time.AfterFunc(e.FlushDelay, func() { e.delayedFlush(gen) })
+}
+
+// cancelFlush stops the pending delayed flush, if any, returning the error of
+// the last delayed flush.
+func (e *Encoder) cancelFlush() error {
+	e.timerLock.Lock()
+	defer e.timerLock.Unlock()
+	if e.flushTimer != nil {
+		e.flushTimer.Stop()
+		e.flushTimer = nil
+	}
+	err := e.flushErr
+	e.flushErr = nil
+	return err
+}
+
+// delayedFlush flushes the Writer when the flush timer of generation gen
+// fires, unless it has been cancelled.
+func (e *Encoder) delayedFlush(gen uint64) {
+	e.timerLock.Lock()
+	if e.flushTimer == nil || e.flushGen != gen {
+		e.timerLock.Unlock()
+		return
+	}
+	e.flushTimer = nil
+	e.timerLock.Unlock()
+
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+	if e.isClosed() {
+		return
+	}
+	if err := e.flush(); err != nil {
+		e.timerLock.Lock()
+		e.flushErr = err
+		e.timerLock.Unlock()
+	}
+}
+
+// flush flushes the Writer if it has a Flush method. writeLock must be held.
+func (e *Encoder) flush() error {
+	if f, ok := e.Writer.(interface {
+		Flush() error
+	}); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Flush waits for all enqueued messages to be written, and flushes the Writer
+// if it has a Flush method, such as a *bufio.Writer. The first error
+// encountered while writing queued messages is returned if any. Flush must be
+// called before waiting for a response to a written request, unless
+// AutoFlush is set.
+func (e *Encoder) Flush() error {
+	e.queueLock.Lock()
+	var done chan struct{}
+	switch {
+	case e.queue == nil:
+	case e.queueClosed:
+		done = e.queueDone
+	default:
+		done = make(chan struct{})
+		e.queue <- queuedWrite{done: done}
+	}
+	e.queueLock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+	if err := e.queueError(); err != nil {
+		return err
+	}
+
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+	if e.isClosed() {
+		return ErrEncoderClosed
+	}
+	err := e.cancelFlush()
+	if ferr := e.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// Close closes the Encoder, and closes the Writer if it implements
+// io.Closer, such as a net.Conn. Closing the Writer unblocks a write that is
+// stalled because the peer stopped reading, without waiting for the write
+// lock held by it. The interrupted write and all subsequent writes return
+// ErrEncoderClosed. Closing an already closed Encoder does nothing.
+func (e *Encoder) Close() error {
+	e.closeLock.Lock()
+	if e.closed {
+		e.closeLock.Unlock()
+		return nil
+	}
+	e.closed = true
+	e.closeLock.Unlock()
+	e.cancelFlush()
+
+	if c, ok := e.Writer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// isClosed returns whether Close has been called.
+func (e *Encoder) isClosed() bool {
+	e.closeLock.Lock()
+	defer e.closeLock.Unlock()
+	return e.closed
 }
 
 // WriteMessage encodes a message and writes it to the Encoders associated
-// io.Writer.
+// io.Writer. The message is written with a single call to Write. If that
+// call fails without writing anything, the error is returned as is, and the
+// stream is still usable. If it fails after writing only part of the message,
+// ErrStreamCorrupt is returned, both for the failed call and all subsequent
+// calls, and the connection must be closed.
 func (e *Encoder) WriteMessage(m Message) error {
-	var (
-		mt  MessageType
-		err error
-	)
+	_, err := e.WriteMessageN(m)
+	return err
+}
+
+// WriteMessageN is like WriteMessage, but also returns the amount of bytes
+// written, including the header, such as for accounting the traffic of a
+// connection. If the write fails, the amount of bytes written before the
+// failure is returned.
+func (e *Encoder) WriteMessageN(m Message) (int, error) {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	// As writes are serialized, a single scratch buffer can be reused for
+	// all messages.
+	buf, err := e.encode(m, e.scratch)
+	if err != nil {
+		return 0, err
+	}
+	e.scratch = buf
+	return e.writeLocked(buf)
+}
 
-	if mt, err = e.Protocol.MessageType(m); err != nil {
+// EnqueueMessage encodes a message and queues it for writing by a separate
+// writer goroutine, which is started by the first call. Queued messages are
+// written strictly in the order in which they were enqueued: messages
+// enqueued by one goroutine are written in call order, and concurrent calls
+// are written in the order in which they enter the queue. Encoding errors are
+// returned immediately. If writing a queued message fails, the remaining
+// queued messages are discarded, and the error is returned by all subsequent
+// calls. EnqueueMessage may block if the queue is full. Messages written
+// through WriteMessage are not ordered with respect to queued messages.
+func (e *Encoder) EnqueueMessage(m Message) error {
+	buf, err := e.encode(m, nil)
+	if err != nil {
 		return err
 	}
 
-	buf := make([]byte, m.EncodedSize()+HeaderSize)
-	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(buf)))
-	buf[4] = byte(mt)
+	e.queueLock.Lock()
+	defer e.queueLock.Unlock()
 
-	if err := m.Marshal(buf[5:]); err != nil {
+	if e.queueClosed {
+		return ErrQueueClosed
+	}
+	if err = e.queueError(); err != nil {
 		return err
 	}
 
-	e.writeLock.Lock()
-	defer e.writeLock.Unlock()
+	if e.queue == nil {
+		e.queue = make(chan queuedWrite, 64)
+		e.queueDone = make(chan struct{})
+		go e.writeQueue(e.queue, e.queueDone)
+	}
 
-	_, err = e.Writer.Write(buf)
-	return err
+	e.queue <- queuedWrite{buf: buf}
+	return nil
+}
+
+// CloseQueue waits for all enqueued messages to be written and stops the
+// writer goroutine, returning the first error encountered while writing
+// queued messages. Subsequent calls to EnqueueMessage return ErrQueueClosed.
+func (e *Encoder) CloseQueue() error {
+	e.queueLock.Lock()
+	if !e.queueClosed {
+		e.queueClosed = true
+		if e.queue != nil {
+			close(e.queue)
+		}
+	}
+	done := e.queueDone
+	e.queueLock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+	return e.queueError()
+}
+
+// queueError returns the first error encountered while writing queued
+// messages.
+func (e *Encoder) queueError() error {
+	e.queueErrLock.Lock()
+	defer e.queueErrLock.Unlock()
+	return e.queueErr
+}
+
+// writeQueue writes queued messages until the queue is closed. After a write
+// error, the remaining messages are discarded.
+func (e *Encoder) writeQueue(queue chan queuedWrite, done chan struct{}) {
+	defer close(done)
+	for w := range queue {
+		if w.done != nil {
+			close(w.done)
+			continue
+		}
+		if e.queueError() != nil {
+			continue
+		}
+		if err := e.write(w.buf); err != nil {
+			e.queueErrLock.Lock()
+			e.queueErr = err
+			e.queueErrLock.Unlock()
+		}
+	}
 }
 
 // Decoder reads messages from an io.Reader. It exposes buffered reading through
 // ReadMessage. A Decoder is not thread safe. Only one goroutine may call
 // ReadMessage at a time.
 type Decoder struct {
-	// Protocol is the protocol codec used for decoding messages.
+	// Protocol is the protocol codec used for decoding messages. It must be
+	// changed with SetProtocol if ReadMessage may be running.
 	Protocol Protocol
 
 	// Reader is the reader to decode from.
@@ -103,9 +1137,115 @@ type Decoder struct {
 	Greedy bool
 
 	// MessageSize is the maximum message size negotiated for the protocol. It
-	// is used to allocate the decoding buffer.
+	// is used to allocate the decoding buffer, and larger messages are
+	// rejected with a *MessageTooBigError before their body is read. If it is
+	// zero and Greedy is not set, message sizes are not limited, but large
+	// bodies are read into a buffer that grows as they arrive instead of
+	// being allocated from the size field. It must be changed with
+	// SetMessageSize if ReadMessage may be running.
 	MessageSize uint32
 
+	// MaxStringSize is the maximum length of any string in a decoded message,
+	// or 0 for no limit other than the message size.
+	MaxStringSize int
+
+	// MaxElements is the maximum amount of elements in any list in a decoded
+	// message, such as the names of a WalkRequest, or 0 for no limit other
+	// than the message size. Data fields are not considered lists. Both limits
+	// are checked before the field is allocated, and only apply to the
+	// message types of this package.
+	MaxElements int
+
+	// IdleTimeout is the maximum time to wait for data if the reader supports
+	// read deadlines, such as a net.Conn, or 0 to wait indefinitely. If the
+	// timeout expires before the next message has started, ReadMessage returns
+	// ErrIdleTimeout, and the connection can be dropped cleanly. If it expires
+	// while a message is only partially received, ReadMessage returns
+	// ErrMessageStalled instead.
+	IdleTimeout time.Duration
+
+	// SizeWidth is the width in bytes of the size field in the message
+	// header, which must be 4 or 8. The default of 0 means 4, as required by
+	// 9P. See Encoder.SizeWidth. SizeWidth must not be changed while Greedy
+	// decoding is in use.
+	SizeWidth int
+
+	// Strict makes the decoder reject messages that are not encoded
+	// canonically, such as messages with bytes left in the body after the
+	// last field, with ErrTrailingData. By default, such bytes are ignored.
+	// Stats are also checked with Validate, and their size prefixes must
+	// match their content, or ErrStatSizeMismatch is returned.
+	Strict bool
+
+	// PreserveExtensions makes the decoder keep bytes left in a message body
+	// after the last field, such as fields appended by a protocol extension.
+	// Such messages are returned wrapped in an *ExtendedMessage holding the
+	// bytes in Extra, so that a relay can encode them again unchanged. Such
+	// wrapped messages are also passed to Server handlers and returned by
+	// Client.Send, and BaseMessage returns the message they wrap.
+	// Messages whose last field spans the rest of the body, such as
+	// ReadResponse, cannot carry extensions. PreserveExtensions has no effect
+	// if Strict is set.
+	PreserveExtensions bool
+
+	// Checksum makes the decoder verify and strip the checksum appended by an
+	// Encoder with Checksum set, returning ErrChecksumMismatch if a message
+	// was corrupted.
+	Checksum bool
+
+	// Align makes the decoder strip the padding added by an Encoder with the
+	// same Align, returning ErrInvalidPadding if the padding does not fit the
+	// alignment. The default of 0 means that messages are not padded.
+	Align int
+
+	// Pool, if set, provides the buffers used to read message bodies when
+	// Greedy decoding is not in use. Decoded messages do not reference the
+	// buffers, so they are returned to the pool after every message. A Pool
+	// can be shared by many Decoders.
+	Pool *BufferPool
+
+	// ReuseBuffer makes the decoder read message bodies into a single buffer
+	// kept across messages when Greedy decoding is not in use, instead of
+	// allocating a buffer for every message. The buffer grows to the largest
+	// message read, and is retained until the Decoder is discarded. Decoded
+	// messages do not reference the buffer. Pool takes precedence if set.
+	ReuseBuffer bool
+
+	// Timestamps makes the decoder record the time at which each message was
+	// decoded, available through ReceivedAt. It is off by default to avoid
+	// the cost of reading the clock.
+	Timestamps bool
+
+	// Stats, if set, records the size of every decoded message, including
+	// its header. Skipped messages are not recorded.
+	Stats *SizeStats
+
+	// Datagram is for message-oriented readers, where every Read returns
+	// exactly one whole message, such as a datagram socket. Each message is
+	// decoded from a single Read into the decoding buffer, without any
+	// buffering across reads. A Read that does not contain exactly one
+	// complete message fails with ErrPayloadTooShort or ErrSizeMismatch. A
+	// message larger than MessageSize fails with a MessageTooBigError, or
+	// ErrSizeMismatch if the reader truncated it. Datagram takes precedence
+	// over Greedy.
+	Datagram bool
+
+	// Filter, if set, is called with the type of every message once its
+	// header has been read. If it returns false, the message body is skipped
+	// without being decoded, and ReadMessage continues with the next message.
+	// Filter is called before the type is looked up in the Protocol, so no
+	// message is allocated for skipped messages, and it can also be used to
+	// skip unknown message types.
+	Filter func(MessageType) bool
+
+	// DeadLetter, if set, is called with the type, body and error of every
+	// message whose body fails to decode, such as with a *DecodeError or
+	// ErrTrailingData, after which ReadMessage continues with the next
+	// message. This only works while the framing of the stream is intact, so
+	// errors in the message header or checksum are still returned. The body
+	// is only valid for the duration of the call.
+	DeadLetter func(mt MessageType, body []byte, err error)
+
 	// total is the count of bytes in the buffer. It is used to keep track
 	// of buffer usage (read offset and cleanup), and is not used by the
 	// actual decoding loop.
@@ -134,11 +1274,51 @@ type Decoder struct {
 	// decoded a header, and set to an zero-initialized message struct
 	// when we have received the header. Comparing it to nil is used to
 	// check what state the decoder is in (header decoding vs. body
-	// decoding).
+	// decoding). It is set to skipped while skipping a body rejected by
+	// Filter.
 	m Message
 
 	// buffer is the reading buffer.
 	buffer []byte
+
+	// crc is the checksum of the header of the current message if Checksum
+	// is set.
+	crc uint32
+
+	// received is the time at which the last message was decoded if
+	// Timestamps is set.
+	received time.Time
+
+	// frame is the size of the last decoded message, including its header.
+	frame uint64
+
+	// configLock protects Protocol, MessageSize and the pending changes, so
+	// that they can be changed with SetProtocol and SetMessageSize while
+	// ReadMessage is running. MessageSize is only assigned by ReadMessage
+	// while it may be running, so ReadMessage itself reads it without the
+	// lock.
+	configLock sync.Mutex
+
+	// nextSize is the message size set by SetMessageSize, which ReadMessage
+	// applies at the next message boundary if resize is set. nextProtocol, if
+	// set, is applied along with it.
+	nextSize     uint32
+	resize       bool
+	nextProtocol Protocol
+
+	// scratch is the buffer used to discard skipped message bodies.
+	scratch []byte
+
+	// body is the buffer used to read message bodies if ReuseBuffer is set.
+	body []byte
+
+	// extra holds the extension bytes of the last unmarshalled message if
+	// PreserveExtensions is set.
+	extra []byte
+
+	// fields is the reader used to unmarshal message bodies, kept to avoid an
+	// allocation per message.
+	fields fieldReader
 }
 
 // Reset resets the decoding state machine and reallocates the buffer to the
@@ -153,33 +1333,450 @@ func (d *Decoder) Reset() error {
 	d.ptr = 0
 	d.m = nil
 	d.buffer = make([]byte, d.MessageSize)
-	d.needed = HeaderSize
+	d.needed = d.headerSize()
+	return nil
+}
+
+// SetReader replaces the reader and discards all decoding state, including
+// any data that has been read ahead and any partially decoded message. This
+// permits reusing a Decoder for a new connection. Unlike Reset, SetReader
+// does not fail if data is buffered, and keeps the current buffer. SetReader
+// must not be called concurrently with ReadMessage.
+func (d *Decoder) SetReader(r io.Reader) {
+	d.Reader = r
+	d.total = 0
+	d.size = 0
+	d.ptr = 0
+	d.m = nil
+	d.needed = d.headerSize()
+}
+
+// SetProtocol changes the Protocol of the decoder. Unlike assigning to
+// Protocol, it may be called concurrently with ReadMessage, such as from the
+// goroutine handling a version negotiation while another one is reading. The
+// new Protocol is used for all messages whose header is read after the call.
+// Protocols built with a ProtocolBuilder are immutable, and can be swapped in
+// this way to reconfigure custom message types.
+func (d *Decoder) SetProtocol(p Protocol) {
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	d.Protocol = p
+	d.nextProtocol = nil
+}
+
+// protocol returns the current Protocol.
+func (d *Decoder) protocol() Protocol {
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	return d.Protocol
+}
+
+// SetMessageSize changes the MessageSize of the decoder. Unlike assigning to
+// MessageSize, it may be called concurrently with ReadMessage, such as from
+// the goroutine handling a version negotiation while another one is reading.
+// The new size takes effect at the next message boundary, where the decoding
+// buffer is resized, keeping any data that has been read ahead. As shrinking
+// the buffer below the data read ahead would lose messages, the change stays
+// pending until enough of that data has been decoded, so that messages
+// received before the change may still be decoded with the old size.
+func (d *Decoder) SetMessageSize(msize uint32) {
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	d.nextSize = msize
+	d.resize = true
+}
+
+// configure changes both the Protocol and the MessageSize of the decoder.
+// Like the size set by SetMessageSize, the Protocol is applied at the next
+// message boundary, so that no message is decoded with only one of them
+// changed.
+func (d *Decoder) configure(p Protocol, msize uint32) {
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	d.nextSize = msize
+	d.resize = true
+	d.nextProtocol = p
+}
+
+// messageSize returns the message size that applies to the next message,
+// which is the size pending from SetMessageSize, if any.
+func (d *Decoder) messageSize() uint32 {
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	if d.resize {
+		return d.nextSize
+	}
+	return d.MessageSize
+}
+
+// applyMessageSize applies a message size pending from SetMessageSize or
+// configure, along with the pending Protocol, if any. It is called by
+// ReadMessage, and does nothing within a message, or while more data than the
+// new size has been read ahead.
+func (d *Decoder) applyMessageSize() {
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	if !d.resize || d.m != nil {
+		return
+	}
+	if d.buffer != nil {
+		buffered := d.total - d.ptr
+		if buffered > d.nextSize {
+			return
+		}
+		b := make([]byte, d.nextSize)
+		copy(b, d.buffer[d.ptr:d.total])
+		d.buffer = b
+		d.total = buffered
+		d.ptr = 0
+	}
+	d.MessageSize = d.nextSize
+	d.resize = false
+	if d.nextProtocol != nil {
+		d.Protocol = d.nextProtocol
+		d.nextProtocol = nil
+	}
+}
+
+// headerSize returns the size of the message header, which depends on
+// SizeWidth.
+func (d *Decoder) headerSize() int {
+	return sizeWidth(d.SizeWidth) + 1
+}
+
+// Buffered returns the bytes that have been read from the reader, but not yet
+// consumed by the decoder. If ReadMessage failed after a header was consumed,
+// the returned bytes start at the message body. This can be used to inspect
+// the stream after a decoding error, or to hand over the remaining data to
+// another reader. The returned slice aliases the internal buffer, and is only
+// valid until the next call to ReadMessage or Reset. Buffered always returns
+// nil if Greedy decoding is not in use, as nothing is buffered in that case.
+func (d *Decoder) Buffered() []byte {
+	if d.buffer == nil || d.ptr >= d.total {
+		return nil
+	}
+	return d.buffer[d.ptr:d.total]
+}
+
+// verify strips the padding of a message body if Align is set, and verifies
+// and strips its checksum if Checksum is set. crc is the checksum of the
+// message header.
+func (d *Decoder) verify(crc uint32, b []byte) ([]byte, error) {
+	if d.Align > 0 {
+		if d.Align > maxAlign {
+			return nil, ErrInvalidAlign
+		}
+		if len(b) == 0 {
+			return nil, ErrPayloadTooShort
+		}
+		pad := int(b[len(b)-1])
+		if pad == 0 || pad > d.Align || pad > len(b) {
+			return nil, ErrInvalidPadding
+		}
+		b = b[:len(b)-pad]
+	}
+
+	if !d.Checksum {
+		return b, nil
+	}
+	if len(b) < checksumSize {
+		return nil, ErrPayloadTooShort
+	}
+
+	sum := len(b) - checksumSize
+	if crc32.Update(crc, crc32.IEEETable, b[:sum]) != binary.LittleEndian.Uint32(b[sum:]) {
+		return nil, ErrChecksumMismatch
+	}
+	return b[:sum], nil
+}
+
+// checkMinSize verifies that a body of size bytes can hold the fixed fields of
+// the empty message m, so that obviously malformed messages are rejected with
+// ErrBodyTooSmall before their body is read.
+func checkMinSize(m Message, size uint64) error {
+	if size < uint64(m.EncodedSize()) {
+		return ErrBodyTooSmall
+	}
+	return nil
+}
+
+// errDeadLettered is returned by the read functions when a message has been
+// passed to DeadLetter, for ReadMessage to continue with the next message.
+var errDeadLettered = errors.New("message passed to dead letter handler")
+
+// unmarshal decodes a message body, enforcing the configured field limits
+// and Strict, including the size prefixes of stats. Errors from decoding the
+// body, including exceeded limits, are returned as a *DecodeError. If
+// DeadLetter is set, errors are passed to it instead, and errDeadLettered is
+// returned.
+func (d *Decoder) unmarshal(m Message, b []byte) error {
+	d.extra = nil
+	d.fields = fieldReader{b: b, maxString: d.MaxStringSize, maxElements: d.MaxElements}
+	err := unmarshalFields(m, &d.fields)
+	field := d.fields.field
+	d.fields.b = nil
+	mt, _ := d.protocol().MessageType(m)
+	switch {
+	case err != nil:
+		err = &DecodeError{Type: mt, Field: field, Err: err}
+	case d.Strict && m.EncodedSize() != len(b):
+		err = ErrTrailingData
+	case d.Strict:
+		err = checkStat(m, b)
+	case d.PreserveExtensions && m.EncodedSize() < len(b):
+		// The body may be a reused buffer.
+		d.extra = append([]byte(nil), b[m.EncodedSize():]...)
+	}
+
+	if err != nil && d.DeadLetter != nil {
+		d.DeadLetter(mt, b, err)
+		return errDeadLettered
+	}
+	return err
+}
+
+// checkStat validates the stat of a decoded message carrying one, and
+// verifies that both the size prefix of the stat and its own size prefix in
+// the message body b match the size of the decoded fields.
+func checkStat(m Message, b []byte) error {
+	var (
+		off, size int
+		validate  func() error
+	)
+	switch m := m.(type) {
+	case *StatResponse:
+		off, size, validate = 2, m.Stat.EncodedSize(), m.Stat.Validate
+	case *WriteStatRequest:
+		off, size, validate = 6, m.Stat.EncodedSize(), m.Stat.Validate
+	case *StatResponseDotu:
+		off, size, validate = 2, m.Stat.EncodedSize(), m.Stat.Validate
+	case *WriteStatRequestDotu:
+		off, size, validate = 6, m.Stat.EncodedSize(), m.Stat.Validate
+	default:
+		return nil
+	}
+
+	if err := validate(); err != nil {
+		return err
+	}
+	if int(binary.LittleEndian.Uint16(b[off:])) != size ||
+		int(binary.LittleEndian.Uint16(b[off+2:])) != size-2 {
+		return ErrStatSizeMismatch
+	}
+	return nil
+}
+
+// deadlineReader is implemented by readers that support read deadlines, such
+// as net.Conn.
+type deadlineReader interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// read reads from the reader, applying IdleTimeout if configured. boundary
+// tells if the read is for the start of a new message, which decides the
+// error returned if the timeout expires.
+func (d *Decoder) read(b []byte, boundary bool) (int, error) {
+	if d.IdleTimeout == 0 {
+		return d.Reader.Read(b)
+	}
+
+	if dr, ok := d.Reader.(deadlineReader); ok {
+		if err := dr.SetReadDeadline(time.Now().Add(d.IdleTimeout)); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := d.Reader.Read(b)
+	if te, ok := err.(interface {
+		Timeout() bool
+	}); ok && te.Timeout() {
+		if boundary && n == 0 {
+			err = ErrIdleTimeout
+		} else {
+			err = ErrMessageStalled
+		}
+	}
+	return n, err
+}
+
+// readFull reads exactly len(b) bytes with the same semantics as io.ReadFull,
+// but through read. boundary is passed on for the first read only.
+func (d *Decoder) readFull(b []byte, boundary bool) error {
+	var (
+		n, nn int
+		err   error
+	)
+	for n < len(b) && err == nil {
+		nn, err = d.read(b[n:], boundary && n == 0)
+		n += nn
+	}
+	if n >= len(b) {
+		return nil
+	}
+	if n > 0 && err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// skipped is the message of the greedy decoder while skipping a message body
+// rejected by Filter. Its methods must not be called.
+var skipped Message = struct{ Message }{}
+
+// skip reports whether a message of the provided type is to be skipped.
+func (d *Decoder) skip(mt MessageType) bool {
+	return d.Filter != nil && !d.Filter(mt)
+}
+
+// discard reads and discards n bytes of a message body.
+func (d *Decoder) discard(n uint64) error {
+	if d.scratch == nil {
+		d.scratch = make([]byte, 4096)
+	}
+	b := d.scratch
+	for n > 0 {
+		if n < uint64(len(b)) {
+			b = b[:n]
+		}
+		if err := d.readFull(b, false); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		n -= uint64(len(b))
+	}
 	return nil
 }
 
 // simpleRead is an inefficient but safe and stateless decoding mechanism.
 func (d *Decoder) simpleRead() (Message, error) {
-	b := make([]byte, 5)
-	_, err := io.ReadFull(d.Reader, b)
+	var (
+		hs = d.headerSize()
+		b  = make([]byte, hs)
+		s  uint64
+		mt MessageType
+	)
+	for {
+		if err := d.readFull(b, true); err != nil {
+			return nil, err
+		}
+
+		s = getSize(b[:hs-1])
+		if s < uint64(hs) {
+			return nil, ErrMessageTooSmall
+		}
+		if max := d.maxSize(); s > uint64(max) {
+			return nil, tooBig(s, max)
+		}
+		s -= uint64(hs)
+		mt = MessageType(b[hs-1])
+		if !d.skip(mt) {
+			break
+		}
+		if err := d.discard(s); err != nil {
+			return nil, err
+		}
+	}
+
+	m, err := d.protocol().Message(mt)
 	if err != nil {
 		return nil, err
 	}
+	if err = checkMinSize(m, s); err != nil {
+		return nil, err
+	}
 
-	s := binary.LittleEndian.Uint32(b[0:4]) - HeaderSize
-	mt := MessageType(b[4])
-	m, err := d.Protocol.Message(mt)
+	var crc uint32
+	if d.Checksum {
+		crc = crc32.ChecksumIEEE(b)
+	}
+
+	b, err = d.readBody(s, func(b []byte) error { return d.readFull(b, false) })
+	defer d.putBuffer(b)
 	if err != nil {
+		if err == io.EOF {
+			// The header was read, so the message is truncated.
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
 
-	b = make([]byte, s)
-	_, err = io.ReadFull(d.Reader, b)
-	if err != nil {
+	if b, err = d.verify(crc, b); err != nil {
 		return nil, err
 	}
+	if err = d.unmarshal(m, b); err != nil {
+		return nil, err
+	}
+	d.frame = s + uint64(hs)
+	return m, nil
+}
 
-	err = m.Unmarshal(b)
-	return m, err
+// maxSize returns the largest message size accepted by the non-greedy
+// decoding paths, which is MessageSize, or the largest int if MessageSize is
+// zero, as larger sizes cannot be allocated.
+func (d *Decoder) maxSize() int {
+	if d.MessageSize > 0 {
+		return int(d.MessageSize)
+	}
+	return maxInt
+}
+
+// growSize is the amount of a message body that is allocated before any of
+// it has been read, if MessageSize is zero.
+const growSize = 1 << 20
+
+// readBody reads a message body of n bytes with read. If MessageSize is set,
+// n has already been checked against it, and the buffer is obtained from
+// getBuffer. Otherwise, the size field is not trusted for allocation, and a
+// large body is read into a buffer that starts at growSize and doubles as the
+// body arrives, up to exactly n. A peer can therefore not make the decoder
+// allocate much more than it has sent.
+func (d *Decoder) readBody(n uint64, read func([]byte) error) ([]byte, error) {
+	if d.MessageSize > 0 || n <= growSize {
+		b := d.getBuffer(n)
+		return b, read(b)
+	}
+
+	var b []byte
+	for l := uint64(0); l < n; {
+		c := 2 * l
+		if c < growSize {
+			c = growSize
+		}
+		if c > n {
+			c = n
+		}
+		nb := make([]byte, c)
+		copy(nb, b)
+		if err := read(nb[l:]); err != nil {
+			return nil, err
+		}
+		b, l = nb, c
+	}
+	return b, nil
+}
+
+// getBuffer returns a buffer of length n, from Pool if set, or the reused
+// buffer if ReuseBuffer is set. n must not exceed maxSize.
+func (d *Decoder) getBuffer(n uint64) []byte {
+	switch {
+	case d.Pool != nil:
+		return d.Pool.Get(int(n))
+	case d.ReuseBuffer:
+		if uint64(cap(d.body)) < n {
+			d.body = make([]byte, n)
+		}
+		return d.body[:n]
+	}
+	return make([]byte, n)
+}
+
+// putBuffer returns a buffer obtained from getBuffer to Pool if set.
+func (d *Decoder) putBuffer(b []byte) {
+	if d.Pool != nil {
+		d.Pool.Put(b)
+	}
 }
 
 // greedyRead is complicated and unsafe (parameters cannot be changed). The
@@ -193,46 +1790,77 @@ func (d *Decoder) greedyRead() (Message, error) {
 	var (
 		err, readerr    error
 		n, limit, total int
+		hs              = d.headerSize()
 	)
 	for {
 		// Handle the data we got.
 		for d.needed <= 0 {
 			if d.m == nil { // Read a header if no message has been prepared.
-				s := binary.LittleEndian.Uint32(d.buffer[d.ptr : d.ptr+4])
-				if s > uint32(len(d.buffer)) {
-					return nil, ErrMessageTooBig
+				s := getSize(d.buffer[d.ptr : d.ptr+uint32(hs-1)])
+				if s > uint64(len(d.buffer)) {
+					return nil, tooBig(s, len(d.buffer))
+				}
+				if s < uint64(hs) {
+					return nil, ErrMessageTooSmall
 				}
 
-				d.size = s - HeaderSize
-				mt := MessageType(d.buffer[d.ptr+4])
+				d.size = uint32(s) - uint32(hs)
+				mt := MessageType(d.buffer[d.ptr+uint32(hs-1)])
+				if d.Checksum {
+					d.crc = crc32.ChecksumIEEE(d.buffer[d.ptr : d.ptr+uint32(hs)])
+				}
 
 				// Update message body size, missing bytes and the current ptr.
 				d.needed += int(d.size)
-				d.ptr += HeaderSize
+				d.ptr += uint32(hs)
 
 				// We try to fetch the message struct immediately - better to fail
 				// early rather than late.
-				if d.m, err = d.Protocol.Message(mt); err != nil {
+				if d.skip(mt) {
+					d.m = skipped
+				} else if d.m, err = d.protocol().Message(mt); err != nil {
+					return nil, err
+				} else if err = checkMinSize(d.m, uint64(d.size)); err != nil {
 					return nil, err
 				}
 
+			} else if d.m == skipped { // Skip the body of a filtered message.
+				d.needed += hs
+				d.ptr += d.size
+				d.size = 0
+				d.m = nil
+
 			} else { // Otherwise, read a body for the message.
-				if err = d.m.Unmarshal(d.buffer[d.ptr : d.ptr+d.size]); err != nil {
+				var b []byte
+				if b, err = d.verify(d.crc, d.buffer[d.ptr:d.ptr+d.size]); err != nil {
 					return nil, err
 				}
 
-				d.needed += HeaderSize
+				// The message is consumed before decoding, so that a body
+				// passed to DeadLetter is not decoded again.
+				d.needed += hs
 				d.ptr += d.size
+				d.frame = uint64(d.size) + uint64(hs)
 				d.size = 0
 
 				m := d.m
 				d.m = nil
+				d.checkState()
+				if err = d.unmarshal(m, b); err != nil {
+					return nil, err
+				}
 				return m, nil
 			}
 		}
 
+		d.checkState()
+
 		// Let's see if any readerr was present from last iteration...
 		if readerr != nil {
+			if readerr == io.EOF && (d.m != nil || d.ptr != d.total) {
+				// We are in the middle of a message.
+				readerr = io.ErrUnexpectedEOF
+			}
 			return nil, readerr
 		}
 
@@ -251,19 +1879,206 @@ func (d *Decoder) greedyRead() (Message, error) {
 		}
 
 		// We need more data!
-		n, readerr = d.Reader.Read(d.buffer[d.total:limit])
+		n, readerr = d.read(d.buffer[d.total:limit], d.m == nil && d.ptr == d.total)
 		d.total += uint32(n)
 		d.needed -= n
 	}
 }
 
+// bufferedRead decodes straight out of the buffer of a bufio.Reader, avoiding
+// a second layer of buffering. Messages larger than the bufio.Reader buffer
+// are read into a separate buffer.
+func (d *Decoder) bufferedRead(br *bufio.Reader) (Message, error) {
+	var (
+		hs  = d.headerSize()
+		b   []byte
+		s   uint64
+		mt  MessageType
+		crc uint32
+		err error
+	)
+	for {
+		if b, err = br.Peek(hs); err != nil {
+			if len(b) > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		s = getSize(b[:hs-1])
+		if s < uint64(hs) {
+			return nil, ErrMessageTooSmall
+		}
+		if max := d.maxSize(); s > uint64(max) {
+			return nil, tooBig(s, max)
+		}
+		s -= uint64(hs)
+		mt = MessageType(b[hs-1])
+		if d.Checksum {
+			crc = crc32.ChecksumIEEE(b)
+		}
+		br.Discard(hs)
+
+		if !d.skip(mt) {
+			break
+		}
+		if _, err = br.Discard(int(s)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+
+	m, err := d.protocol().Message(mt)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkMinSize(m, s); err != nil {
+		return nil, err
+	}
+
+	peek := s <= uint64(br.Size())
+	if peek {
+		b, err = br.Peek(int(s))
+	} else {
+		b, err = d.readBody(s, func(b []byte) error {
+			_, err := io.ReadFull(br, b)
+			return err
+		})
+		defer d.putBuffer(b)
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	var body []byte
+	if body, err = d.verify(crc, b); err == nil {
+		err = d.unmarshal(m, body)
+	}
+	if peek {
+		br.Discard(int(s))
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.frame = s + uint64(hs)
+	return m, nil
+}
+
+// datagramRead decodes a message from a single Read.
+func (d *Decoder) datagramRead() (Message, error) {
+	if d.buffer == nil {
+		d.Reset()
+	}
+
+	hs := d.headerSize()
+	for {
+		n, err := d.read(d.buffer, true)
+		if n == 0 && err != nil {
+			return nil, err
+		}
+		if n < hs {
+			return nil, ErrPayloadTooShort
+		}
+
+		b := d.buffer[:n]
+		s := getSize(b[:hs-1])
+		if s < uint64(hs) {
+			return nil, ErrMessageTooSmall
+		}
+		if s > uint64(len(d.buffer)) {
+			return nil, tooBig(s, len(d.buffer))
+		}
+		if s != uint64(n) {
+			return nil, ErrSizeMismatch
+		}
+
+		mt := MessageType(b[hs-1])
+		if d.skip(mt) {
+			continue
+		}
+		m, err := d.protocol().Message(mt)
+		if err != nil {
+			return nil, err
+		}
+		if err = checkMinSize(m, uint64(len(b)-hs)); err != nil {
+			return nil, err
+		}
+
+		var crc uint32
+		if d.Checksum {
+			crc = crc32.ChecksumIEEE(b[:hs])
+		}
+		if b, err = d.verify(crc, b[hs:]); err != nil {
+			return nil, err
+		}
+		if err = d.unmarshal(m, b); err != nil {
+			return nil, err
+		}
+		d.frame = s
+		return m, nil
+	}
+}
+
 // ReadMessage executes the decoder loop, returning the next message. It will
 // continue reading from the configured reader until a message is found or an
 // error occurs. NextMessage calls Reset if the internal buffer is nil for
 // initialization.
+//
+// If the reader is a *bufio.Reader, messages are decoded directly from its
+// buffer, regardless of Greedy, as long as the decoder has nothing buffered
+// itself. Otherwise, without Greedy, every message takes at least two Read
+// calls, one for the header and one for the body, as nothing past the end of
+// the message is read. With Greedy, a single Read call fills the buffer with
+// as many messages as are available, which are then decoded without reading.
+//
+// io.EOF is only returned if the reader ends at a message boundary. If it
+// ends in the middle of a message, io.ErrUnexpectedEOF is returned instead.
 func (d *Decoder) ReadMessage() (Message, error) {
-	if d.Greedy {
-		return d.greedyRead()
+	var (
+		m   Message
+		err error
+	)
+	d.applyMessageSize()
+	for {
+		if d.Datagram {
+			m, err = d.datagramRead()
+		} else if br, ok := d.Reader.(*bufio.Reader); ok && d.ptr == d.total && d.m == nil {
+			m, err = d.bufferedRead(br)
+		} else if d.Greedy {
+			m, err = d.greedyRead()
+		} else {
+			m, err = d.simpleRead()
+		}
+		if err != errDeadLettered {
+			break
+		}
 	}
-	return d.simpleRead()
+
+	if err == nil && d.Timestamps {
+		d.received = time.Now()
+	}
+	if err == nil && d.Stats != nil {
+		if mt, terr := d.protocol().MessageType(m); terr == nil {
+			d.Stats.Record(mt, d.frame)
+		}
+	}
+	if err == nil && d.extra != nil {
+		m = &ExtendedMessage{Message: m, Extra: d.extra}
+		d.extra = nil
+	}
+	return m, err
+}
+
+// ReceivedAt returns the time at which the message last returned by
+// ReadMessage was decoded, if Timestamps is set. Combined with the time at
+// which a request was sent, it can be used to measure the latency of
+// individual requests. Like ReadMessage, it must not be called concurrently
+// with ReadMessage.
+func (d *Decoder) ReceivedAt() time.Time {
+	return d.received
 }
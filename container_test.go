@@ -1,8 +1,14 @@
 package qp
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
+	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -168,3 +174,2239 @@ func TestEncoder(t *testing.T) {
 		}
 	}
 }
+
+func TestDecoderBuffered(t *testing.T) {
+	good := MessageTestData[0].container
+	corrupt := append([]byte(nil), MessageTestData[1].container...)
+	corrupt[3] = 0xFF // Claims a size far beyond MessageSize.
+
+	inputbuf := new(bytes.Buffer)
+	inputbuf.Write(good)
+	inputbuf.Write(corrupt)
+
+	d := Decoder{
+		Protocol:    NineP2000,
+		Reader:      inputbuf,
+		MessageSize: 1024,
+		Greedy:      true,
+	}
+	d.Reset()
+
+	if b := d.Buffered(); b != nil {
+		t.Errorf("expected nothing buffered before reading, got %v", b)
+	}
+
+	if _, err := d.ReadMessage(); err != nil {
+		t.Fatalf("unable to read first message: %v", err)
+	}
+
+	if b := d.Buffered(); bytes.Compare(b, corrupt) != 0 {
+		t.Errorf("buffer after first message did not match.\n\tExpected: %v\n\tGot:      %v", corrupt, b)
+	}
+
+	if _, err := d.ReadMessage(); !errors.Is(err, ErrMessageTooBig) {
+		t.Fatalf("expected ErrMessageTooBig, got %v", err)
+	}
+
+	if b := d.Buffered(); bytes.Compare(b, corrupt) != 0 {
+		t.Errorf("residual buffer did not match.\n\tExpected: %v\n\tGot:      %v", corrupt, b)
+	}
+}
+
+func TestDecoderSetMessageSizeBoundary(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := Encoder{Protocol: NineP2000, Writer: buf, MessageSize: 1024}
+	if err := e.WriteMessage(&ClunkRequest{Tag: 1, Fid: 1}); err != nil {
+		t.Fatalf("unable to encode: %v", err)
+	}
+	rest := append([]byte(nil), buf.Bytes()[buf.Len()-2:]...)
+	buf.Truncate(buf.Len() - 2)
+
+	d := Decoder{Protocol: NineP2000, Reader: buf, MessageSize: 1024, Greedy: true}
+	d.Reset()
+	if _, err := d.ReadMessage(); err == nil {
+		t.Fatalf("expected truncated message to fail")
+	}
+
+	// The size is not changed within the partially decoded message.
+	d.SetMessageSize(2048)
+	buf.Write(rest)
+	if _, err := d.ReadMessage(); err != nil {
+		t.Fatalf("unable to finish message: %v", err)
+	}
+	if d.MessageSize != 1024 {
+		t.Errorf("size changed within message: %d", d.MessageSize)
+	}
+
+	if _, err := d.ReadMessage(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+	if d.MessageSize != 2048 || len(d.buffer) != 2048 {
+		t.Errorf("expected size 2048 at boundary, got %d with buffer of %d", d.MessageSize, len(d.buffer))
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	wr := &WalkRequest{
+		Tag:    45,
+		Fid:    1,
+		NewFid: 2,
+		Names:  []string{"usr", "glenda", "lib"},
+	}
+
+	tests := []struct {
+		maxString, maxElements int
+		field                  string
+	}{
+		{0, 0, ""},
+		{6, 3, ""},
+		{5, 0, "Names[1]"},
+		{0, 2, "Names"},
+	}
+
+	for i, tt := range tests {
+		for _, greedy := range []bool{false, true} {
+			buf := new(bytes.Buffer)
+			e := Encoder{Protocol: NineP2000, Writer: buf, MessageSize: 1024}
+			if err := e.WriteMessage(wr); err != nil {
+				t.Fatalf("test %d: unable to encode: %v", i, err)
+			}
+
+			d := Decoder{
+				Protocol:      NineP2000,
+				Reader:        buf,
+				MessageSize:   1024,
+				Greedy:        greedy,
+				MaxStringSize: tt.maxString,
+				MaxElements:   tt.maxElements,
+			}
+			d.Reset()
+
+			_, err := d.ReadMessage()
+			if tt.field == "" {
+				if err != nil {
+					t.Errorf("test %d (greedy: %t): unexpected error: %v", i, greedy, err)
+				}
+				continue
+			}
+			var de *DecodeError
+			if !errors.As(err, &de) || de.Field != tt.field || !errors.Is(err, ErrFieldTooBig) {
+				t.Errorf("test %d (greedy: %t): expected ErrFieldTooBig for %s, got %v", i, greedy, tt.field, err)
+			}
+		}
+	}
+
+	// A walk claiming 65535 names in a payload that cannot hold them must be
+	// rejected before the names are allocated.
+	b := []byte{0x2d, 0x0, 0x1, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0xff, 0xff, 0x1, 0x0, 'a'}
+	if err := new(WalkRequest).Unmarshal(b); err != ErrPayloadTooShort {
+		t.Errorf("expected ErrPayloadTooShort for oversized name count, got %v", err)
+	}
+
+	// The limits are checked before the payload size, as the count is read.
+	frame := append([]byte{byte(HeaderSize + len(b)), 0, 0, 0, byte(Twalk)}, b...)
+	d := Decoder{Protocol: NineP2000, Reader: bytes.NewReader(frame), MessageSize: 1024, MaxElements: 16}
+	if _, err := d.ReadMessage(); !errors.Is(err, ErrFieldTooBig) {
+		t.Errorf("expected ErrFieldTooBig for oversized name count, got %v", err)
+	}
+}
+
+func TestDecoderIdleTimeout(t *testing.T) {
+	msg := MessageTestData[0].container
+
+	for _, greedy := range []bool{false, true} {
+		// A complete message followed by silence is an idle connection.
+		c1, c2 := net.Pipe()
+		go c2.Write(msg)
+
+		d := Decoder{
+			Protocol:    NineP2000,
+			Reader:      c1,
+			MessageSize: 1024,
+			Greedy:      greedy,
+			IdleTimeout: 50 * time.Millisecond,
+		}
+		d.Reset()
+
+		if _, err := d.ReadMessage(); err != nil {
+			t.Fatalf("greedy: %t: unable to read message: %v", greedy, err)
+		}
+		if _, err := d.ReadMessage(); err != ErrIdleTimeout {
+			t.Errorf("greedy: %t: expected ErrIdleTimeout, got %v", greedy, err)
+		}
+		c1.Close()
+		c2.Close()
+
+		// A partial message followed by silence is a stalled message.
+		c1, c2 = net.Pipe()
+		go c2.Write(msg[:len(msg)-2])
+
+		d = Decoder{
+			Protocol:    NineP2000,
+			Reader:      c1,
+			MessageSize: 1024,
+			Greedy:      greedy,
+			IdleTimeout: 50 * time.Millisecond,
+		}
+		d.Reset()
+
+		if _, err := d.ReadMessage(); err != ErrMessageStalled {
+			t.Errorf("greedy: %t: expected ErrMessageStalled, got %v", greedy, err)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+// writeCounter counts the Write calls made to it.
+type writeCounter struct {
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+// TestEncoderSingleWrite verifies that the header and body of a message are
+// handed to the writer in a single Write call.
+func TestEncoderSingleWrite(t *testing.T) {
+	w := &writeCounter{}
+	e := Encoder{Protocol: NineP2000, Writer: w, MessageSize: 8192}
+
+	for i, tt := range MessageTestData {
+		w.writes = 0
+		if err := e.WriteMessage(tt.input); err != nil {
+			t.Fatalf("test %d: unable to encode %T: %v", i, tt.input, err)
+		}
+		if w.writes != 1 {
+			t.Errorf("test %d: expected 1 write for %T, got %d", i, tt.input, w.writes)
+		}
+	}
+}
+
+func BenchmarkEncoderReadResponse(b *testing.B) {
+	w := &writeCounter{}
+	e := Encoder{Protocol: NineP2000, Writer: w, MessageSize: 8192}
+	m := &ReadResponse{Tag: 1, Data: make([]byte, 4096)}
+
+	b.SetBytes(int64(HeaderSize + m.EncodedSize()))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := e.WriteMessage(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+}
+
+func TestDecoderSizeUnderflow(t *testing.T) {
+	// Sizes smaller than the header must be rejected before the header size
+	// is subtracted from them. A size of exactly the header is a message with
+	// an empty body, which is too small for the tag of Rclunk.
+	tests := []struct {
+		size uint32
+		err  error
+	}{
+		{0, ErrMessageTooSmall},
+		{1, ErrMessageTooSmall},
+		{3, ErrMessageTooSmall},
+		{4, ErrMessageTooSmall},
+		{5, ErrBodyTooSmall},
+	}
+
+	for i, tt := range tests {
+		b := []byte{0x0, 0x0, 0x0, 0x0, byte(Rclunk), 0x2d, 0x0}
+		binary.LittleEndian.PutUint32(b, tt.size)
+
+		readers := map[string]func() io.Reader{
+			"simple": func() io.Reader { return bytes.NewReader(b) },
+			"greedy": func() io.Reader { return bytes.NewReader(b) },
+			"bufio":  func() io.Reader { return bufio.NewReader(bytes.NewReader(b)) },
+		}
+		for name, r := range readers {
+			d := Decoder{
+				Protocol:    NineP2000,
+				Reader:      r(),
+				MessageSize: 1024,
+				Greedy:      name == "greedy",
+			}
+			d.Reset()
+
+			if _, err := d.ReadMessage(); !errors.Is(err, tt.err) {
+				t.Errorf("test %d: %s: expected %v, got %v", i, name, tt.err, err)
+			}
+		}
+	}
+}
+
+func TestDecoderBufio(t *testing.T) {
+	inputbuf := new(bytes.Buffer)
+	for _, tt := range MessageTestData {
+		inputbuf.Write(tt.container)
+	}
+
+	// A small bufio buffer forces both the direct and the copying path.
+	d := Decoder{
+		Protocol:    NineP2000,
+		Reader:      bufio.NewReaderSize(inputbuf, 16),
+		MessageSize: 1024,
+	}
+
+	for i, tt := range MessageTestData {
+		m, err := d.ReadMessage()
+		if err != nil {
+			t.Fatalf("test %d: failed on %T with error: %v", i, tt.input, err)
+		}
+		if !CompareMarshallables(tt.input, m) {
+			t.Errorf("test %d: failed on %T\n\tExpected: %#v\n\tGot:      %#v", i, tt.input, tt.input, m)
+		}
+	}
+
+	if _, err := d.ReadMessage(); err != io.EOF {
+		t.Errorf("expected io.EOF at end of stream, got %v", err)
+	}
+}
+
+func benchmarkDecoder(b *testing.B, wrap func(io.Reader) io.Reader, greedy bool) {
+	stream := new(bytes.Buffer)
+	for _, tt := range MessageTestData {
+		stream.Write(tt.container)
+	}
+	raw := stream.Bytes()
+
+	r := bytes.NewReader(raw)
+	d := Decoder{
+		Protocol:    NineP2000,
+		Reader:      wrap(r),
+		MessageSize: 8192,
+		Greedy:      greedy,
+	}
+	d.Reset()
+
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(raw)
+		for range MessageTestData {
+			if _, err := d.ReadMessage(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecoderGreedy(b *testing.B) {
+	benchmarkDecoder(b, func(r io.Reader) io.Reader { return r }, true)
+}
+
+func BenchmarkDecoderBufio(b *testing.B) {
+	benchmarkDecoder(b, func(r io.Reader) io.Reader { return bufio.NewReader(r) }, false)
+}
+
+func BenchmarkDecoderSimple(b *testing.B) {
+	benchmarkDecoder(b, func(r io.Reader) io.Reader { return r }, false)
+}
+
+// countingReader counts the Read calls made to the wrapped reader.
+type countingReader struct {
+	io.Reader
+	reads int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	cr.reads++
+	return cr.Reader.Read(p)
+}
+
+// BenchmarkDecoderReads reports the Read calls per message made by each mode
+// of the Decoder on a stream where all data is available at once.
+func BenchmarkDecoderReads(b *testing.B) {
+	stream := new(bytes.Buffer)
+	for _, tt := range MessageTestData {
+		stream.Write(tt.container)
+	}
+	raw := stream.Bytes()
+
+	modes := []struct {
+		name   string
+		greedy bool
+		wrap   func(io.Reader) io.Reader
+	}{
+		{"simple", false, func(r io.Reader) io.Reader { return r }},
+		{"greedy", true, func(r io.Reader) io.Reader { return r }},
+		{"bufio", false, func(r io.Reader) io.Reader { return bufio.NewReader(r) }},
+	}
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			r := bytes.NewReader(raw)
+			cr := &countingReader{Reader: r}
+			d := Decoder{
+				Protocol:    NineP2000,
+				Reader:      mode.wrap(cr),
+				MessageSize: 8192,
+				Greedy:      mode.greedy,
+			}
+			d.Reset()
+
+			b.SetBytes(int64(len(raw)))
+			for i := 0; i < b.N; i++ {
+				r.Reset(raw)
+				for range MessageTestData {
+					if _, err := d.ReadMessage(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(cr.reads)/float64(b.N*len(MessageTestData)), "reads/msg")
+		})
+	}
+}
+
+func TestDecoderReuseBuffer(t *testing.T) {
+	var stream bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &stream}
+	e.WriteMessage(&ReadResponse{Tag: 1, Data: []byte("hello")})
+	e.WriteMessage(&ReadResponse{Tag: 2, Data: []byte("hi")})
+	e.WriteMessage(&ReadResponse{Tag: 3, Data: bytes.Repeat([]byte("x"), 100)})
+
+	d := &Decoder{Protocol: NineP2000, Reader: &stream, MessageSize: 8192, ReuseBuffer: true}
+	m1, err := d.ReadMessage()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	first := &d.body[0]
+	m2, err := d.ReadMessage()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if &d.body[0] != first {
+		t.Errorf("expected the buffer to be reused for a smaller message")
+	}
+
+	// Messages do not alias the buffer, so later messages and changes to the
+	// buffer leave them intact.
+	if _, err = d.ReadMessage(); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	for i := range d.body {
+		d.body[i] = 0
+	}
+	if string(m1.(*ReadResponse).Data) != "hello" || string(m2.(*ReadResponse).Data) != "hi" {
+		t.Errorf("decoded messages alias the reused buffer: %q, %q", m1.(*ReadResponse).Data, m2.(*ReadResponse).Data)
+	}
+
+	// Without ReuseBuffer, every message gets its own buffer.
+	read := func(reuse bool) float64 {
+		r := bytes.NewReader(nil)
+		d := &Decoder{Protocol: NineP2000, Reader: r, MessageSize: 8192, ReuseBuffer: reuse}
+		var b bytes.Buffer
+		(&Encoder{Protocol: NineP2000, Writer: &b}).WriteMessage(&ClunkRequest{Tag: 1, Fid: 1})
+		return testing.AllocsPerRun(100, func() {
+			r.Reset(b.Bytes())
+			if _, err := d.ReadMessage(); err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+		})
+	}
+	if with, without := read(true), read(false); with >= without {
+		t.Errorf("expected fewer allocations with ReuseBuffer, got %v with and %v without", with, without)
+	}
+}
+
+func BenchmarkDecoderReuseBuffer(b *testing.B) {
+	for _, reuse := range []bool{false, true} {
+		name := "alloc"
+		if reuse {
+			name = "reuse"
+		}
+		b.Run(name, func(b *testing.B) {
+			stream := new(bytes.Buffer)
+			for _, tt := range MessageTestData {
+				stream.Write(tt.container)
+			}
+			raw := stream.Bytes()
+
+			r := bytes.NewReader(raw)
+			d := Decoder{Protocol: NineP2000, Reader: r, MessageSize: 8192, ReuseBuffer: reuse}
+			b.SetBytes(int64(len(raw)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.Reset(raw)
+				for range MessageTestData {
+					if _, err := d.ReadMessage(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMessageTypeNames(t *testing.T) {
+	// Every known message type must have a name, and every name must belong
+	// to a known message type.
+	protocols := []Protocol{NineP2000, NineP2000Dotu, NineP2000Dote}
+	for i := 0; i < 256; i++ {
+		mt := MessageType(i)
+		known := false
+		for _, p := range protocols {
+			if _, err := p.Message(mt); err == nil {
+				known = true
+			}
+		}
+
+		name := mt.String()
+		parsed, ok := ParseMessageType(name)
+		if known != ok {
+			t.Errorf("message type %d: known: %t, but name %q parsed: %t", i, known, name, ok)
+			continue
+		}
+		if ok && parsed != mt {
+			t.Errorf("message type %d: name %q parsed as %d", i, name, parsed)
+		}
+	}
+
+	if Twalk.String() != "Twalk" {
+		t.Errorf("expected \"Twalk\", got %q", Twalk.String())
+	}
+	if Terror.String() != "MessageType(106)" {
+		t.Errorf("expected \"MessageType(106)\", got %q", Terror.String())
+	}
+	if _, ok := ParseMessageType("twalk"); ok {
+		t.Errorf("message type names must be case sensitive")
+	}
+	if _, ok := ParseMessageType("Tbogus"); ok {
+		t.Errorf("unknown message type name parsed")
+	}
+}
+
+// failingWriter accepts limit bytes, and then fails.
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, io.ErrClosedPipe
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestEncoderPartialWrite(t *testing.T) {
+	m := MessageTestData[0].input
+	size := len(MessageTestData[0].container)
+
+	// A write that fails before anything is written leaves the stream intact.
+	e := Encoder{Protocol: NineP2000, Writer: &failingWriter{}, MessageSize: 1024}
+	if err := e.WriteMessage(m); err != io.ErrClosedPipe {
+		t.Errorf("expected io.ErrClosedPipe, got %v", err)
+	}
+
+	// A write that fails partway through a message corrupts the stream.
+	w := &failingWriter{limit: size + 3}
+	e = Encoder{Protocol: NineP2000, Writer: w, MessageSize: 1024}
+	if err := e.WriteMessage(m); err != nil {
+		t.Fatalf("unable to write first message: %v", err)
+	}
+	if err := e.WriteMessage(m); err != ErrStreamCorrupt {
+		t.Errorf("expected ErrStreamCorrupt, got %v", err)
+	}
+
+	// Further writes must be refused, even if the writer would accept them.
+	w.limit = 1024
+	if err := e.WriteMessage(m); err != ErrStreamCorrupt {
+		t.Errorf("expected ErrStreamCorrupt after corruption, got %v", err)
+	}
+}
+
+func TestResponseTypeValid(t *testing.T) {
+	requests := []MessageType{
+		Tversion, Tauth, Tattach, Tflush, Twalk, Topen, Tcreate, Tread,
+		Twrite, Tclunk, Tremove, Tstat, Twstat, Tsession, Tsread, Tswrite,
+	}
+	for _, req := range requests {
+		for i := 0; i < 256; i++ {
+			rep := MessageType(i)
+			expected := rep == req+1 || rep == Rerror
+			if ResponseTypeValid(req, rep) != expected {
+				t.Errorf("%v: expected %v to be valid: %t", req, rep, expected)
+			}
+		}
+	}
+
+	// Responses and unknown types are not requests.
+	for _, req := range []MessageType{Terror, Rerror, Rwalk, MessageType(0), MessageType(200)} {
+		if ResponseTypeValid(req, Rerror) {
+			t.Errorf("%v: expected no response to be valid", req)
+		}
+	}
+}
+
+func TestDecodeExact(t *testing.T) {
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf, MessageSize: 8192}
+	msg := &WalkRequest{Tag: 1, Fid: 2, NewFid: 3, Names: []string{"usr", "glenda"}}
+	if err := e.WriteMessage(msg); err != nil {
+		t.Fatalf("unable to encode message: %v", err)
+	}
+	frame := buf.Bytes()
+
+	m, err := DecodeExact(frame)
+	if err != nil {
+		t.Fatalf("exact frame: unexpected error: %v", err)
+	}
+	if !Equal(m, msg) {
+		t.Errorf("exact frame: decoded message differs:\n%s", Diff(m, msg))
+	}
+
+	// The declared size must match the frame.
+	if _, err = DecodeExact(append(append([]byte{}, frame...), 0)); err != ErrSizeMismatch {
+		t.Errorf("long frame: expected ErrSizeMismatch, got %v", err)
+	}
+	if _, err = DecodeExact(frame[:len(frame)-1]); err != ErrSizeMismatch {
+		t.Errorf("short frame: expected ErrSizeMismatch, got %v", err)
+	}
+	if _, err = DecodeExact(frame[:3]); err != ErrPayloadTooShort {
+		t.Errorf("truncated header: expected ErrPayloadTooShort, got %v", err)
+	}
+
+	// A size field covering data beyond the last field.
+	long := append(append([]byte{}, frame...), 0)
+	long[0]++
+	if _, err = DecodeExact(long); err != ErrTrailingData {
+		t.Errorf("trailing data: expected ErrTrailingData, got %v", err)
+	}
+}
+
+func TestEncoderEnqueueOrder(t *testing.T) {
+	const (
+		goroutines = 8
+		messages   = 100
+	)
+
+	var (
+		buf      bytes.Buffer
+		lock     sync.Mutex
+		expected []Tag
+		wg       sync.WaitGroup
+	)
+
+	e := &Encoder{Protocol: NineP2000, Writer: &buf, MessageSize: 8192}
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				tag := Tag(i*messages + j)
+
+				// Recording the enqueue order under a lock makes the expected
+				// output order deterministic.
+				lock.Lock()
+				if err := e.EnqueueMessage(&ClunkResponse{Tag: tag}); err != nil {
+					t.Errorf("goroutine %d: enqueue failed: %v", i, err)
+				}
+				expected = append(expected, tag)
+				lock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err := e.CloseQueue(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if err := e.EnqueueMessage(&ClunkResponse{}); err != ErrQueueClosed {
+		t.Errorf("expected ErrQueueClosed, got %v", err)
+	}
+
+	d := &Decoder{Protocol: NineP2000, Reader: &buf, MessageSize: 8192}
+	for i, tag := range expected {
+		m, err := d.ReadMessage()
+		if err != nil {
+			t.Fatalf("message %d: read failed: %v", i, err)
+		}
+		if MessageTag(m) != tag {
+			t.Fatalf("message %d: expected tag %d, got %d", i, tag, MessageTag(m))
+		}
+	}
+	if _, err := d.ReadMessage(); err != io.EOF {
+		t.Errorf("expected EOF after queued messages, got %v", err)
+	}
+}
+
+func TestEncoderEnqueueError(t *testing.T) {
+	e := &Encoder{Protocol: NineP2000, Writer: &failingWriter{}, MessageSize: 8192}
+	if err := e.EnqueueMessage(&ClunkResponse{}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	if err := e.CloseQueue(); err != io.ErrClosedPipe {
+		t.Errorf("expected io.ErrClosedPipe from close, got %v", err)
+	}
+}
+
+func TestEncoderUnknownMessage(t *testing.T) {
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf}
+	err := e.WriteMessage(&ErrorResponseDotu{Error: "nope", Errno: 2})
+	if !errors.Is(err, ErrUnknownMessageType) {
+		t.Fatalf("expected ErrUnknownMessageType, got %v", err)
+	}
+	var ume *UnknownMessageError
+	if !errors.As(err, &ume) {
+		t.Fatalf("expected UnknownMessageError, got %T", err)
+	}
+	if !strings.Contains(err.Error(), "ErrorResponseDotu") {
+		t.Errorf("error does not name the message type: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be written, got %d bytes", buf.Len())
+	}
+
+	if _, _, err = EncodeBody(NineP2000, &ErrorResponseDotu{}); !errors.As(err, &ume) {
+		t.Errorf("EncodeBody: expected UnknownMessageError, got %v", err)
+	}
+}
+
+// flushRecorder buffers written data until Flush, counting the flushes.
+type flushRecorder struct {
+	lock     sync.Mutex
+	pending  []byte
+	flushed  []byte
+	flushes  int
+	flushErr error
+}
+
+func (fr *flushRecorder) Write(p []byte) (int, error) {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	fr.pending = append(fr.pending, p...)
+	return len(p), nil
+}
+
+func (fr *flushRecorder) Flush() error {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	if len(fr.pending) > 0 {
+		fr.flushed = append(fr.flushed, fr.pending...)
+		fr.pending = nil
+		fr.flushes++
+	}
+	return fr.flushErr
+}
+
+// state returns the amount of flushed bytes and flushes.
+func (fr *flushRecorder) state() (int, int) {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	return len(fr.flushed), fr.flushes
+}
+
+func TestEncoderFlushDelay(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	m := &ClunkRequest{Tag: 1, Fid: 1}
+	size := m.EncodedSize() + HeaderSize
+
+	// waitFlushed waits for n bytes to be flushed.
+	waitFlushed := func(fr *flushRecorder, n int) int {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if flushed, flushes := fr.state(); flushed >= n {
+				return flushes
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("data was not flushed")
+		return 0
+	}
+
+	// A lone message is flushed after the delay.
+	fr := &flushRecorder{}
+	e := &Encoder{Protocol: NineP2000, Writer: fr, FlushDelay: delay}
+	if err := e.WriteMessage(m); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if flushed, _ := fr.state(); flushed != 0 {
+		t.Errorf("expected no data to be flushed immediately, got %d bytes", flushed)
+	}
+	if flushes := waitFlushed(fr, size); flushes != 1 {
+		t.Errorf("expected 1 flush, got %d", flushes)
+	}
+
+	// A burst is coalesced into a single flush.
+	fr = &flushRecorder{}
+	e = &Encoder{Protocol: NineP2000, Writer: fr, FlushDelay: delay}
+	for i := 0; i < 10; i++ {
+		if err := e.WriteMessage(m); err != nil {
+			t.Fatalf("write %d failed: %v", i, err)
+		}
+	}
+	if flushes := waitFlushed(fr, 10*size); flushes != 1 {
+		t.Errorf("expected burst to be flushed once, got %d flushes", flushes)
+	}
+
+	// Flush and Close cancel the pending flush.
+	fr = &flushRecorder{}
+	e = &Encoder{Protocol: NineP2000, Writer: fr, FlushDelay: delay}
+	e.WriteMessage(m)
+	if err := e.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	e.WriteMessage(m)
+	e.Close()
+	time.Sleep(3 * delay)
+	if flushed, flushes := fr.state(); flushed != size || flushes != 1 {
+		t.Errorf("expected only the explicit flush, got %d bytes in %d flushes", flushed, flushes)
+	}
+
+	// Errors from delayed flushes are returned by Flush.
+	fr = &flushRecorder{flushErr: io.ErrClosedPipe}
+	e = &Encoder{Protocol: NineP2000, Writer: fr, FlushDelay: delay}
+	e.WriteMessage(m)
+	waitFlushed(fr, size)
+	time.Sleep(delay)
+	if err := e.Flush(); err != io.ErrClosedPipe {
+		t.Errorf("expected error of delayed flush, got %v", err)
+	}
+}
+
+func TestDecoderPreserveExtensions(t *testing.T) {
+	// A WalkRequest followed by extension bytes, and a plain message.
+	walk := &WalkRequest{Tag: 3, Fid: 1, NewFid: 2, Names: []string{"a"}}
+	extra := []byte{1, 2, 3}
+	body := make([]byte, walk.EncodedSize())
+	walk.Marshal(body)
+	body = append(body, extra...)
+	frame := make([]byte, HeaderSize, HeaderSize+len(body))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(HeaderSize+len(body)))
+	frame[4] = byte(Twalk)
+	frame = append(frame, body...)
+
+	var plain bytes.Buffer
+	(&Encoder{Protocol: NineP2000, Writer: &plain}).WriteMessage(&ClunkRequest{Tag: 4, Fid: 2})
+	stream := append(append([]byte{}, frame...), plain.Bytes()...)
+
+	modes := map[string]func(r io.Reader) *Decoder{
+		"simple": func(r io.Reader) *Decoder {
+			return &Decoder{Protocol: NineP2000, Reader: r, MessageSize: 8192, PreserveExtensions: true}
+		},
+		"greedy": func(r io.Reader) *Decoder {
+			return &Decoder{Protocol: NineP2000, Reader: r, MessageSize: 8192, PreserveExtensions: true, Greedy: true}
+		},
+		"bufio": func(r io.Reader) *Decoder {
+			return &Decoder{Protocol: NineP2000, Reader: bufio.NewReader(r), MessageSize: 8192, PreserveExtensions: true}
+		},
+	}
+	for name, nd := range modes {
+		d := nd(bytes.NewReader(stream))
+		m, err := d.ReadMessage()
+		if err != nil {
+			t.Fatalf("%s: read failed: %v", name, err)
+		}
+		em, ok := m.(*ExtendedMessage)
+		if !ok {
+			t.Fatalf("%s: expected ExtendedMessage, got %T", name, m)
+		}
+		if !Equal(em.Message, walk) || !bytes.Equal(em.Extra, extra) || MessageTag(em) != 3 {
+			t.Errorf("%s: unexpected message %#v with extra %v", name, em.Message, em.Extra)
+		}
+
+		// The extension is encoded again unchanged.
+		var buf bytes.Buffer
+		if err = (&Encoder{Protocol: NineP2000, Writer: &buf}).WriteMessage(em); err != nil {
+			t.Fatalf("%s: write failed: %v", name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), frame) {
+			t.Errorf("%s: re-encoded message differs:\n\t%#v\n\t%#v", name, buf.Bytes(), frame)
+		}
+
+		// Messages without extensions are not wrapped.
+		if m, err = d.ReadMessage(); err != nil {
+			t.Fatalf("%s: read failed: %v", name, err)
+		}
+		if _, ok = m.(*ClunkRequest); !ok {
+			t.Errorf("%s: expected ClunkRequest, got %T", name, m)
+		}
+	}
+
+	// Strict takes precedence.
+	d := &Decoder{Protocol: NineP2000, Reader: bytes.NewReader(frame), MessageSize: 8192, PreserveExtensions: true, Strict: true}
+	if _, err := d.ReadMessage(); err != ErrTrailingData {
+		t.Errorf("expected ErrTrailingData in strict mode, got %v", err)
+	}
+}
+
+func TestEncoderWriteMessageN(t *testing.T) {
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf}
+	for i, tt := range MessageTestData {
+		buf.Reset()
+		n, err := e.WriteMessageN(tt.input)
+		if err != nil {
+			t.Fatalf("test %d: write failed: %v", i, err)
+		}
+		if expected := HeaderSize + tt.input.EncodedSize(); n != expected || n != buf.Len() {
+			t.Errorf("test %d: expected %d bytes, got %d, wrote %d", i, expected, n, buf.Len())
+		}
+	}
+
+	if n, err := e.WriteMessageN(&ErrorResponseDotu{}); err == nil || n != 0 {
+		t.Errorf("expected encoding error and 0 bytes, got %d, %v", n, err)
+	}
+}
+
+func TestEncoderClose(t *testing.T) {
+	// Nothing reads from the pipe, so writes block.
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	e := &Encoder{Protocol: NineP2000, Writer: c1, MessageSize: 8192}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			errs <- e.WriteMessage(&ClunkRequest{Tag: Tag(i)})
+		}(i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if err := e.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != ErrEncoderClosed {
+				t.Errorf("expected ErrEncoderClosed from blocked write, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("write not unblocked by close")
+		}
+	}
+
+	if err := e.WriteMessage(&ClunkRequest{}); err != ErrEncoderClosed {
+		t.Errorf("expected ErrEncoderClosed after close, got %v", err)
+	}
+	if err := e.Flush(); err != ErrEncoderClosed {
+		t.Errorf("expected ErrEncoderClosed from flush, got %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Errorf("expected second close to succeed, got %v", err)
+	}
+}
+
+// echoServer replies to every message read from rw with a ClunkResponse with
+// the same tag.
+func echoServer(rw io.ReadWriter) {
+	s := NewSession(rw, NineP2000, 8192)
+	for {
+		m, err := s.Decoder.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err = s.Encoder.WriteMessage(&ClunkResponse{Tag: MessageTag(m)}); err != nil {
+			return
+		}
+	}
+}
+
+func TestEncoderFlush(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go echoServer(c2)
+
+	e := &Encoder{Protocol: NineP2000, Writer: bufio.NewWriter(c1), MessageSize: 8192}
+	d := &Decoder{Protocol: NineP2000, Reader: c1, MessageSize: 8192}
+
+	// Without a flush, the request stays in the buffer, and the response never
+	// arrives.
+	if err := e.WriteMessage(&ClunkRequest{Tag: 1}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	c1.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := d.ReadMessage(); err == nil {
+		t.Fatalf("received response to unflushed request")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	if err := e.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	c1.SetReadDeadline(time.Now().Add(time.Second))
+	m, err := d.ReadMessage()
+	if err != nil {
+		t.Fatalf("read after flush failed: %v", err)
+	}
+	if MessageTag(m) != 1 {
+		t.Errorf("expected tag 1, got %d", MessageTag(m))
+	}
+
+	// AutoFlush flushes after every message.
+	e.AutoFlush = true
+	if err = e.WriteMessage(&ClunkRequest{Tag: 2}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if m, err = d.ReadMessage(); err != nil {
+		t.Fatalf("read with AutoFlush failed: %v", err)
+	}
+	if MessageTag(m) != 2 {
+		t.Errorf("expected tag 2, got %d", MessageTag(m))
+	}
+
+	// Flush also waits for queued messages.
+	e.AutoFlush = false
+	if err = e.EnqueueMessage(&ClunkRequest{Tag: 3}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	if err = e.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if m, err = d.ReadMessage(); err != nil {
+		t.Fatalf("read after queued flush failed: %v", err)
+	}
+	if MessageTag(m) != 3 {
+		t.Errorf("expected tag 3, got %d", MessageTag(m))
+	}
+	if err = e.CloseQueue(); err != nil {
+		t.Errorf("close failed: %v", err)
+	}
+}
+
+func TestSizeWidth(t *testing.T) {
+	msg := &WalkRequest{Tag: 1, Fid: 2, NewFid: 3, Names: []string{"usr", "glenda"}}
+	for _, width := range []int{0, 4, 8} {
+		var buf bytes.Buffer
+		e := &Encoder{Protocol: NineP2000, Writer: &buf, MessageSize: 8192, SizeWidth: width}
+		for i := 0; i < 3; i++ {
+			if err := e.WriteMessage(msg); err != nil {
+				t.Fatalf("width %d: unable to encode message: %v", width, err)
+			}
+		}
+
+		w := width
+		if w == 0 {
+			w = 4
+		}
+		size := msg.EncodedSize() + w + 1
+		if buf.Len() != 3*size {
+			t.Fatalf("width %d: expected %d bytes, got %d", width, 3*size, buf.Len())
+		}
+		if mt := MessageType(buf.Bytes()[w]); mt != Twalk {
+			t.Errorf("width %d: expected Twalk after size field, got %v", width, mt)
+		}
+
+		readers := map[string]func() *Decoder{
+			"simple": func() *Decoder {
+				return &Decoder{Protocol: NineP2000, Reader: bytes.NewReader(buf.Bytes()), MessageSize: 8192, SizeWidth: width}
+			},
+			"greedy": func() *Decoder {
+				return &Decoder{Protocol: NineP2000, Reader: bytes.NewReader(buf.Bytes()), MessageSize: 8192, SizeWidth: width, Greedy: true}
+			},
+			"bufio": func() *Decoder {
+				return &Decoder{Protocol: NineP2000, Reader: bufio.NewReader(bytes.NewReader(buf.Bytes())), MessageSize: 8192, SizeWidth: width}
+			},
+		}
+		for name, nd := range readers {
+			d := nd()
+			for i := 0; i < 3; i++ {
+				m, err := d.ReadMessage()
+				if err != nil {
+					t.Fatalf("width %d, %s: message %d: read failed: %v", width, name, i, err)
+				}
+				if !Equal(m, msg) {
+					t.Errorf("width %d, %s: message %d differs:\n%s", width, name, i, Diff(m, msg))
+				}
+			}
+			if _, err := d.ReadMessage(); err != io.EOF {
+				t.Errorf("width %d, %s: expected EOF, got %v", width, name, err)
+			}
+		}
+	}
+}
+
+func TestSizeWidthTooBig(t *testing.T) {
+	header := func(size uint64) []byte {
+		b := make([]byte, 9)
+		binary.LittleEndian.PutUint64(b, size)
+		b[8] = byte(Twrite)
+		return b
+	}
+
+	tests := []struct {
+		b         []byte
+		msize     uint32
+		size, max int
+	}{
+		{header(1 << 40), 8192, 1 << 40, 8192},
+		{header(1 << 63), 8192, maxInt, 8192},
+		{header(1 << 63), 0, maxInt, maxInt},
+	}
+	for i, tt := range tests {
+		for _, mode := range []string{"simple", "greedy", "bufio"} {
+			if mode == "greedy" && tt.msize == 0 {
+				continue
+			}
+			var r io.Reader = bytes.NewReader(tt.b)
+			if mode == "bufio" {
+				r = bufio.NewReader(r)
+			}
+			d := &Decoder{Protocol: NineP2000, Reader: r, MessageSize: tt.msize, SizeWidth: 8, Greedy: mode == "greedy"}
+			_, err := d.ReadMessage()
+			var tooBig *MessageTooBigError
+			if !errors.As(err, &tooBig) || tooBig.Size != tt.size || tooBig.Max != tt.max {
+				t.Errorf("test %d: %s: expected size %d and max %d, got %v", i, mode, tt.size, tt.max, err)
+			}
+		}
+	}
+}
+
+func TestDecoderUnlimitedGrowth(t *testing.T) {
+	// A large message decodes across several doublings of the buffer.
+	msg := &WriteRequest{Tag: 1, Fid: 2, Data: make([]byte, 5*growSize+3)}
+	for i := range msg.Data {
+		msg.Data[i] = byte(i)
+	}
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf, SizeWidth: 8}
+	if err := e.WriteMessage(msg); err != nil {
+		t.Fatalf("unable to encode message: %v", err)
+	}
+
+	// A header claiming a terabyte, followed by only a little data, must fail
+	// without allocating for the claimed size.
+	hostile := make([]byte, 9+100)
+	binary.LittleEndian.PutUint64(hostile, 1<<40)
+	hostile[8] = byte(Twrite)
+
+	for _, mode := range []string{"simple", "bufio"} {
+		reader := func(b []byte) io.Reader {
+			if mode == "bufio" {
+				return bufio.NewReader(bytes.NewReader(b))
+			}
+			return bytes.NewReader(b)
+		}
+
+		d := &Decoder{Protocol: NineP2000, Reader: reader(buf.Bytes()), SizeWidth: 8}
+		m, err := d.ReadMessage()
+		if err != nil {
+			t.Fatalf("%s: read failed: %v", mode, err)
+		}
+		if !Equal(m, msg) {
+			t.Errorf("%s: message differs", mode)
+		}
+
+		d = &Decoder{Protocol: NineP2000, Reader: reader(hostile), SizeWidth: 8}
+		if _, err = d.ReadMessage(); err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: expected io.ErrUnexpectedEOF, got %v", mode, err)
+		}
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	var dump []byte
+	for _, tt := range MessageTestData {
+		dump = append(dump, tt.container...)
+	}
+
+	msgs, err := DecodeAll(NineP2000, dump)
+	if err != nil {
+		t.Fatalf("clean dump: unexpected error: %v", err)
+	}
+	if len(msgs) != len(MessageTestData) {
+		t.Fatalf("clean dump: expected %d messages, got %d", len(MessageTestData), len(msgs))
+	}
+	for i, m := range msgs {
+		if !Equal(m, MessageTestData[i].input.(Message)) {
+			t.Errorf("clean dump: message %d differs:\n%s", i, Diff(m, MessageTestData[i].input.(Message)))
+		}
+	}
+
+	if msgs, err = DecodeAll(NineP2000, nil); err != nil || len(msgs) != 0 {
+		t.Errorf("empty dump: expected no messages and no error, got %d messages and %v", len(msgs), err)
+	}
+
+	// Truncating the last message, both in its body and in its header.
+	last := len(MessageTestData[len(MessageTestData)-1].container)
+	for _, cut := range []int{1, last - 3} {
+		msgs, err = DecodeAll(NineP2000, dump[:len(dump)-cut])
+		if err != ErrPayloadTooShort {
+			t.Errorf("truncated by %d: expected ErrPayloadTooShort, got %v", cut, err)
+		}
+		if len(msgs) != len(MessageTestData)-1 {
+			t.Errorf("truncated by %d: expected %d messages, got %d", cut, len(MessageTestData)-1, len(msgs))
+		}
+	}
+}
+
+func TestDecoderStrict(t *testing.T) {
+	// A message with a byte of padding after the last field.
+	padded := append([]byte{}, MessageTestData[0].container...)
+	padded = append(padded, 0)
+	padded[0]++
+
+	for _, greedy := range []bool{false, true} {
+		d := &Decoder{Protocol: NineP2000, Reader: bytes.NewReader(padded), MessageSize: 8192, Greedy: greedy}
+		if _, err := d.ReadMessage(); err != nil {
+			t.Errorf("greedy %t: lenient decoder rejected padding: %v", greedy, err)
+		}
+
+		d = &Decoder{Protocol: NineP2000, Reader: bytes.NewReader(padded), MessageSize: 8192, Greedy: greedy, Strict: true}
+		if _, err := d.ReadMessage(); err != ErrTrailingData {
+			t.Errorf("greedy %t: expected ErrTrailingData, got %v", greedy, err)
+		}
+
+		d = &Decoder{Protocol: NineP2000, Reader: bytes.NewReader(MessageTestData[0].container), MessageSize: 8192, Greedy: greedy, Strict: true}
+		if _, err := d.ReadMessage(); err != nil {
+			t.Errorf("greedy %t: strict decoder rejected canonical message: %v", greedy, err)
+		}
+	}
+}
+
+func TestDecoderSetReader(t *testing.T) {
+	d := &Decoder{Protocol: NineP2000, MessageSize: 8192, Greedy: true}
+	for i := 0; i < 2; i++ {
+		c1, c2 := net.Pipe()
+		go func(i int) {
+			e := &Encoder{Protocol: NineP2000, Writer: c2, MessageSize: 8192}
+			e.WriteMessage(&ClunkRequest{Tag: Tag(i), Fid: 1})
+			// Leave a partial message behind, which must not leak into the
+			// next stream.
+			c2.Write([]byte{0x40, 0x00})
+			c2.Close()
+		}(i)
+
+		d.SetReader(c1)
+		m, err := d.ReadMessage()
+		if err != nil {
+			t.Fatalf("stream %d: read failed: %v", i, err)
+		}
+		if MessageTag(m) != Tag(i) {
+			t.Errorf("stream %d: expected tag %d, got %d", i, i, MessageTag(m))
+		}
+		if _, err = d.ReadMessage(); err == nil {
+			t.Errorf("stream %d: expected error for partial message", i)
+		}
+		c1.Close()
+	}
+}
+
+func TestDecodeAt(t *testing.T) {
+	var capture []byte
+	var offsets []int64
+	for _, tt := range MessageTestData {
+		offsets = append(offsets, int64(len(capture)))
+		capture = append(capture, tt.container...)
+	}
+	r := bytes.NewReader(capture)
+
+	// Decode the second message directly by its offset.
+	m, n, err := DecodeAt(r, offsets[1], 8192)
+	if err != nil {
+		t.Fatalf("decode of second message failed: %v", err)
+	}
+	if n != len(MessageTestData[1].container) {
+		t.Errorf("expected size %d, got %d", len(MessageTestData[1].container), n)
+	}
+	if !Equal(m, MessageTestData[1].input) {
+		t.Errorf("unexpected message:\n%s", Diff(m, MessageTestData[1].input))
+	}
+
+	// Walk the capture by the returned sizes.
+	var off int64
+	for i, tt := range MessageTestData {
+		if off != offsets[i] {
+			t.Fatalf("test %d: expected offset %d, got %d", i, offsets[i], off)
+		}
+		m, n, err := DecodeAt(r, off, 8192)
+		if err != nil {
+			t.Fatalf("test %d: decode failed: %v", i, err)
+		}
+		if !Equal(m, tt.input) {
+			t.Errorf("test %d: unexpected message:\n%s", i, Diff(m, tt.input))
+		}
+		off += int64(n)
+	}
+	if _, _, err := DecodeAt(r, off, 8192); err != io.EOF {
+		t.Errorf("expected io.EOF at end of capture, got %v", err)
+	}
+
+	truncated := bytes.NewReader(capture[:offsets[1]+int64(n)-1])
+	if _, _, err := DecodeAt(truncated, offsets[1], 8192); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF for truncated message, got %v", err)
+	}
+
+	huge := bytes.NewReader([]byte{0xF0, 0xFF, 0xFF, 0xFF, byte(Twrite)})
+	var tooBig *MessageTooBigError
+	if _, _, err := DecodeAt(huge, 0, 8192); !errors.As(err, &tooBig) || tooBig.Size != 0xFFFFFFF0 || tooBig.Max != 8192 {
+		t.Errorf("expected MessageTooBigError for oversized message, got %v", err)
+	}
+
+	// An msize of 0 does not limit the message size.
+	if m, _, err := DecodeAt(r, offsets[1], 0); err != nil || !Equal(m, MessageTestData[1].input) {
+		t.Errorf("expected second message without limit, got %v, %v", m, err)
+	}
+}
+
+func TestSkipMessage(t *testing.T) {
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf}
+	msgs := []Message{
+		&ReadResponse{Tag: 1, Data: make([]byte, 10000)},
+		&ClunkRequest{Tag: 2, Fid: 3},
+	}
+	for _, m := range msgs {
+		if err := e.WriteMessage(m); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	capture := append([]byte{}, buf.Bytes()...)
+
+	mt, err := SkipMessage(&buf)
+	if err != nil {
+		t.Fatalf("skip failed: %v", err)
+	}
+	if mt != Rread {
+		t.Errorf("expected %v, got %v", Rread, mt)
+	}
+
+	// The next message can be decoded from the same reader.
+	d := &Decoder{Protocol: NineP2000, Reader: &buf, MessageSize: 1024}
+	m, err := d.ReadMessage()
+	if err != nil {
+		t.Fatalf("read after skip failed: %v", err)
+	}
+	if !Equal(m, msgs[1]) {
+		t.Errorf("unexpected message after skip:\n%s", Diff(m, msgs[1]))
+	}
+	if _, err = SkipMessage(&buf); err != io.EOF {
+		t.Errorf("expected io.EOF at end, got %v", err)
+	}
+
+	truncated := bytes.NewReader(capture[:5000])
+	if _, err = SkipMessage(truncated); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF for truncated message, got %v", err)
+	}
+}
+
+func TestEncodeBody(t *testing.T) {
+	// An external framing of type[1] length[2] body, unrelated to 9P framing.
+	var frames []byte
+	for i, tt := range MessageTestData {
+		mt, body, err := EncodeBody(NineP2000, tt.input.(Message))
+		if err != nil {
+			t.Fatalf("test %d: unable to encode body: %v", i, err)
+		}
+		if bytes.Compare(body, tt.reference) != 0 {
+			t.Errorf("test %d: body does not match reference:\n\t%#v\n\t%#v", i, body, tt.reference)
+		}
+		if mt != MessageType(tt.container[4]) {
+			t.Errorf("test %d: expected type %v, got %v", i, MessageType(tt.container[4]), mt)
+		}
+		frames = append(frames, byte(mt), byte(len(body)), byte(len(body)>>8))
+		frames = append(frames, body...)
+	}
+
+	for i, tt := range MessageTestData {
+		mt, l := MessageType(frames[0]), int(frames[1])|int(frames[2])<<8
+		m, err := DecodeBody(NineP2000, mt, frames[3:3+l])
+		if err != nil {
+			t.Fatalf("test %d: unable to decode body: %v", i, err)
+		}
+		if !Equal(m, tt.input.(Message)) {
+			t.Errorf("test %d: decoded message differs:\n%s", i, Diff(m, tt.input.(Message)))
+		}
+		frames = frames[3+l:]
+	}
+
+	if _, err := DecodeBody(NineP2000, MessageType(0), nil); err != ErrUnknownMessageType {
+		t.Errorf("expected ErrUnknownMessageType, got %v", err)
+	}
+}
+
+func TestDecodeTypedBody(t *testing.T) {
+	// The type and length of the body are known from an outer protocol.
+	in := &WalkRequest{Tag: 3, Fid: 1, NewFid: 2, Names: []string{"a", "bc"}}
+	mt, body, err := EncodeBody(NineP2000, in)
+	if err != nil {
+		t.Fatalf("unable to encode body: %v", err)
+	}
+
+	r := bytes.NewReader(append(body, 0xAA))
+	m, err := DecodeTypedBody(NineP2000, Twalk, r, len(body))
+	if err != nil {
+		t.Fatalf("unable to decode body: %v", err)
+	}
+	if mt != Twalk || !Equal(m, in) {
+		t.Errorf("decoded message differs:\n%s", Diff(m, in))
+	}
+	if r.Len() != 1 {
+		t.Errorf("expected only the body to be consumed, %d bytes left", r.Len())
+	}
+
+	if _, err = DecodeTypedBody(NineP2000, Twalk, bytes.NewReader(body[:5]), len(body)); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF for short body, got %v", err)
+	}
+	if _, err = DecodeTypedBody(NineP2000, Twalk, bytes.NewReader(body), 5); !errors.As(err, new(*DecodeError)) {
+		t.Errorf("expected DecodeError for truncated length, got %v", err)
+	}
+	if _, err = DecodeTypedBody(NineP2000, MessageType(0), bytes.NewReader(body), len(body)); err != ErrUnknownMessageType {
+		t.Errorf("expected ErrUnknownMessageType, got %v", err)
+	}
+}
+
+func TestMessageTooBigError(t *testing.T) {
+	m := &WriteRequest{Data: make([]byte, 100)}
+	size := m.EncodedSize() + HeaderSize
+
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf, MessageSize: 64}
+	err := e.WriteMessage(m)
+	if !errors.Is(err, ErrMessageTooBig) {
+		t.Fatalf("encoder: expected ErrMessageTooBig, got %v", err)
+	}
+	var tooBig *MessageTooBigError
+	if !errors.As(err, &tooBig) || tooBig.Size != size || tooBig.Max != 64 {
+		t.Errorf("encoder: expected size %d and max 64, got %v", size, err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("encoder: wrote %d bytes of oversized message", buf.Len())
+	}
+
+	e.MessageSize = 8192
+	if err = e.WriteMessage(m); err != nil {
+		t.Fatalf("encoder: unable to write message: %v", err)
+	}
+
+	// A header alone claiming a huge message must be rejected before the
+	// body is allocated.
+	huge := []byte{0xF0, 0xFF, 0xFF, 0xFF, byte(Twrite)}
+	tests := []struct {
+		b    []byte
+		size int
+	}{
+		{buf.Bytes(), size},
+		{huge, 0xFFFFFFF0},
+	}
+	for i, tt := range tests {
+		for _, mode := range []string{"simple", "greedy", "bufio"} {
+			var r io.Reader = bytes.NewReader(tt.b)
+			if mode == "bufio" {
+				r = bufio.NewReader(r)
+			}
+			d := &Decoder{Protocol: NineP2000, Reader: r, MessageSize: 64, Greedy: mode == "greedy"}
+			_, err = d.ReadMessage()
+			if !errors.Is(err, ErrMessageTooBig) {
+				t.Fatalf("test %d: %s: expected ErrMessageTooBig, got %v", i, mode, err)
+			}
+			if !errors.As(err, &tooBig) || tooBig.Size != tt.size || tooBig.Max != 64 {
+				t.Errorf("test %d: %s: expected size %d and max 64, got %v", i, mode, tt.size, err)
+			}
+		}
+	}
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	full := MessageTestData[0].container
+	tests := []struct {
+		b   []byte
+		err error
+	}{
+		{nil, io.EOF},
+		{full[:2], io.ErrUnexpectedEOF},
+		{full[:HeaderSize], io.ErrUnexpectedEOF},
+		{full[:len(full)-1], io.ErrUnexpectedEOF},
+	}
+
+	modes := map[string]func(r io.Reader) *Decoder{
+		"simple": func(r io.Reader) *Decoder {
+			return &Decoder{Protocol: NineP2000, Reader: r, MessageSize: 8192}
+		},
+		"greedy": func(r io.Reader) *Decoder {
+			return &Decoder{Protocol: NineP2000, Reader: r, MessageSize: 8192, Greedy: true}
+		},
+		"bufio": func(r io.Reader) *Decoder {
+			return &Decoder{Protocol: NineP2000, Reader: bufio.NewReader(r), MessageSize: 8192}
+		},
+	}
+
+	for name, nd := range modes {
+		for i, tt := range tests {
+			// A complete message first, so that a clean EOF is only reported
+			// at a message boundary.
+			b := append(append([]byte{}, full...), tt.b...)
+			d := nd(&ByteReader{bytes.NewReader(b)})
+			if _, err := d.ReadMessage(); err != nil {
+				t.Fatalf("%s test %d: unable to read first message: %v", name, i, err)
+			}
+			if _, err := d.ReadMessage(); err != tt.err {
+				t.Errorf("%s test %d: expected %v, got %v", name, i, tt.err, err)
+			}
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	tests := []struct {
+		m     Message
+		cut   int
+		mt    MessageType
+		field string
+	}{
+		{&WalkRequest{Tag: 1, Fid: 1, NewFid: 2, Names: []string{"a", "b", "c", "glenda"}}, 3, Twalk, "Names[3]"},
+		{&WalkRequest{Tag: 1, Fid: 1, NewFid: 2}, 3, Twalk, "NewFid"},
+		{&StatResponse{Tag: 1, Stat: Stat{Name: "glenda", UID: "glenda"}}, 14, Rstat, "Stat.Name"},
+		{&WalkResponse{Tag: 1, Qids: []Qid{{}, {}}}, 1, Rwalk, "Qids"},
+		{&ReadResponse{Tag: 1, Data: []byte("glenda")}, 1, Rread, "Data"},
+	}
+
+	for i, tt := range tests {
+		mt, body, err := EncodeBody(NineP2000, tt.m)
+		if err != nil {
+			t.Fatalf("test %d: encode failed: %v", i, err)
+		}
+		body = body[:len(body)-tt.cut]
+
+		frame := make([]byte, HeaderSize+len(body))
+		binary.LittleEndian.PutUint32(frame, uint32(len(frame)))
+		frame[4] = byte(mt)
+		copy(frame[HeaderSize:], body)
+
+		_, err1 := DecodeBody(NineP2000, mt, body)
+		d := &Decoder{Protocol: NineP2000, Reader: bytes.NewReader(frame), MessageSize: 8192}
+		_, err2 := d.ReadMessage()
+
+		// The Decoder rejects bodies too small for the fixed fields before
+		// decoding them.
+		errs := []error{err1, err2}
+		if min, _ := MinSize(NineP2000, mt); len(body) < min {
+			if err2 != ErrBodyTooSmall {
+				t.Errorf("test %d: expected ErrBodyTooSmall from decoder, got %v", i, err2)
+			}
+			errs = errs[:1]
+		}
+
+		for _, err := range errs {
+			var de *DecodeError
+			if !errors.As(err, &de) {
+				t.Errorf("test %d: expected DecodeError, got %v", i, err)
+				continue
+			}
+			if de.Type != tt.mt || de.Field != tt.field {
+				t.Errorf("test %d: expected %v %s, got %v %s", i, tt.mt, tt.field, de.Type, de.Field)
+			}
+			if !errors.Is(err, ErrPayloadTooShort) {
+				t.Errorf("test %d: expected error to wrap ErrPayloadTooShort, got %v", i, err)
+			}
+		}
+	}
+}
+
+func TestDecodeInto(t *testing.T) {
+	msgs := []Message{
+		&WalkRequest{Tag: 1, Fid: 1, NewFid: 2, Names: []string{"usr", "glenda"}},
+		&ClunkRequest{Tag: 2, Fid: 2},
+		&WalkRequest{Tag: 3, Fid: 1, NewFid: 3, Names: []string{"tmp"}},
+	}
+
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf}
+	for _, m := range msgs {
+		if err := e.WriteMessage(m); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	// A single WalkRequest is reused for all walks.
+	var walk WalkRequest
+	if err := DecodeInto(NineP2000, &buf, &walk, 8192); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if !Equal(&walk, msgs[0]) {
+		t.Errorf("unexpected message:\n%s", Diff(&walk, msgs[0]))
+	}
+
+	// The clunk does not match, but is consumed.
+	if err := DecodeInto(NineP2000, &buf, &walk, 8192); err != ErrTypeMismatch {
+		t.Errorf("expected ErrTypeMismatch, got %v", err)
+	}
+
+	if err := DecodeInto(NineP2000, &buf, &walk, 8192); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if !Equal(&walk, msgs[2]) {
+		t.Errorf("unexpected message:\n%s", Diff(&walk, msgs[2]))
+	}
+
+	if err := DecodeInto(NineP2000, &buf, &walk, 8192); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+
+	huge := bytes.NewReader([]byte{0xF0, 0xFF, 0xFF, 0xFF, byte(Twalk)})
+	var tooBig *MessageTooBigError
+	if err := DecodeInto(NineP2000, huge, &walk, 8192); !errors.As(err, &tooBig) || tooBig.Size != 0xFFFFFFF0 || tooBig.Max != 8192 {
+		t.Errorf("expected MessageTooBigError for oversized message, got %v", err)
+	}
+
+	// An msize of 0 does not limit the message size.
+	buf.Reset()
+	if err := e.WriteMessage(msgs[0]); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := DecodeInto(NineP2000, &buf, &walk, 0); err != nil || !Equal(&walk, msgs[0]) {
+		t.Errorf("expected walk without limit, got %v", err)
+	}
+}
+
+func TestMinSize(t *testing.T) {
+	tests := []struct {
+		p    Protocol
+		mt   MessageType
+		size int
+	}{
+		// tag[2] fid[4] newfid[4] nwname[2]
+		{NineP2000, Twalk, 2 + 4 + 4 + 2},
+		// tag[2] count[4]
+		{NineP2000, Rread, 2 + 4},
+		{NineP2000, Tclunk, 2 + 4},
+		// tag[2] n[2] and a stat with empty strings.
+		{NineP2000, Rstat, 2 + 2 + 2 + 2 + 4 + 13 + 4 + 4 + 4 + 8 + 4*2},
+		// The 9P2000.u stat adds an extension string and three numbers.
+		{NineP2000Dotu, Rstat, 2 + 2 + 2 + 2 + 4 + 13 + 4 + 4 + 4 + 8 + 5*2 + 3*4},
+	}
+
+	for i, tt := range tests {
+		size, err := MinSize(tt.p, tt.mt)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		}
+		if size != tt.size {
+			t.Errorf("test %d: expected %d, got %d", i, tt.size, size)
+		}
+	}
+
+	if _, err := MinSize(NineP2000, MessageType(0)); err != ErrUnknownMessageType {
+		t.Errorf("expected ErrUnknownMessageType, got %v", err)
+	}
+}
+
+func TestFramedMessageWriteTo(t *testing.T) {
+	msgs := []Message{
+		&VersionRequest{Tag: NOTAG, MessageSize: 8192, Version: Version},
+		&WalkRequest{Tag: 1, Fid: 1, NewFid: 2, Names: []string{"usr", "glenda"}},
+		&ReadResponse{Tag: 2, Data: []byte("hello")},
+	}
+
+	for i, m := range msgs {
+		var expected, got bytes.Buffer
+		e := &Encoder{Protocol: NineP2000, Writer: &expected}
+		if err := e.WriteMessage(m); err != nil {
+			t.Fatalf("test %d: encoder failed: %v", i, err)
+		}
+
+		n, err := FramedMessage{NineP2000, m}.WriteTo(&got)
+		if err != nil {
+			t.Fatalf("test %d: WriteTo failed: %v", i, err)
+		}
+		if n != int64(got.Len()) {
+			t.Errorf("test %d: WriteTo returned %d, wrote %d bytes", i, n, got.Len())
+		}
+		if !bytes.Equal(got.Bytes(), expected.Bytes()) {
+			t.Errorf("test %d: output differs from Encoder:\nexpected: %#v\ngot:      %#v", i, expected.Bytes(), got.Bytes())
+		}
+	}
+
+	if _, err := (FramedMessage{NineP2000, &ErrorResponseDotu{}}).WriteTo(&bytes.Buffer{}); !errors.Is(err, ErrUnknownMessageType) {
+		t.Errorf("expected ErrUnknownMessageType, got %v", err)
+	}
+}
+
+// rawMessage is a custom message without a tag.
+type rawMessage struct {
+	Data []byte
+}
+
+func (m *rawMessage) EncodedSize() int { return len(m.Data) }
+
+func (m *rawMessage) Marshal(b []byte) error {
+	copy(b, m.Data)
+	return nil
+}
+
+func (m *rawMessage) Unmarshal(b []byte) error {
+	m.Data = append(m.Data[:0], b...)
+	return nil
+}
+
+// rawProtocol is a protocol consisting only of rawMessage, with type 1.
+type rawProtocol struct{}
+
+func (rawProtocol) MessageType(m Message) (MessageType, error) {
+	if _, ok := m.(*rawMessage); ok {
+		return 1, nil
+	}
+	return 0, ErrUnknownMessageType
+}
+
+func (rawProtocol) Message(mt MessageType) (Message, error) {
+	if mt == 1 {
+		return &rawMessage{}, nil
+	}
+	return nil, ErrUnknownMessageType
+}
+
+func TestDecoderFilterAllocs(t *testing.T) {
+	// Streams with a single accepted message, without and with 100 skipped
+	// messages before it.
+	var plain, skipping bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &skipping}
+	for i := 0; i < 100; i++ {
+		if err := e.WriteMessage(&ReadResponse{Tag: Tag(i), Data: make([]byte, 100)}); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	for _, w := range []io.Writer{&plain, &skipping} {
+		e = &Encoder{Protocol: NineP2000, Writer: w}
+		if err := e.WriteMessage(&ClunkRequest{Tag: 1, Fid: 1}); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	for _, name := range []string{"simple", "greedy", "bufio"} {
+		allocs := func(stream []byte) float64 {
+			r := bytes.NewReader(stream)
+			br := bufio.NewReader(r)
+			d := &Decoder{
+				Protocol:    NineP2000,
+				Reader:      r,
+				MessageSize: 1024,
+				Greedy:      name == "greedy",
+				Filter:      func(mt MessageType) bool { return mt == Tclunk },
+			}
+			if name == "bufio" {
+				d.Reader = br
+			}
+			// Warm up buffers that are allocated once.
+			if _, err := d.ReadMessage(); err != nil {
+				t.Fatalf("%s: read failed: %v", name, err)
+			}
+
+			return testing.AllocsPerRun(100, func() {
+				r.Reset(stream)
+				br.Reset(r)
+				if _, err := d.ReadMessage(); err != nil {
+					t.Fatalf("%s: read failed: %v", name, err)
+				}
+			})
+		}
+
+		if a, b := allocs(plain.Bytes()), allocs(skipping.Bytes()); a != b {
+			t.Errorf("%s: skipped messages allocated: %v allocations without, %v with", name, a, b)
+		}
+	}
+}
+
+func TestUntaggedMessage(t *testing.T) {
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: rawProtocol{}, Writer: &buf}
+	in := &rawMessage{Data: []byte("hello")}
+	if err := e.WriteMessage(in); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	d := &Decoder{Protocol: rawProtocol{}, Reader: &buf, MessageSize: 1024}
+	m, err := d.ReadMessage()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !Equal(m, in) {
+		t.Errorf("unexpected message:\n%s", Diff(m, in))
+	}
+	if tag := MessageTag(m); tag != NOTAG {
+		t.Errorf("expected NOTAG for untagged message, got %d", tag)
+	}
+
+	c, conn := newTestClient(func(m Message) Message { return nil })
+	defer conn.Close()
+	if _, err = c.Send(in); err != ErrUntaggedMessage {
+		t.Errorf("expected ErrUntaggedMessage from Send, got %v", err)
+	}
+}
+
+func TestDecoderFilter(t *testing.T) {
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf}
+	walks := []Message{
+		&WalkRequest{Tag: 1, Fid: 1, NewFid: 2, Names: []string{"usr"}},
+		&WalkRequest{Tag: 3, Fid: 2, NewFid: 3, Names: []string{"glenda"}},
+	}
+	for _, m := range []Message{
+		&ReadRequest{Tag: 0, Fid: 1, Count: 8192},
+		walks[0],
+		&ReadRequest{Tag: 2, Fid: 2, Count: 8192},
+		&ReadResponse{Tag: 2, Data: make([]byte, 10000)},
+		walks[1],
+		&ReadRequest{Tag: 4, Fid: 3, Count: 8192},
+	} {
+		if err := e.WriteMessage(m); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	readers := map[string]func() io.Reader{
+		"simple": func() io.Reader { return bytes.NewReader(buf.Bytes()) },
+		"greedy": func() io.Reader { return bytes.NewReader(buf.Bytes()) },
+		"bufio":  func() io.Reader { return bufio.NewReaderSize(bytes.NewReader(buf.Bytes()), 4096) },
+	}
+	for name, r := range readers {
+		d := &Decoder{
+			Protocol:    NineP2000,
+			Reader:      r(),
+			MessageSize: 16384,
+			Greedy:      name == "greedy",
+			Filter: func(mt MessageType) bool {
+				return mt != Tread && mt != Rread
+			},
+		}
+		for i, expected := range walks {
+			m, err := d.ReadMessage()
+			if err != nil {
+				t.Fatalf("%s: message %d: read failed: %v", name, i, err)
+			}
+			if !Equal(m, expected) {
+				t.Errorf("%s: message %d: unexpected message:\n%s", name, i, Diff(m, expected))
+			}
+		}
+		if _, err := d.ReadMessage(); err != io.EOF {
+			t.Errorf("%s: expected io.EOF after skipped message, got %v", name, err)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	msgs := []Message{
+		&WalkRequest{Tag: 1, Fid: 1, NewFid: 2, Names: []string{"usr", "glenda"}},
+		&ReadResponse{Tag: 2, Data: []byte("hello")},
+	}
+
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf, Checksum: true}
+	for _, m := range msgs {
+		if err := e.WriteMessage(m); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	clean := append([]byte{}, buf.Bytes()...)
+
+	// Flip a bit in the body of the second message.
+	corrupt := append([]byte{}, clean...)
+	corrupt[len(corrupt)-checksumSize-1] ^= 0x01
+
+	readers := map[string]func([]byte) io.Reader{
+		"simple": func(b []byte) io.Reader { return bytes.NewReader(b) },
+		"greedy": func(b []byte) io.Reader { return bytes.NewReader(b) },
+		"bufio":  func(b []byte) io.Reader { return bufio.NewReader(bytes.NewReader(b)) },
+	}
+	for name, r := range readers {
+		for _, tt := range []struct {
+			b   []byte
+			err error
+		}{
+			{clean, nil},
+			{corrupt, ErrChecksumMismatch},
+		} {
+			d := &Decoder{
+				Protocol:    NineP2000,
+				Reader:      r(tt.b),
+				MessageSize: 1024,
+				Greedy:      name == "greedy",
+				Checksum:    true,
+			}
+
+			m, err := d.ReadMessage()
+			if err != nil {
+				t.Fatalf("%s: read failed: %v", name, err)
+			}
+			if !Equal(m, msgs[0]) {
+				t.Errorf("%s: unexpected message:\n%s", name, Diff(m, msgs[0]))
+			}
+
+			m, err = d.ReadMessage()
+			if err != tt.err {
+				t.Errorf("%s: expected %v, got %v", name, tt.err, err)
+			}
+			if err == nil && !Equal(m, msgs[1]) {
+				t.Errorf("%s: unexpected message:\n%s", name, Diff(m, msgs[1]))
+			}
+		}
+	}
+}
+
+func TestAlign(t *testing.T) {
+	msgs := []Message{
+		&WalkRequest{Tag: 1, Fid: 1, NewFid: 2, Names: []string{"usr", "glenda"}},
+		&ReadResponse{Tag: 2, Data: []byte("hello")},
+		&ClunkRequest{Tag: 3, Fid: 0},
+	}
+
+	for _, checksum := range []bool{false, true} {
+		var buf bytes.Buffer
+		e := &Encoder{Protocol: NineP2000, Writer: &buf, Align: 8, Checksum: checksum}
+		for _, m := range msgs {
+			if err := e.WriteMessage(m); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+		}
+
+		// Every frame is padded to a multiple of 8 bytes.
+		b := buf.Bytes()
+		for off := 0; off < len(b); {
+			s := int(binary.LittleEndian.Uint32(b[off:]))
+			if s%8 != 0 {
+				t.Errorf("checksum %v: frame at %d is %d bytes, not aligned", checksum, off, s)
+			}
+			off += s
+		}
+
+		readers := map[string]func([]byte) io.Reader{
+			"simple": func(b []byte) io.Reader { return bytes.NewReader(b) },
+			"greedy": func(b []byte) io.Reader { return bytes.NewReader(b) },
+			"bufio":  func(b []byte) io.Reader { return bufio.NewReader(bytes.NewReader(b)) },
+		}
+		for name, r := range readers {
+			d := &Decoder{
+				Protocol:    NineP2000,
+				Reader:      r(b),
+				MessageSize: 1024,
+				Greedy:      name == "greedy",
+				Strict:      true,
+				Checksum:    checksum,
+				Align:       8,
+			}
+			for i, expected := range msgs {
+				m, err := d.ReadMessage()
+				if err != nil {
+					t.Fatalf("%s: message %d: read failed: %v", name, i, err)
+				}
+				if !Equal(m, expected) {
+					t.Errorf("%s: message %d: unexpected message:\n%s", name, i, Diff(m, expected))
+				}
+			}
+		}
+	}
+
+	// A message without padding is rejected.
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf}
+	if err := e.WriteMessage(msgs[2]); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	d := &Decoder{Protocol: NineP2000, Reader: &buf, MessageSize: 1024, Align: 8}
+	if _, err := d.ReadMessage(); err != ErrInvalidPadding {
+		t.Errorf("expected ErrInvalidPadding, got %v", err)
+	}
+
+	e = &Encoder{Protocol: NineP2000, Writer: &buf, Align: 256}
+	if err := e.WriteMessage(msgs[2]); err != ErrInvalidAlign {
+		t.Errorf("expected ErrInvalidAlign, got %v", err)
+	}
+}
+
+func TestDecoderDeadLetter(t *testing.T) {
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf}
+	if err := e.WriteMessage(&ClunkRequest{Tag: 1, Fid: 1}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	// A read response claiming 1 byte of data, but carrying 2.
+	bad := []byte{0, 0, 0, 0, byte(Rread), 2, 0, 1, 0, 0, 0, 'h', 'i'}
+	binary.LittleEndian.PutUint32(bad, uint32(len(bad)))
+	buf.Write(bad)
+
+	if err := e.WriteMessage(&ClunkRequest{Tag: 3, Fid: 3}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	stream := buf.Bytes()
+
+	readers := map[string]func([]byte) io.Reader{
+		"simple": func(b []byte) io.Reader { return bytes.NewReader(b) },
+		"greedy": func(b []byte) io.Reader { return bytes.NewReader(b) },
+		"bufio":  func(b []byte) io.Reader { return bufio.NewReader(bytes.NewReader(b)) },
+	}
+	for name, r := range readers {
+		var (
+			letters   int
+			letter    []byte
+			letterErr error
+		)
+		d := &Decoder{
+			Protocol:    NineP2000,
+			Reader:      r(stream),
+			MessageSize: 1024,
+			Greedy:      name == "greedy",
+			DeadLetter: func(mt MessageType, body []byte, err error) {
+				if mt != Rread {
+					t.Errorf("%s: expected dead letter of type %v, got %v", name, Rread, mt)
+				}
+				letters++
+				letter = append([]byte{}, body...)
+				letterErr = err
+			},
+		}
+
+		for _, tag := range []Tag{1, 3} {
+			m, err := d.ReadMessage()
+			if err != nil {
+				t.Fatalf("%s: read failed: %v", name, err)
+			}
+			if MessageTag(m) != tag {
+				t.Errorf("%s: expected tag %d, got %d", name, tag, MessageTag(m))
+			}
+		}
+		if _, err := d.ReadMessage(); err != io.EOF {
+			t.Errorf("%s: expected io.EOF, got %v", name, err)
+		}
+
+		if letters != 1 {
+			t.Errorf("%s: expected 1 dead letter, got %d", name, letters)
+		}
+		if bytes.Compare(letter, bad[HeaderSize:]) != 0 {
+			t.Errorf("%s: expected dead letter body %v, got %v", name, bad[HeaderSize:], letter)
+		}
+		if !errors.Is(letterErr, ErrCountMismatch) {
+			t.Errorf("%s: expected ErrCountMismatch, got %v", name, letterErr)
+		}
+	}
+}
+
+func TestDecoderSetProtocol(t *testing.T) {
+	const count = 1000
+	r, w := io.Pipe()
+	go func() {
+		e := &Encoder{Protocol: NineP2000, Writer: w}
+		for i := 0; i < count; i++ {
+			if err := e.WriteMessage(&ClunkRequest{Tag: Tag(i), Fid: 1}); err != nil {
+				break
+			}
+		}
+		w.Close()
+	}()
+
+	d := &Decoder{Protocol: NineP2000, Reader: r, MessageSize: 1024}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				d.SetProtocol(NineP2000Dotu)
+			} else {
+				d.SetProtocol(NineP2000)
+			}
+		}
+	}()
+
+	// Both protocols decode clunks the same way, so every message must
+	// decode regardless of which one is in use.
+	for i := 0; i < count; i++ {
+		m, err := d.ReadMessage()
+		if err != nil {
+			t.Fatalf("read %d failed: %v", i, err)
+		}
+		if MessageTag(m) != Tag(i) {
+			t.Errorf("read %d: expected tag %d, got %d", i, i, MessageTag(m))
+		}
+	}
+}
+
+func TestDecoderTimestamps(t *testing.T) {
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf}
+	for i := 0; i < 3; i++ {
+		if err := e.WriteMessage(&ClunkRequest{Tag: Tag(i), Fid: 1}); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	d := &Decoder{Protocol: NineP2000, Reader: &buf, MessageSize: 1024}
+	if _, err := d.ReadMessage(); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !d.ReceivedAt().IsZero() {
+		t.Errorf("expected no timestamp without Timestamps, got %v", d.ReceivedAt())
+	}
+
+	d.Timestamps = true
+	start := time.Now()
+	var last time.Time
+	for i := 1; i < 3; i++ {
+		if _, err := d.ReadMessage(); err != nil {
+			t.Fatalf("message %d: read failed: %v", i, err)
+		}
+		ts := d.ReceivedAt()
+		if ts.Before(start) || ts.Before(last) {
+			t.Errorf("message %d: timestamp %v not monotonic after %v", i, ts, last)
+		}
+		last = ts
+	}
+}
+
+// chunkReader reads at most n bytes at a time.
+type chunkReader struct {
+	io.Reader
+	n int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.Reader.Read(p)
+}
+
+func TestDecoderNegativeNeeded(t *testing.T) {
+	stream := new(bytes.Buffer)
+	var expected []Message
+	for i := 0; i < 5000; i++ {
+		tt := MessageTestData[i%len(MessageTestData)]
+		stream.Write(tt.container)
+		expected = append(expected, tt.input)
+	}
+	raw := stream.Bytes()
+
+	// Chunk sizes are chosen to leave partial headers and bodies behind.
+	for _, chunk := range []int{len(raw), 65536, 10007, 4099, 97, 13} {
+		d := &Decoder{
+			Protocol:    NineP2000,
+			Reader:      &chunkReader{Reader: bytes.NewReader(raw), n: chunk},
+			MessageSize: 65536,
+			Greedy:      true,
+		}
+
+		for i, m := range expected {
+			got, err := d.ReadMessage()
+			if err != nil {
+				t.Fatalf("chunk %d: message %d: read failed: %v", chunk, i, err)
+			}
+			if !CompareMarshallables(m, got) {
+				t.Fatalf("chunk %d: message %d: expected %#v, got %#v", chunk, i, m, got)
+			}
+			if i == 0 && chunk >= 65536 && d.needed > -10000 {
+				t.Errorf("chunk %d: expected deeply negative needed after first message, got %d", chunk, d.needed)
+			}
+			if remainder := len(d.Buffered()); d.needed != d.headerSize()-remainder {
+				t.Errorf("chunk %d: message %d: needed is %d with %d buffered", chunk, i, d.needed, remainder)
+			}
+		}
+
+		if _, err := d.ReadMessage(); err != io.EOF {
+			t.Errorf("chunk %d: expected io.EOF, got %v", chunk, err)
+		}
+	}
+
+	// A truncated stream must leave the incomplete message as the remainder.
+	d := &Decoder{
+		Protocol:    NineP2000,
+		Reader:      bytes.NewReader(raw[:len(raw)-3]),
+		MessageSize: 65536,
+		Greedy:      true,
+	}
+	var err error
+	for i := 0; err == nil; i++ {
+		if _, err = d.ReadMessage(); err == nil && i >= len(expected)-1 {
+			t.Fatalf("decoded truncated message")
+		}
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	last := MessageTestData[(len(expected)-1)%len(MessageTestData)].container
+	if got, expected := len(d.Buffered()), len(last)-HeaderSize-3; got != expected {
+		t.Errorf("expected %d bytes remaining, got %d", expected, got)
+	}
+}
+
+// datagramReader returns one datagram per Read, truncating it if it does not
+// fit.
+type datagramReader struct {
+	datagrams [][]byte
+}
+
+func (dr *datagramReader) Read(p []byte) (int, error) {
+	if len(dr.datagrams) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, dr.datagrams[0])
+	dr.datagrams = dr.datagrams[1:]
+	return n, nil
+}
+
+func TestDecoderDatagram(t *testing.T) {
+	var datagrams [][]byte
+	for _, tt := range MessageTestData {
+		datagrams = append(datagrams, tt.container)
+	}
+
+	d := &Decoder{
+		Protocol:    NineP2000,
+		Reader:      &datagramReader{datagrams: datagrams},
+		MessageSize: 8192,
+		Datagram:    true,
+	}
+	for i, tt := range MessageTestData {
+		m, err := d.ReadMessage()
+		if err != nil {
+			t.Fatalf("test %d: read failed: %v", i, err)
+		}
+		if !Equal(m, tt.input) {
+			t.Errorf("test %d: unexpected message:\n%s", i, Diff(m, tt.input))
+		}
+	}
+	if _, err := d.ReadMessage(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+
+	frame := MessageTestData[0].container
+	tests := []struct {
+		datagram []byte
+		err      error
+	}{
+		{append(append([]byte{}, frame...), frame...), ErrSizeMismatch},
+		{frame[:len(frame)-1], ErrSizeMismatch},
+		{frame[:3], ErrPayloadTooShort},
+	}
+	for i, tt := range tests {
+		d := &Decoder{
+			Protocol:    NineP2000,
+			Reader:      &datagramReader{datagrams: [][]byte{tt.datagram}},
+			MessageSize: 8192,
+			Datagram:    true,
+		}
+		if _, err := d.ReadMessage(); err != tt.err {
+			t.Errorf("test %d: expected %v, got %v", i, tt.err, err)
+		}
+	}
+}
+
+func BenchmarkEncoderSmallMessages(b *testing.B) {
+	msgs := []Message{
+		&WalkRequest{Tag: 1, Fid: 1, NewFid: 2, Names: []string{"usr", "glenda"}},
+		&ClunkRequest{Tag: 1, Fid: 2},
+		&StatRequest{Tag: 1, Fid: 1},
+	}
+	e := &Encoder{Protocol: NineP2000, Writer: &writeCounter{}, MessageSize: 8192}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := e.WriteMessage(msgs[i%len(msgs)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
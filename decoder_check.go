@@ -0,0 +1,24 @@
+//go:build qpdebug
+// +build qpdebug
+
+package qp
+
+import "fmt"
+
+// checkState panics if the greedy decoding state is inconsistent. needed may
+// go far below zero when many messages are read at once, but must always
+// equal the size of the next header or body minus the buffered data. As a
+// violation is a bug in the decoder rather than in the stream, the check is
+// only built with the qpdebug tag, such as with "go test -tags qpdebug".
+func (d *Decoder) checkState() {
+	if d.ptr > d.total {
+		panic(fmt.Sprintf("qp: decoder ptr %d beyond total %d", d.ptr, d.total))
+	}
+	expected := d.headerSize()
+	if d.m != nil {
+		expected = int(d.size)
+	}
+	if buffered := int(d.total - d.ptr); d.needed != expected-buffered {
+		panic(fmt.Sprintf("qp: decoder needs %d bytes, expected %d with %d buffered", d.needed, expected-buffered, buffered))
+	}
+}
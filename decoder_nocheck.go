@@ -0,0 +1,8 @@
+//go:build !qpdebug
+// +build !qpdebug
+
+package qp
+
+// checkState verifies the greedy decoding state if built with the qpdebug
+// tag, and does nothing otherwise.
+func (d *Decoder) checkState() {}
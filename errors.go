@@ -0,0 +1,29 @@
+package qp
+
+import "fmt"
+
+// DecodeError describes a failure to decode a message body, with the type of
+// the message and, if it could be determined, the field that failed.
+type DecodeError struct {
+	// Type is the type of the message being decoded.
+	Type MessageType
+
+	// Field is the path of the field that failed to decode, such as
+	// "Names[3]", or empty if unknown.
+	Field string
+
+	// Err is the underlying error, such as ErrPayloadTooShort.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("decoding %v: %v", e.Type, e.Err)
+	}
+	return fmt.Sprintf("decoding %v %s: %v", e.Type, e.Field, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,143 @@
+package qp
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrFileClosed indicates that a FileWriter or FileReader was used after
+// being closed.
+var ErrFileClosed = errors.New("file closed")
+
+// fileWriter implements the io.WriteCloser returned by NewFileWriter.
+type fileWriter struct {
+	c      *Client
+	fid    Fid
+	offset uint64
+
+	// buf holds data that has not yet been written.
+	buf []byte
+
+	// err is the first error encountered, which is returned by all later
+	// calls.
+	err error
+}
+
+// NewFileWriter returns an io.WriteCloser writing to an open fid, starting at
+// offset. Written data is buffered until a full WriteRequest can be sent, as
+// permitted by the message size and the IOUnit of the fid. The offset is
+// advanced by the amount of data acknowledged by the server, and data that was
+// not acknowledged is written again at the following offset. Close writes any
+// buffered data, but does not clunk the fid. Write fails with ErrMessageTooBig
+// if the message size leaves no room for data. Once an error has occurred, it
+// is returned by all later calls. The io.WriteCloser is not thread safe.
+func NewFileWriter(c *Client, fid Fid, offset uint64) io.WriteCloser {
+	return &fileWriter{c: c, fid: fid, offset: offset}
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	max := w.c.maxWrite(w.fid)
+	if max <= 0 {
+		// The message size leaves no room for data.
+		w.err = ErrMessageTooBig
+		return 0, w.err
+	}
+
+	var n int
+	for len(p) > 0 {
+		chunk := p
+		if space := max - len(w.buf); len(chunk) > space {
+			chunk = chunk[:space]
+		}
+		w.buf = append(w.buf, chunk...)
+		n += len(chunk)
+		p = p[len(chunk):]
+
+		if len(w.buf) >= max {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush writes all buffered data.
+func (w *fileWriter) flush() error {
+	n, err := w.c.WriteAll(w.fid, w.offset, w.buf)
+	w.offset += uint64(n)
+	w.buf = append(w.buf[:0], w.buf[n:]...)
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
+
+// Close writes any buffered data.
+func (w *fileWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	err := w.flush()
+	if err == nil {
+		w.err = ErrFileClosed
+	}
+	return err
+}
+
+// fileReader implements the io.ReadCloser returned by NewFileReader.
+type fileReader struct {
+	c      *Client
+	fid    Fid
+	offset uint64
+
+	// err is the error returned by all later calls, such as io.EOF.
+	err error
+}
+
+// NewFileReader returns an io.ReadCloser reading from an open fid, starting at
+// offset. Every Read sends a single ReadRequest for as much data as fits in the
+// provided buffer, the message size and the IOUnit of the fid, and the offset
+// is advanced by the amount of data returned. The server may return less data
+// than requested without reaching the end of the file, and only a read
+// returning no data is reported as io.EOF. Close does not clunk the fid. The
+// io.ReadCloser is not thread safe.
+func NewFileReader(c *Client, fid Fid, offset uint64) io.ReadCloser {
+	return &fileReader{c: c, fid: fid, offset: offset}
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if max := r.c.maxRead(r.fid); len(p) > max {
+		p = p[:max]
+	}
+	data, err := r.c.read(r.fid, r.offset, uint32(len(p)))
+	if err != nil {
+		r.err = err
+		return 0, err
+	}
+	if len(data) == 0 {
+		r.err = io.EOF
+		return 0, io.EOF
+	}
+
+	n := copy(p, data)
+	r.offset += uint64(n)
+	return n, nil
+}
+
+// Close marks the reader as closed.
+func (r *fileReader) Close() error {
+	r.err = ErrFileClosed
+	return nil
+}
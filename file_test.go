@@ -0,0 +1,142 @@
+package qp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestFileWriter(t *testing.T) {
+	var (
+		lock          sync.Mutex
+		file          = make([]byte, 5)
+		reads, writes []uint64
+	)
+
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go stubServer(c2, fileServer(&lock, &file, 30, &reads, &writes))
+	c := NewClient(NewSession(c1, NineP2000, 64))
+
+	w := NewFileWriter(c, 1, 5)
+	n, err := io.Copy(w, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("expected %d bytes copied, got %d", len(data), n)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if _, err = w.Write([]byte{0}); err != ErrFileClosed {
+		t.Errorf("expected ErrFileClosed, got %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if bytes.Compare(file[5:], data) != 0 {
+		t.Errorf("file content did not match written data")
+	}
+	// The server only accepts 30 bytes at a time, so buffered data is sent
+	// in several writes, each continuing where the acknowledged data ended.
+	if len(writes) == 0 || writes[0] != 5 {
+		t.Fatalf("expected first write at offset 5, got %v", writes)
+	}
+	for i := 1; i < len(writes); i++ {
+		if writes[i] <= writes[i-1] || writes[i]-writes[i-1] > 30 {
+			t.Errorf("write %d: unexpected offset %d after %d", i, writes[i], writes[i-1])
+		}
+	}
+}
+
+func TestFileWriterSmallMessageSize(t *testing.T) {
+	var (
+		lock          sync.Mutex
+		file          []byte
+		reads, writes []uint64
+	)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go stubServer(c2, fileServer(&lock, &file, 30, &reads, &writes))
+
+	// A message size of 16 leaves no room for data in a WriteRequest.
+	c := NewClient(NewSession(c1, NineP2000, 16))
+	w := NewFileWriter(c, 1, 0)
+	if _, err := w.Write([]byte("data")); err != ErrMessageTooBig {
+		t.Errorf("expected ErrMessageTooBig, got %v", err)
+	}
+	if err := w.Close(); err != ErrMessageTooBig {
+		t.Errorf("expected ErrMessageTooBig on close, got %v", err)
+	}
+}
+
+func TestFileReader(t *testing.T) {
+	var (
+		lock          sync.Mutex
+		file          = make([]byte, 500)
+		reads, writes []uint64
+	)
+	for i := range file {
+		file[i] = byte(i)
+	}
+
+	// The second read returns less than requested, without being at the end
+	// of the file.
+	max := uint64(64 - ReadOverhead)
+	h := fileServer(&lock, &file, 0, &reads, &writes)
+	short := func(m Message) Message {
+		resp := h(m)
+		if req, ok := m.(*ReadRequest); ok && req.Offset == 5+max {
+			r := resp.(*ReadResponse)
+			r.Data = r.Data[:10]
+		}
+		return resp
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go stubServer(c2, short)
+	c := NewClient(NewSession(c1, NineP2000, 64))
+
+	r := NewFileReader(c, 1, 5)
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if bytes.Compare(buf.Bytes(), file[5:]) != 0 {
+		t.Errorf("read data did not match file content")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != ErrFileClosed {
+		t.Errorf("expected ErrFileClosed, got %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	// Reads continue where the returned data ended, including after the
+	// short read.
+	expected := []uint64{5, 5 + max, 5 + max + 10}
+	for off := expected[2] + max; off < uint64(len(file)); off += max {
+		expected = append(expected, off)
+	}
+	expected = append(expected, uint64(len(file)))
+	if len(reads) != len(expected) {
+		t.Fatalf("expected reads at %v, got %v", expected, reads)
+	}
+	for i := range expected {
+		if reads[i] != expected[i] {
+			t.Errorf("read %d: expected offset %d, got %d", i, expected[i], reads[i])
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package qp
+
+import (
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+// FS exposes the file tree of a 9P server as a read-only fs.FS, such as for
+// use with fs.WalkDir. Paths are walked from a root fid, usually obtained with
+// Client.Attach, which is not clunked by FS. Every open file holds a fid
+// allocated from the Fids of the Client until it is closed, while Stat and
+// ReadDir release their fids before returning. FS implements fs.StatFS and
+// fs.ReadDirFS. FS is thread safe.
+type FS struct {
+	c    *Client
+	root Fid
+}
+
+// NewFS returns an FS for the tree rooted at fid.
+func NewFS(c *Client, root Fid) *FS {
+	return &FS{c: c, root: root}
+}
+
+// Open walks to and opens the named file for reading.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	fid, _, _, err := fsys.c.OpenFile(fsys.root, fsPath(name), OREAD)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	st, err := fsys.c.Stat(fid)
+	if err != nil {
+		fsys.c.Clunk(fid)
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &fsFile{
+		c:    fsys.c,
+		name: name,
+		fid:  fid,
+		stat: st,
+		r:    NewFileReader(fsys.c, fid, 0),
+	}, nil
+}
+
+// Stat returns information about the named file, without opening it.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	fid, _, err := fsys.c.WalkPath(fsys.root, fsPath(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	defer fsys.c.Clunk(fid)
+
+	st, err := fsys.c.Stat(fid)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return &statInfo{st}, nil
+}
+
+// ReadDir reads the named directory, returning its entries sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := f.(*fsFile).ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// fsPath converts an fs.FS path to a path for Client.OpenFile.
+func fsPath(name string) string {
+	if name == "." {
+		return ""
+	}
+	return name
+}
+
+// fsFile is an open file of an FS. It implements fs.ReadDirFile.
+type fsFile struct {
+	c    *Client
+	name string
+	fid  Fid
+	stat Stat
+	r    io.Reader
+
+	// entries holds the directory entries not yet returned by ReadDir, and
+	// is nil until the directory has been read.
+	entries []fs.DirEntry
+
+	closed bool
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	return &statInfo{f.stat}, nil
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.stat.Mode&DMDIR != 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	return f.r.Read(p)
+}
+
+// ReadDir reads the entries of a directory, following the semantics of
+// fs.ReadDirFile. The whole directory is read by the first call.
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.stat.Mode&DMDIR == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	if f.entries == nil {
+		stats, err := f.c.ReadDir(f.fid)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: err}
+		}
+		f.entries = make([]fs.DirEntry, len(stats))
+		for i := range stats {
+			f.entries[i] = &statInfo{stats[i]}
+		}
+	}
+
+	if n <= 0 || n > len(f.entries) {
+		if n > 0 && len(f.entries) == 0 {
+			return nil, io.EOF
+		}
+		n = len(f.entries)
+	}
+	entries := f.entries[:n:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+// Close clunks and releases the fid of the file.
+func (f *fsFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return f.c.Clunk(f.fid)
+}
+
+// statInfo exposes a Stat as an fs.FileInfo and an fs.DirEntry.
+type statInfo struct {
+	s Stat
+}
+
+func (si *statInfo) Name() string       { return si.s.Name }
+func (si *statInfo) Size() int64        { return int64(si.s.Length) }
+func (si *statInfo) ModTime() time.Time { return time.Unix(int64(si.s.Mtime), 0) }
+func (si *statInfo) IsDir() bool        { return si.s.Mode&DMDIR != 0 }
+
+// Sys returns the Stat.
+func (si *statInfo) Sys() interface{} { return si.s }
+
+func (si *statInfo) Type() fs.FileMode          { return si.Mode().Type() }
+func (si *statInfo) Info() (fs.FileInfo, error) { return si, nil }
+
+// Mode converts the permissions and mode bits of the Stat.
+func (si *statInfo) Mode() fs.FileMode {
+	m := fs.FileMode(si.s.Mode & 0777)
+	for _, b := range []struct {
+		from FileMode
+		to   fs.FileMode
+	}{
+		{DMDIR, fs.ModeDir},
+		{DMAPPEND, fs.ModeAppend},
+		{DMEXCL, fs.ModeExclusive},
+		{DMTMP, fs.ModeTemporary},
+	} {
+		if si.s.Mode&b.from != 0 {
+			m |= b.to
+		}
+	}
+	return m
+}
@@ -0,0 +1,179 @@
+package qp
+
+import (
+	"io/fs"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+// treeServer serves a static file tree, tracking the fids in use.
+type treeServer struct {
+	lock  sync.Mutex
+	files map[string]string
+	dirs  map[string][]string
+	fids  map[Fid]string
+}
+
+func newTreeServer() *treeServer {
+	return &treeServer{
+		files: map[string]string{
+			"a.txt":         "hello",
+			"dir/b.txt":     "world",
+			"dir/sub/c.txt": strings.Repeat("c", 20000),
+		},
+		dirs: map[string][]string{
+			"":        {"dir", "a.txt"},
+			"dir":     {"sub", "b.txt"},
+			"dir/sub": {"c.txt"},
+		},
+		fids: map[Fid]string{},
+	}
+}
+
+func (ts *treeServer) stat(path string) Stat {
+	st := Stat{Name: path[strings.LastIndex(path, "/")+1:], Mode: 0644, Mtime: 1000}
+	if path == "" {
+		st.Name = "/"
+	}
+	if _, ok := ts.dirs[path]; ok {
+		st.Qid.Type = QTDIR
+		st.Mode = DMDIR | 0755
+	} else {
+		st.Length = uint64(len(ts.files[path]))
+	}
+	return st
+}
+
+func (ts *treeServer) content(path string) []byte {
+	if _, ok := ts.dirs[path]; !ok {
+		return []byte(ts.files[path])
+	}
+	var b []byte
+	for _, name := range ts.dirs[path] {
+		st := ts.stat(strings.TrimPrefix(path+"/"+name, "/"))
+		e := make([]byte, st.EncodedSize())
+		st.Marshal(e)
+		b = append(b, e...)
+	}
+	return b
+}
+
+func (ts *treeServer) handle(m Message) Message {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	switch m := m.(type) {
+	case *AttachRequest:
+		ts.fids[m.Fid] = ""
+		return &AttachResponse{Qid: NewQid(QTDIR, 0, 0)}
+	case *WalkRequest:
+		path, ok := ts.fids[m.Fid]
+		if !ok {
+			return &ErrorResponse{Error: "unknown fid"}
+		}
+		var qids []Qid
+		for _, name := range m.Names {
+			next := strings.TrimPrefix(path+"/"+name, "/")
+			_, file := ts.files[next]
+			_, dir := ts.dirs[next]
+			if !file && !dir {
+				break
+			}
+			path = next
+			qids = append(qids, NewQid(ts.stat(path).Qid.Type, 0, 0))
+		}
+		if len(qids) == 0 && len(m.Names) > 0 {
+			return &ErrorResponse{Error: "file does not exist"}
+		}
+		if len(qids) == len(m.Names) {
+			ts.fids[m.NewFid] = path
+		}
+		return &WalkResponse{Qids: qids}
+	case *OpenRequest:
+		return &OpenResponse{}
+	case *StatRequest:
+		return &StatResponse{Stat: ts.stat(ts.fids[m.Fid])}
+	case *ReadRequest:
+		b := ts.content(ts.fids[m.Fid])
+		if m.Offset >= uint64(len(b)) {
+			return &ReadResponse{}
+		}
+		b = b[m.Offset:]
+		if len(b) > int(m.Count) {
+			b = b[:m.Count]
+		}
+		return &ReadResponse{Data: b}
+	case *ClunkRequest:
+		delete(ts.fids, m.Fid)
+		return &ClunkResponse{}
+	}
+	return &ErrorResponse{Error: "unexpected request"}
+}
+
+func TestFS(t *testing.T) {
+	ts := newTreeServer()
+	c, conn := newTestClient(ts.handle)
+	defer conn.Close()
+
+	root, _, err := c.Attach(NOFID, "glenda", "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	fsys := NewFS(c, root)
+
+	var walked []string
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	expected := []string{".", "a.txt", "dir", "dir/b.txt", "dir/sub", "dir/sub/c.txt"}
+	if !reflect.DeepEqual(walked, expected) {
+		t.Errorf("expected walk %v, got %v", expected, walked)
+	}
+
+	for path, content := range ts.files {
+		b, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			t.Errorf("%s: read failed: %v", path, err)
+			continue
+		}
+		if string(b) != content {
+			t.Errorf("%s: content did not match", path)
+		}
+	}
+
+	fi, err := fs.Stat(fsys, "dir/sub")
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if !fi.IsDir() || fi.Mode() != fs.ModeDir|0755 || fi.Name() != "sub" {
+		t.Errorf("unexpected stat: %v %v %v", fi.Name(), fi.IsDir(), fi.Mode())
+	}
+
+	if err = fstest.TestFS(fsys, "a.txt", "dir/b.txt", "dir/sub/c.txt"); err != nil {
+		t.Errorf("fstest failed: %v", err)
+	}
+
+	if _, err = fsys.Open("nope"); err == nil {
+		t.Errorf("expected error opening missing file")
+	}
+	if _, err = fsys.Open("/a.txt"); err == nil {
+		t.Errorf("expected error opening invalid path")
+	}
+
+	// Only the root fid is left.
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if len(ts.fids) != 1 {
+		t.Errorf("expected only the root fid to remain, got %v", ts.fids)
+	}
+}
@@ -0,0 +1,45 @@
+package qp
+
+import "net"
+
+// Dial connects to addr on the named network, such as "tcp" or "unix", and
+// returns a Session for the connection using NineP2000 and the provided
+// maximum message size. Version negotiation is left to the caller, such as
+// through Session.ClientVersion. The connection is closed by Session.Close.
+func Dial(network, addr string, msize uint32) (*Session, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSession(conn, NineP2000, msize), nil
+}
+
+// Listener is a net.Listener that accepts connections as Sessions.
+type Listener struct {
+	net.Listener
+
+	// MessageSize is the maximum message size of accepted Sessions.
+	MessageSize uint32
+}
+
+// Listen listens on addr on the named network, such as "tcp" or "unix",
+// returning a Listener that accepts Sessions with the provided maximum
+// message size.
+func Listen(network, addr string, msize uint32) (*Listener, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{Listener: l, MessageSize: msize}, nil
+}
+
+// AcceptSession waits for the next connection, and returns a Session for it
+// using NineP2000 and the MessageSize of the Listener. Version negotiation
+// is left to the caller, such as through Session.ServerVersion.
+func (l *Listener) AcceptSession() (*Session, error) {
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewSession(conn, NineP2000, l.MessageSize), nil
+}
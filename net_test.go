@@ -0,0 +1,55 @@
+package qp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDialListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "9p.sock")
+
+	l, err := Listen("unix", addr, 8192)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		s, err := l.AcceptSession()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer s.Close()
+		_, err = s.ServerVersion(Version)
+		errc <- err
+	}()
+
+	s, err := Dial("unix", addr, 4096)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer s.Close()
+
+	version, err := s.ClientVersion(4096, Version)
+	if err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	if version != Version {
+		t.Errorf("expected version %s, got %s", Version, version)
+	}
+	if s.Encoder.MessageSize != 4096 || s.Decoder.MessageSize != 4096 {
+		t.Errorf("expected message size 4096, got %d/%d", s.Encoder.MessageSize, s.Decoder.MessageSize)
+	}
+	if err = <-errc; err != nil {
+		t.Errorf("server version failed: %v", err)
+	}
+}
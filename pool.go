@@ -0,0 +1,62 @@
+package qp
+
+import "sync"
+
+// BufferPool is a pool of byte buffers of a fixed capacity, such as the
+// message size. Unlike sync.Pool, it retains at most a configured number of
+// buffers, so memory is released once demand drops, such as after a spike in
+// connections. BufferPool is thread safe.
+type BufferPool struct {
+	size int
+	max  int
+
+	// lock protects free.
+	lock sync.Mutex
+	free [][]byte
+}
+
+// NewBufferPool returns a BufferPool of buffers with capacity size, retaining
+// at most max unused buffers.
+func NewBufferPool(size, max int) *BufferPool {
+	return &BufferPool{size: size, max: max}
+}
+
+// Get returns a buffer of length n. If n exceeds the buffer size of the pool,
+// a buffer is allocated that will not be retained when put back.
+func (bp *BufferPool) Get(n int) []byte {
+	if n > bp.size {
+		return make([]byte, n)
+	}
+
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	if l := len(bp.free); l > 0 {
+		b := bp.free[l-1]
+		bp.free[l-1] = nil
+		bp.free = bp.free[:l-1]
+		return b[:n]
+	}
+	return make([]byte, n, bp.size)
+}
+
+// Put returns a buffer to the pool. The buffer is discarded if it was not
+// allocated by the pool, or if the pool already retains its maximum amount of
+// buffers. The buffer must not be used after Put.
+func (bp *BufferPool) Put(b []byte) {
+	if cap(b) != bp.size {
+		return
+	}
+
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	if len(bp.free) < bp.max {
+		bp.free = append(bp.free, b[:0])
+	}
+}
+
+// Retained returns the number of unused buffers currently retained.
+func (bp *BufferPool) Retained() int {
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	return len(bp.free)
+}
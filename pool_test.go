@@ -0,0 +1,68 @@
+package qp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	bp := NewBufferPool(64, 2)
+
+	bufs := [][]byte{bp.Get(10), bp.Get(64), bp.Get(1)}
+	for i, b := range bufs {
+		if cap(b) != 64 {
+			t.Errorf("buffer %d: expected capacity 64, got %d", i, cap(b))
+		}
+	}
+	if n := len(bufs[0]); n != 10 {
+		t.Errorf("expected length 10, got %d", n)
+	}
+
+	for _, b := range bufs {
+		bp.Put(b)
+	}
+	if n := bp.Retained(); n != 2 {
+		t.Errorf("expected 2 retained buffers after exceeding the cap, got %d", n)
+	}
+
+	// Oversized and foreign buffers are not retained.
+	big := bp.Get(100)
+	if len(big) != 100 {
+		t.Errorf("expected length 100, got %d", len(big))
+	}
+	bp.Get(1)
+	bp.Put(big)
+	bp.Put(make([]byte, 32))
+	if n := bp.Retained(); n != 1 {
+		t.Errorf("expected 1 retained buffer, got %d", n)
+	}
+}
+
+func TestDecoderPool(t *testing.T) {
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf}
+	in := &ReadResponse{Tag: 1, Data: []byte("hello")}
+	for i := 0; i < 2; i++ {
+		if err := e.WriteMessage(in); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	bp := NewBufferPool(1024, 4)
+	d := &Decoder{Protocol: NineP2000, Reader: &buf, MessageSize: 1024, Pool: bp}
+	first, err := d.ReadMessage()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if _, err = d.ReadMessage(); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	// The body buffer is reused, which must not affect decoded messages.
+	if n := bp.Retained(); n != 1 {
+		t.Errorf("expected 1 retained buffer, got %d", n)
+	}
+	if !Equal(first, in) {
+		t.Errorf("first message changed by buffer reuse:\n%s", Diff(first, in))
+	}
+}
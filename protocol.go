@@ -0,0 +1,142 @@
+package qp
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// ProtocolBuilder builds a Protocol from a base protocol extended with custom
+// message types. Build returns an immutable snapshot of the registrations, so
+// that a Decoder can be reconfigured by building a new Protocol and passing
+// it to SetProtocol, rather than by changing the Protocol it is using. A
+// ProtocolBuilder is not thread safe, but the built protocols are.
+type ProtocolBuilder struct {
+	base     Protocol
+	messages map[MessageType]func() Message
+	types    map[reflect.Type]MessageType
+}
+
+// NewProtocolBuilder returns a ProtocolBuilder extending base, which may be
+// nil to build a protocol consisting only of the registered message types.
+// The base protocol must itself be safe for concurrent use, which all
+// protocols in this package are.
+func NewProtocolBuilder(base Protocol) *ProtocolBuilder {
+	return &ProtocolBuilder{
+		base:     base,
+		messages: make(map[MessageType]func() Message),
+		types:    make(map[reflect.Type]MessageType),
+	}
+}
+
+// Register adds a message type to the protocol, replacing any previous
+// registration of mt and taking precedence over the base protocol. fn must
+// return a new, empty message of the same concrete type on every call, and
+// is called concurrently by the built protocols. As the concrete type of a
+// message decides its message type when encoding, Register panics if fn is
+// nil or returns nil, or if its type is already registered for another
+// message type.
+func (b *ProtocolBuilder) Register(mt MessageType, fn func() Message) {
+	if fn == nil {
+		panic("qp: nil message constructor")
+	}
+	t := reflect.TypeOf(fn())
+	if t == nil {
+		panic("qp: message constructor returned nil")
+	}
+	if other, ok := b.types[t]; ok && other != mt {
+		panic(fmt.Sprintf("qp: %v already registered as message type %v", t, other))
+	}
+	if old, ok := b.messages[mt]; ok {
+		delete(b.types, reflect.TypeOf(old()))
+	}
+	b.messages[mt] = fn
+	b.types[t] = mt
+}
+
+// Build returns a Protocol with the current registrations. Later calls to
+// Register do not affect the returned Protocol. The Protocol implements
+// TypeLister if the base protocol does, or if there is no base protocol.
+func (b *ProtocolBuilder) Build() Protocol {
+	p := &builtProtocol{
+		base:     b.base,
+		messages: make(map[MessageType]func() Message, len(b.messages)),
+		types:    make(map[reflect.Type]MessageType, len(b.types)),
+	}
+	for mt, fn := range b.messages {
+		p.messages[mt] = fn
+	}
+	for t, mt := range b.types {
+		p.types[t] = mt
+	}
+	if _, ok := b.base.(TypeLister); b.base != nil && !ok {
+		return unlistedProtocol{p}
+	}
+	return p
+}
+
+// builtProtocol is a Protocol built by a ProtocolBuilder. It is never modified
+// after construction.
+type builtProtocol struct {
+	base     Protocol
+	messages map[MessageType]func() Message
+	types    map[reflect.Type]MessageType
+}
+
+// Message returns an empty Message based on the provided message type.
+func (p *builtProtocol) Message(mt MessageType) (Message, error) {
+	if fn, ok := p.messages[mt]; ok {
+		return fn(), nil
+	}
+	if p.base == nil {
+		return nil, ErrUnknownMessageType
+	}
+	return p.base.Message(mt)
+}
+
+// MessageType returns the message type of a given message.
+func (p *builtProtocol) MessageType(m Message) (MessageType, error) {
+	if mt, ok := p.types[reflect.TypeOf(m)]; ok {
+		return mt, nil
+	}
+	if p.base == nil {
+		return 0, ErrUnknownMessageType
+	}
+	return p.base.MessageType(m)
+}
+
+// Types returns the message types of the base protocol, followed by the
+// registered message types that are not part of it in ascending order.
+func (p *builtProtocol) Types() []MessageType {
+	var types []MessageType
+	seen := make(map[MessageType]bool)
+	if tl, ok := p.base.(TypeLister); ok {
+		for _, mt := range tl.Types() {
+			types = append(types, mt)
+			seen[mt] = true
+		}
+	}
+
+	var added []MessageType
+	for mt := range p.messages {
+		if !seen[mt] {
+			added = append(added, mt)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+	return append(types, added...)
+}
+
+// unlistedProtocol hides the Types method of a builtProtocol whose base
+// protocol cannot list its types.
+type unlistedProtocol struct {
+	p *builtProtocol
+}
+
+func (u unlistedProtocol) Message(mt MessageType) (Message, error) {
+	return u.p.Message(mt)
+}
+
+func (u unlistedProtocol) MessageType(m Message) (MessageType, error) {
+	return u.p.MessageType(m)
+}
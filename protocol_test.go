@@ -0,0 +1,193 @@
+package qp
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// otherRawMessage is a custom message distinct from rawMessage.
+type otherRawMessage struct {
+	rawMessage
+}
+
+func TestProtocolBuilder(t *testing.T) {
+	b := NewProtocolBuilder(NineP2000)
+	b.Register(200, func() Message { return &rawMessage{} })
+	p := b.Build()
+
+	// Later registrations must not affect the built protocol.
+	b.Register(201, func() Message { return &otherRawMessage{} })
+	q := b.Build()
+
+	if m, err := p.Message(200); err != nil || !reflect.DeepEqual(m, &rawMessage{}) {
+		t.Errorf("expected rawMessage for 200, got %#v, %v", m, err)
+	}
+	if m, err := p.Message(Tclunk); err != nil || !reflect.DeepEqual(m, &ClunkRequest{}) {
+		t.Errorf("expected ClunkRequest for Tclunk, got %#v, %v", m, err)
+	}
+	if _, err := p.Message(201); err != ErrUnknownMessageType {
+		t.Errorf("expected ErrUnknownMessageType for 201, got %v", err)
+	}
+	if mt, err := p.MessageType(&rawMessage{}); err != nil || mt != 200 {
+		t.Errorf("expected 200 for rawMessage, got %v, %v", mt, err)
+	}
+	if mt, err := p.MessageType(&ClunkRequest{}); err != nil || mt != Tclunk {
+		t.Errorf("expected Tclunk for ClunkRequest, got %v, %v", mt, err)
+	}
+	if _, err := p.MessageType(&otherRawMessage{}); err != ErrUnknownMessageType {
+		t.Errorf("expected ErrUnknownMessageType for otherRawMessage, got %v", err)
+	}
+	if mt, err := q.MessageType(&otherRawMessage{}); err != nil || mt != 201 {
+		t.Errorf("expected 201 for otherRawMessage, got %v, %v", mt, err)
+	}
+
+	if types, expected := p.(TypeLister).Types(), append(NineP2000.Types(), 200); !reflect.DeepEqual(types, expected) {
+		t.Errorf("expected types %v, got %v", expected, types)
+	}
+	if types, expected := q.(TypeLister).Types(), append(NineP2000.Types(), 200, 201); !reflect.DeepEqual(types, expected) {
+		t.Errorf("expected types %v, got %v", expected, types)
+	}
+
+	// Registrations take precedence over the base protocol.
+	b = NewProtocolBuilder(NineP2000)
+	b.Register(Tclunk, func() Message { return &rawMessage{} })
+	p = b.Build()
+	if m, err := p.Message(Tclunk); err != nil || !reflect.DeepEqual(m, &rawMessage{}) {
+		t.Errorf("expected rawMessage for Tclunk, got %#v, %v", m, err)
+	}
+	if types, expected := p.(TypeLister).Types(), NineP2000.Types(); !reflect.DeepEqual(types, expected) {
+		t.Errorf("expected types %v, got %v", expected, types)
+	}
+
+	p = NewProtocolBuilder(nil).Build()
+	if _, err := p.Message(Tclunk); err != ErrUnknownMessageType {
+		t.Errorf("expected ErrUnknownMessageType without base, got %v", err)
+	}
+	if _, err := p.MessageType(&ClunkRequest{}); err != ErrUnknownMessageType {
+		t.Errorf("expected ErrUnknownMessageType without base, got %v", err)
+	}
+
+	if _, ok := NewProtocolBuilder(rawProtocol{}).Build().(TypeLister); ok {
+		t.Errorf("expected no TypeLister for base without Types")
+	}
+}
+
+func TestProtocolBuilderSwap(t *testing.T) {
+	// Two variants decoding the custom message type to different messages.
+	var variants [2]Protocol
+	b := NewProtocolBuilder(NineP2000)
+	b.Register(200, func() Message { return &rawMessage{} })
+	variants[0] = b.Build()
+	b.Register(200, func() Message { return &otherRawMessage{} })
+	variants[1] = b.Build()
+
+	const messages = 2000
+	stream := new(bytes.Buffer)
+	e := &Encoder{Protocol: variants[0], Writer: stream}
+	for i := 0; i < messages; i++ {
+		var m Message = &rawMessage{Data: []byte("custom")}
+		if i%2 == 0 {
+			m = &ClunkRequest{Tag: Tag(i), Fid: Fid(i)}
+		}
+		if err := e.WriteMessage(m); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	d := &Decoder{
+		Protocol:    variants[0],
+		Reader:      &chunkReader{Reader: stream, n: 97},
+		MessageSize: 8192,
+		Greedy:      true,
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			d.SetProtocol(variants[i%2])
+		}
+	}()
+
+	for i := 0; ; i++ {
+		m, err := d.ReadMessage()
+		if err == io.EOF {
+			if i != messages {
+				t.Errorf("expected %d messages, got %d", messages, i)
+			}
+			break
+		}
+		if err != nil {
+			t.Errorf("message %d: read failed: %v", i, err)
+			break
+		}
+
+		var data []byte
+		switch m := m.(type) {
+		case *ClunkRequest:
+			if m.Fid != Fid(i) {
+				t.Errorf("message %d: expected fid %d, got %d", i, i, m.Fid)
+			}
+			continue
+		case *rawMessage:
+			data = m.Data
+		case *otherRawMessage:
+			data = m.Data
+		default:
+			t.Errorf("message %d: unexpected message %T", i, m)
+			continue
+		}
+		if i%2 == 0 || string(data) != "custom" {
+			t.Errorf("message %d: unexpected custom message with %q", i, data)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestProtocolBuilderRegisterPanics(t *testing.T) {
+	raw := func() Message { return &rawMessage{} }
+	tests := []struct {
+		mt    MessageType
+		fn    func() Message
+		panic bool
+	}{
+		{200, raw, false},
+		{200, func() Message { return &otherRawMessage{} }, false},
+		{201, raw, false},
+		{202, raw, true},
+		{203, nil, true},
+		{204, func() Message { return nil }, true},
+	}
+
+	b := NewProtocolBuilder(NineP2000)
+	for i, tt := range tests {
+		func() {
+			defer func() {
+				if r := recover(); (r != nil) != tt.panic {
+					t.Errorf("test %d: expected panic %t, got %v", i, tt.panic, r)
+				}
+			}()
+			b.Register(tt.mt, tt.fn)
+		}()
+	}
+
+	// Replacing the registration of 200 released rawMessage for 201.
+	p := b.Build()
+	if mt, err := p.MessageType(&rawMessage{}); err != nil || mt != 201 {
+		t.Errorf("expected 201 for rawMessage, got %v, %v", mt, err)
+	}
+	if mt, err := p.MessageType(&otherRawMessage{}); err != nil || mt != 200 {
+		t.Errorf("expected 200 for otherRawMessage, got %v, %v", mt, err)
+	}
+}
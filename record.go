@@ -0,0 +1,217 @@
+package qp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrReplayMismatch indicates that a message written to a Player does not
+// match the next message sent in the recording.
+var ErrReplayMismatch = errors.New("message does not match recording")
+
+// Direction is the direction of a recorded message.
+type Direction byte
+
+// Record directions.
+const (
+	// RecordSent marks a message written to the recorded connection.
+	RecordSent Direction = '>'
+
+	// RecordReceived marks a message read from the recorded connection.
+	RecordReceived Direction = '<'
+)
+
+// Recorder wraps an io.ReadWriter, such as the connection of a Session,
+// logging every message passing through it. Each message is logged as a
+// direction marker followed by the raw framed message, with a 4 byte size
+// field. Partial reads and writes are buffered until the message is complete.
+// Written data is logged before it is passed on, so that a request always
+// precedes its response in the log, even if the write fails. Recorder is
+// thread safe, but Read and Write must each only be called by one goroutine
+// at a time.
+type Recorder struct {
+	rw io.ReadWriter
+
+	// lock protects log, sent and received.
+	lock sync.Mutex
+	log  io.Writer
+
+	// sent and received hold incomplete messages.
+	sent, received []byte
+}
+
+// NewRecorder returns a Recorder for rw, logging to log.
+func NewRecorder(rw io.ReadWriter, log io.Writer) *Recorder {
+	return &Recorder{rw: rw, log: log}
+}
+
+// Read reads from the wrapped io.ReadWriter, logging completed messages.
+func (r *Recorder) Read(p []byte) (int, error) {
+	n, err := r.rw.Read(p)
+	if n > 0 {
+		if lerr := r.record(RecordReceived, &r.received, p[:n]); err == nil {
+			err = lerr
+		}
+	}
+	return n, err
+}
+
+// Write logs completed messages, and writes to the wrapped io.ReadWriter.
+func (r *Recorder) Write(p []byte) (int, error) {
+	if err := r.record(RecordSent, &r.sent, p); err != nil {
+		return 0, err
+	}
+	return r.rw.Write(p)
+}
+
+// record appends b to the incomplete message in buf, logging all messages
+// that are completed.
+func (r *Recorder) record(dir Direction, buf *[]byte, b []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	*buf = append(*buf, b...)
+	for len(*buf) >= HeaderSize {
+		s := binary.LittleEndian.Uint32((*buf)[0:4])
+		if s < HeaderSize {
+			return ErrMessageTooSmall
+		}
+		if uint64(s) > uint64(len(*buf)) {
+			break
+		}
+
+		rec := make([]byte, 1+s)
+		rec[0] = byte(dir)
+		copy(rec[1:], (*buf)[:s])
+		if _, err := r.log.Write(rec); err != nil {
+			return err
+		}
+		*buf = append((*buf)[:0], (*buf)[s:]...)
+	}
+	return nil
+}
+
+// ReadRecord reads a single message logged by a Recorder, returning its
+// direction and the framed message. io.EOF is returned at the end of the log.
+func ReadRecord(r io.Reader) (Direction, []byte, error) {
+	hdr := make([]byte, 1+HeaderSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+
+	s := binary.LittleEndian.Uint32(hdr[1:5])
+	if s < HeaderSize {
+		return 0, nil, ErrMessageTooSmall
+	}
+
+	b := make([]byte, s)
+	copy(b, hdr[1:])
+	if _, err := io.ReadFull(r, b[HeaderSize:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return Direction(hdr[0]), b, nil
+}
+
+// playerRecord is a message of a recording.
+type playerRecord struct {
+	dir Direction
+	b   []byte
+}
+
+// Player replays a recording made by a Recorder, taking the place of the
+// peer of the recorded connection. Reads return the received messages of the
+// recording in order, each only once all messages sent before it in the
+// recording have been written. Writes must match the sent messages of the
+// recording, or ErrReplayMismatch is returned. Once the recording is
+// exhausted, Read returns io.EOF. Player is thread safe.
+type Player struct {
+	// lock protects all fields.
+	lock sync.Mutex
+	cond *sync.Cond
+
+	records []playerRecord
+
+	// pos is the index of the next record to be read or written.
+	pos int
+
+	// reading holds the remainder of the received message being read.
+	reading []byte
+
+	// writing holds an incomplete written message.
+	writing []byte
+}
+
+// NewPlayer reads a recording made by a Recorder from r, returning a Player
+// for it.
+func NewPlayer(r io.Reader) (*Player, error) {
+	p := &Player{}
+	p.cond = sync.NewCond(&p.lock)
+	for {
+		dir, b, err := ReadRecord(r)
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.records = append(p.records, playerRecord{dir: dir, b: b})
+	}
+}
+
+// Read reads the received messages of the recording, blocking until the
+// messages sent before them have been written.
+func (p *Player) Read(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for len(p.reading) == 0 {
+		if p.pos == len(p.records) {
+			return 0, io.EOF
+		}
+		if rec := p.records[p.pos]; rec.dir == RecordReceived {
+			p.reading = rec.b
+			p.pos++
+			p.cond.Broadcast()
+			break
+		}
+		p.cond.Wait()
+	}
+
+	n := copy(b, p.reading)
+	p.reading = p.reading[n:]
+	return n, nil
+}
+
+// Write verifies that the written messages match the sent messages of the
+// recording, blocking until the messages received before them have been
+// read.
+func (p *Player) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.writing = append(p.writing, b...)
+	for len(p.writing) >= HeaderSize {
+		s := binary.LittleEndian.Uint32(p.writing[0:4])
+		if uint64(s) > uint64(len(p.writing)) {
+			break
+		}
+
+		for p.pos < len(p.records) && p.records[p.pos].dir == RecordReceived {
+			p.cond.Wait()
+		}
+		if p.pos == len(p.records) || !bytes.Equal(p.records[p.pos].b, p.writing[:s]) {
+			return 0, ErrReplayMismatch
+		}
+
+		p.pos++
+		p.writing = append(p.writing[:0], p.writing[s:]...)
+		p.cond.Broadcast()
+	}
+	return len(b), nil
+}
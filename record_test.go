@@ -0,0 +1,94 @@
+package qp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// recordSession runs a short session on s, returning the responses.
+func recordSession(t *testing.T, s *Session) []Message {
+	if _, err := s.ClientVersion(8192, Version); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+
+	var resps []Message
+	c := NewClient(s)
+	for _, m := range []Message{
+		&WalkRequest{Fid: 1, NewFid: 2, Names: []string{"usr", "glenda"}},
+		&ClunkRequest{Fid: 2},
+	} {
+		resp, err := c.Send(m)
+		if err != nil {
+			t.Fatalf("send failed: %v", err)
+		}
+		resps = append(resps, resp)
+	}
+	return resps
+}
+
+func TestRecorderPlayer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	srv := NewServer(NewSession(c2, NineP2000, 8192))
+	srv.Handle(Tversion, func(m Message) (Message, error) {
+		return &VersionResponse{MessageSize: 8192, Version: Version}, nil
+	})
+	srv.Handle(Twalk, func(m Message) (Message, error) {
+		return &WalkResponse{Qids: []Qid{NewQid(QTDIR, 0, 1), NewQid(QTFILE, 0, 2)}}, nil
+	})
+	srv.Handle(Tclunk, func(m Message) (Message, error) {
+		return &ClunkResponse{}, nil
+	})
+	go srv.Serve()
+
+	var log bytes.Buffer
+	recorded := recordSession(t, NewSession(NewRecorder(c1, &log), NineP2000, 8192))
+
+	expected := []struct {
+		dir Direction
+		mt  MessageType
+	}{
+		{RecordSent, Tversion},
+		{RecordReceived, Rversion},
+		{RecordSent, Twalk},
+		{RecordReceived, Rwalk},
+		{RecordSent, Tclunk},
+		{RecordReceived, Rclunk},
+	}
+	r := bytes.NewReader(log.Bytes())
+	for i, tt := range expected {
+		dir, b, err := ReadRecord(r)
+		if err != nil {
+			t.Fatalf("record %d: read failed: %v", i, err)
+		}
+		if dir != tt.dir || MessageType(b[4]) != tt.mt {
+			t.Errorf("record %d: expected %c %v, got %c %v", i, tt.dir, tt.mt, dir, MessageType(b[4]))
+		}
+	}
+	if r.Len() != 0 {
+		t.Errorf("expected end of recording, %d bytes left", r.Len())
+	}
+
+	p, err := NewPlayer(bytes.NewReader(log.Bytes()))
+	if err != nil {
+		t.Fatalf("unable to load recording: %v", err)
+	}
+	replayed := recordSession(t, NewSession(p, NineP2000, 8192))
+	for i := range recorded {
+		if !Equal(replayed[i], recorded[i]) {
+			t.Errorf("response %d: replay differs:\n%s", i, Diff(replayed[i], recorded[i]))
+		}
+	}
+
+	// A request that differs from the recording is rejected.
+	p, err = NewPlayer(bytes.NewReader(log.Bytes()))
+	if err != nil {
+		t.Fatalf("unable to load recording: %v", err)
+	}
+	e := &Encoder{Protocol: NineP2000, Writer: p}
+	if err = e.WriteMessage(&VersionRequest{Tag: NOTAG, MessageSize: 4096, Version: Version}); err != ErrReplayMismatch {
+		t.Errorf("expected ErrReplayMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,558 @@
+package qp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+var (
+	// ErrNoHandler indicates that no handler is registered for the type of a
+	// received request.
+	ErrNoHandler = errors.New("no handler for message type")
+
+	// ErrDuplicateTag indicates that a request used the tag of another
+	// request that is still being handled.
+	ErrDuplicateTag = errors.New("duplicate tag")
+
+	// ErrVersionTag indicates that a VersionRequest did not use NOTAG.
+	ErrVersionTag = errors.New("version request must use NOTAG")
+
+	// ErrHandlerPanic indicates that a handler panicked. It is wrapped by the
+	// error returned by Serve if RecoverPanics is set.
+	ErrHandlerPanic = errors.New("handler panicked")
+)
+
+// Handler processes a request, returning the response. If an error is
+// returned, an error response is sent instead. If both the response and the
+// error are nil, no response is sent.
+type Handler func(Message) (Message, error)
+
+// ErrorToResponse converts an error to an error response with the provided
+// tag. If the error is or wraps a *ServerError, its message is used directly.
+// If dotu is set, an ErrorResponseDotu is returned, carrying the errno of the
+// error if it is or wraps a *ServerError, a syscall.Errno, or an error with an
+// Errno() uint32 method. Otherwise, an ErrorResponse is returned.
+func ErrorToResponse(tag Tag, err error, dotu bool) Message {
+	msg := err.Error()
+	var errno uint32
+
+	var se *ServerError
+	var sysErrno syscall.Errno
+	var errnoErr interface {
+		Errno() uint32
+	}
+	switch {
+	case errors.As(err, &se):
+		msg, errno = se.Message, se.Errno
+	case errors.As(err, &errnoErr):
+		errno = errnoErr.Errno()
+	case errors.As(err, &sysErrno):
+		errno = uint32(sysErrno)
+	}
+
+	if dotu {
+		return &ErrorResponseDotu{Tag: tag, Error: msg, Errno: errno}
+	}
+	return &ErrorResponse{Tag: tag, Error: msg}
+}
+
+// Server reads requests from a Session and dispatches them to handlers
+// registered per MessageType. The tag of the request is copied to the
+// response, and errors returned by handlers are converted by ErrorToResponse,
+// sending an ErrorResponseDotu if the protocol supports it. By default,
+// requests are handled one at a time, in the order in which they are
+// received, so a slow handler stalls decoding. Server is thread safe.
+type Server struct {
+	// Workers is the number of goroutines handling requests concurrently. If
+	// zero, requests are handled by the goroutine calling Serve. Otherwise,
+	// decoding only blocks when Workers requests are already waiting to be
+	// handled. Decoded messages do not share memory with the decoding
+	// buffer, so they are safe to hand to other goroutines. Workers must not
+	// be changed while Serve is running.
+	Workers int
+
+	// Ordered makes responses be written in the order in which the requests
+	// were received, even when handled concurrently by workers. Without it,
+	// responses are written as soon as their handler returns. Ordered must
+	// not be changed while Serve is running.
+	Ordered bool
+
+	// Prioritized makes error and flush responses be written ahead of other
+	// responses waiting to be written, such as large ReadResponses, when
+	// requests are handled by workers and the connection is slow to accept
+	// responses. Responses are written by a single goroutine, following these
+	// rules:
+	//
+	//  - ErrorResponse, ErrorResponseDotu and FlushResponse are written
+	//    before any other waiting response, in the order they were returned.
+	//  - Other responses are written in the order they were returned.
+	//  - A FlushResponse for a FlushRequest is held back until the response
+	//    to the request with OldTag has been written, or its handler returned
+	//    no response, as flush(5) requires the response to the flushed
+	//    request to precede the response to the flush.
+	//
+	// Prioritized has no effect without workers, or if Ordered is set.
+	// Prioritized must not be changed while Serve is running.
+	Prioritized bool
+
+	// RejectDuplicateTags makes the Server track the tags of outstanding
+	// requests, and respond to any request reusing such a tag with
+	// ErrDuplicateTag without handling it. NOTAG, and requests without a tag,
+	// are exempt.
+	// RejectDuplicateTags must not be changed while Serve is running.
+	RejectDuplicateTags bool
+
+	// StrictVersionTag makes the Server respond to any VersionRequest that
+	// does not use NOTAG with ErrVersionTag, without handling it.
+	StrictVersionTag bool
+
+	// RecoverPanics makes the Server recover from panics in handlers. No
+	// response is sent for the request, and Serve stops as if reading had
+	// failed, returning an error wrapping ErrHandlerPanic and the panic value.
+	// When using workers, Serve stops once the next request has been read, as
+	// it does for write errors. Without RecoverPanics, a panic in a handler
+	// crashes the program.
+	RecoverPanics bool
+
+	session *Session
+
+	// tagsLock protects tags.
+	tagsLock sync.Mutex
+
+	// tags holds the tags of outstanding requests if RejectDuplicateTags is
+	// set.
+	tags map[Tag]bool
+
+	// handlersLock protects handlers.
+	handlersLock sync.RWMutex
+	handlers     map[MessageType]Handler
+}
+
+// NewServer returns a Server operating on the provided Session.
+func NewServer(s *Session) *Server {
+	return &Server{
+		session:  s,
+		handlers: make(map[MessageType]Handler),
+	}
+}
+
+// Handle registers a handler for requests of the provided MessageType,
+// replacing any previously registered handler. A nil handler unregisters the
+// message type.
+func (s *Server) Handle(mt MessageType, h Handler) {
+	s.handlersLock.Lock()
+	defer s.handlersLock.Unlock()
+	if h == nil {
+		delete(s.handlers, mt)
+		return
+	}
+	s.handlers[mt] = h
+}
+
+// handler returns the handler for the provided MessageType.
+func (s *Server) handler(mt MessageType) Handler {
+	s.handlersLock.RLock()
+	defer s.handlersLock.RUnlock()
+	return s.handlers[mt]
+}
+
+// serverJob is a request waiting to be handled by a worker. If result is set,
+// the response is delivered there instead of being written by the worker.
+type serverJob struct {
+	m Message
+
+	// duplicate is set if the tag of the request was already in use.
+	duplicate bool
+
+	result chan Message
+}
+
+// Serve reads and dispatches requests until reading or writing fails, which
+// usually happens when the connection is closed. The error is returned. If
+// the connection ends at a message boundary, such as when the client
+// disconnects, the error is io.EOF, while a connection ending in the middle
+// of a request results in io.ErrUnexpectedEOF. When using workers, Serve
+// waits for outstanding requests to be handled before returning.
+func (s *Server) Serve() error {
+	if s.Workers <= 0 {
+		for {
+			m, err := s.session.Decoder.ReadMessage()
+			if err != nil {
+				return err
+			}
+
+			j := s.newJob(m)
+			resp, perr := s.handleJob(j)
+			if err = s.finish(j, resp); err != nil {
+				return err
+			}
+			if perr != nil {
+				return perr
+			}
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errLock  sync.Mutex
+		writeErr error
+	)
+
+	setError := func(err error) {
+		errLock.Lock()
+		if writeErr == nil {
+			writeErr = err
+		}
+		errLock.Unlock()
+	}
+
+	finish := func(j serverJob, resp Message) {
+		if err := s.finish(j, resp); err != nil {
+			setError(err)
+		}
+	}
+
+	writeError := func() error {
+		errLock.Lock()
+		defer errLock.Unlock()
+		return writeErr
+	}
+
+	var (
+		results    chan serverJob
+		queue      *replyQueue
+		writerDone chan struct{}
+	)
+	switch {
+	case s.Ordered:
+		results = make(chan serverJob, s.Workers)
+		writerDone = make(chan struct{})
+		go func() {
+			defer close(writerDone)
+			for j := range results {
+				finish(j, <-j.result)
+			}
+		}()
+	case s.Prioritized:
+		queue = newReplyQueue()
+		writerDone = make(chan struct{})
+		go func() {
+			defer close(writerDone)
+			for {
+				t, resp, ok := queue.next()
+				if !ok {
+					return
+				}
+				if err := s.write(resp); err != nil {
+					setError(err)
+				}
+				queue.written(t)
+			}
+		}()
+	}
+
+	jobs := make(chan serverJob, s.Workers)
+	for i := 0; i < s.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				resp, perr := s.handleJob(j)
+				if perr != nil {
+					setError(perr)
+				}
+				switch {
+				case j.result != nil:
+					j.result <- resp
+				case queue != nil:
+					s.releaseTag(j)
+					queue.push(j.m, resp)
+				default:
+					finish(j, resp)
+				}
+			}
+		}()
+	}
+
+	var err error
+	for err == nil {
+		var m Message
+		if m, err = s.session.Decoder.ReadMessage(); err != nil {
+			break
+		}
+
+		j := s.newJob(m)
+		switch {
+		case results != nil:
+			j.result = make(chan Message, 1)
+			results <- j
+		case queue != nil:
+			queue.add(MessageTag(m))
+		}
+		jobs <- j
+		err = writeError()
+	}
+
+	close(jobs)
+	wg.Wait()
+	switch {
+	case results != nil:
+		close(results)
+		<-writerDone
+	case queue != nil:
+		queue.close()
+		<-writerDone
+	}
+
+	if werr := writeError(); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// newJob prepares a job for a request, marking it as a duplicate if
+// RejectDuplicateTags is set and the tag is already in use.
+func (s *Server) newJob(m Message) serverJob {
+	j := serverJob{m: m}
+	t := MessageTag(m)
+	if !s.RejectDuplicateTags || t == NOTAG {
+		return j
+	}
+
+	s.tagsLock.Lock()
+	defer s.tagsLock.Unlock()
+	if s.tags == nil {
+		s.tags = make(map[Tag]bool)
+	}
+	if s.tags[t] {
+		j.duplicate = true
+	} else {
+		s.tags[t] = true
+	}
+	return j
+}
+
+// handleJob handles a job, returning the response, and the error from a
+// recovered handler panic, if any.
+func (s *Server) handleJob(j serverJob) (Message, error) {
+	if j.duplicate {
+		return ErrorToResponse(MessageTag(j.m), ErrDuplicateTag, s.dotu()), nil
+	}
+	return s.handle(j.m)
+}
+
+// finish releases the tag of a job and writes the response. The tag is
+// released first, as the client may reuse it as soon as the response
+// arrives.
+func (s *Server) finish(j serverJob, resp Message) error {
+	s.releaseTag(j)
+	return s.write(resp)
+}
+
+// releaseTag releases the tag of a job if RejectDuplicateTags is set.
+func (s *Server) releaseTag(j serverJob) {
+	if s.RejectDuplicateTags && !j.duplicate {
+		s.tagsLock.Lock()
+		delete(s.tags, MessageTag(j.m))
+		s.tagsLock.Unlock()
+	}
+}
+
+// dotu reports whether the protocol supports ErrorResponseDotu.
+func (s *Server) dotu() bool {
+	_, err := s.session.Encoder.protocol().MessageType(&ErrorResponseDotu{})
+	return err == nil
+}
+
+// handle calls the handler for a request, returning the response with the tag
+// of the request, or nil if no response is to be sent. Requests that do not
+// implement Tagged may be answered with responses that do not either. If the
+// handler panicked and RecoverPanics is set, the panic is returned as an error
+// without a response.
+func (s *Server) handle(m Message) (Message, error) {
+	var resp Message
+	mt, err := s.session.Decoder.protocol().MessageType(BaseMessage(m))
+	if err == nil && s.StrictVersionTag && mt == Tversion && MessageTag(m) != NOTAG {
+		err = ErrVersionTag
+	}
+	if err == nil {
+		if h := s.handler(mt); h != nil {
+			var perr error
+			if resp, err, perr = s.call(h, m); perr != nil {
+				return nil, perr
+			}
+		} else {
+			err = ErrNoHandler
+		}
+	}
+
+	if err == nil && resp != nil {
+		_, tagged := m.(Tagged)
+		if tm, ok := resp.(Tagged); ok {
+			tm.SetTag(MessageTag(m))
+		} else if tagged {
+			err = ErrUntaggedMessage
+		}
+	}
+
+	if err != nil {
+		resp = ErrorToResponse(MessageTag(m), err, s.dotu())
+	}
+	return resp, nil
+}
+
+// call calls a handler. If RecoverPanics is set, a panic is recovered and
+// returned as perr.
+func (s *Server) call(h Handler, m Message) (resp Message, err, perr error) {
+	if s.RecoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				resp, err, perr = nil, nil, fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+			}
+		}()
+	}
+	resp, err = h(m)
+	return resp, err, nil
+}
+
+// write writes a response, if any.
+func (s *Server) write(resp Message) error {
+	if resp == nil {
+		return nil
+	}
+
+	err := s.session.Encoder.WriteMessage(resp)
+	if err == nil {
+		err = s.session.Encoder.Flush()
+	}
+	return err
+}
+
+// queuedReply is a response waiting in a replyQueue.
+type queuedReply struct {
+	// tag is the tag of the request.
+	tag  Tag
+	resp Message
+}
+
+// replyQueue orders the responses of a Server with Prioritized set, as
+// described there. replyQueue is thread safe.
+type replyQueue struct {
+	// lock protects all fields.
+	lock sync.Mutex
+	cond *sync.Cond
+
+	// urgent holds waiting error and flush responses, and normal all other
+	// waiting responses.
+	urgent, normal []queuedReply
+
+	// outstanding counts the requests per tag that have been read, but
+	// whose response has not yet been written.
+	outstanding map[Tag]int
+
+	// held maps tags to the FlushResponses waiting for the response to the
+	// request with that tag to be written.
+	held map[Tag][]queuedReply
+
+	closed bool
+}
+
+func newReplyQueue() *replyQueue {
+	q := &replyQueue{
+		outstanding: make(map[Tag]int),
+		held:        make(map[Tag][]queuedReply),
+	}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// add marks a request with the provided tag as outstanding. It must be called
+// before the request is handled.
+func (q *replyQueue) add(t Tag) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.outstanding[t]++
+}
+
+// push queues the response to a request. A nil response completes the
+// request without writing anything.
+func (q *replyQueue) push(req, resp Message) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	t := MessageTag(req)
+	if resp == nil {
+		q.done(t)
+		return
+	}
+
+	r := queuedReply{tag: t, resp: resp}
+	switch BaseMessage(resp).(type) {
+	case *FlushResponse:
+		if f, ok := BaseMessage(req).(*FlushRequest); ok && f.OldTag != t && q.outstanding[f.OldTag] > 0 {
+			q.held[f.OldTag] = append(q.held[f.OldTag], r)
+			return
+		}
+		q.urgent = append(q.urgent, r)
+	case *ErrorResponse, *ErrorResponseDotu:
+		q.urgent = append(q.urgent, r)
+	default:
+		q.normal = append(q.normal, r)
+	}
+	q.cond.Signal()
+}
+
+// next returns the next response to write, blocking until one is available.
+// It returns false once the queue is closed and empty.
+func (q *replyQueue) next() (Tag, Message, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		for _, queue := range []*[]queuedReply{&q.urgent, &q.normal} {
+			if len(*queue) > 0 {
+				r := (*queue)[0]
+				(*queue)[0] = queuedReply{}
+				*queue = (*queue)[1:]
+				return r.tag, r.resp, true
+			}
+		}
+		if q.closed {
+			return NOTAG, nil, false
+		}
+		q.cond.Wait()
+	}
+}
+
+// written completes the request with the provided tag once its response has
+// been written.
+func (q *replyQueue) written(t Tag) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.done(t)
+}
+
+// done completes a request, releasing the FlushResponses held for it once no
+// request with its tag is outstanding. lock must be held.
+func (q *replyQueue) done(t Tag) {
+	if q.outstanding[t]--; q.outstanding[t] > 0 {
+		return
+	}
+	delete(q.outstanding, t)
+	if held := q.held[t]; len(held) > 0 {
+		delete(q.held, t)
+		q.urgent = append(q.urgent, held...)
+		q.cond.Signal()
+	}
+}
+
+// close makes next return false once the queue is empty. It must only be
+// called once no more responses will be pushed.
+func (q *replyQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
@@ -0,0 +1,488 @@
+package qp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	srv := NewServer(NewSession(c2, NineP2000, 8192))
+	srv.Handle(Tversion, func(m Message) (Message, error) {
+		req := m.(*VersionRequest)
+		return &VersionResponse{MessageSize: req.MessageSize, Version: req.Version}, nil
+	})
+	srv.Handle(Twalk, func(m Message) (Message, error) {
+		req := m.(*WalkRequest)
+		if len(req.Names) > 0 && req.Names[0] == "missing" {
+			return nil, errors.New("file not found")
+		}
+		qids := make([]Qid, len(req.Names))
+		for i := range qids {
+			qids[i] = NewQid(QTDIR, 0, uint64(i+1))
+		}
+		return &WalkResponse{Qids: qids}, nil
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve() }()
+
+	s := NewSession(c1, NineP2000, 8192)
+	version, err := s.ClientVersion(4096, Version)
+	if err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	if version != Version {
+		t.Errorf("expected version %s, got %s", Version, version)
+	}
+
+	c := NewClient(s)
+	tests := []struct {
+		req  Message
+		resp Message
+	}{
+		{
+			&WalkRequest{Fid: 1, NewFid: 2, Names: []string{"usr", "glenda"}},
+			&WalkResponse{Qids: []Qid{NewQid(QTDIR, 0, 1), NewQid(QTDIR, 0, 2)}},
+		},
+		{
+			&WalkRequest{Fid: 1, NewFid: 2, Names: []string{"missing"}},
+			&ErrorResponse{Error: "file not found"},
+		},
+		{
+			&ClunkRequest{Fid: 1},
+			&ErrorResponse{Error: ErrNoHandler.Error()},
+		},
+	}
+
+	for i, tt := range tests {
+		resp, err := c.Send(tt.req)
+		if err != nil {
+			t.Fatalf("test %d: send failed: %v", i, err)
+		}
+		if MessageTag(resp) != MessageTag(tt.req) {
+			t.Errorf("test %d: response tag %d does not match request tag %d", i, MessageTag(resp), MessageTag(tt.req))
+		}
+		resp.(Tagged).SetTag(0)
+		if !Equal(resp, tt.resp) {
+			t.Errorf("test %d: unexpected response:\n%s", i, Diff(resp, tt.resp))
+		}
+	}
+
+	c1.Close()
+	if err = <-errc; err == nil {
+		t.Errorf("expected error from Serve after close")
+	}
+}
+
+// errnoError is an error carrying an errno.
+type errnoError struct{}
+
+func (errnoError) Error() string { return "permission denied" }
+func (errnoError) Errno() uint32 { return 13 }
+
+func TestErrorToResponse(t *testing.T) {
+	tests := []struct {
+		err  error
+		dotu bool
+		resp Message
+	}{
+		{errors.New("oops"), false, &ErrorResponse{Tag: 5, Error: "oops"}},
+		{errors.New("oops"), true, &ErrorResponseDotu{Tag: 5, Error: "oops"}},
+		{fmt.Errorf("walk: %w", &ServerError{Message: "file not found", Errno: 2}), false, &ErrorResponse{Tag: 5, Error: "file not found"}},
+		{fmt.Errorf("walk: %w", &ServerError{Message: "file not found", Errno: 2}), true, &ErrorResponseDotu{Tag: 5, Error: "file not found", Errno: 2}},
+		{errnoError{}, true, &ErrorResponseDotu{Tag: 5, Error: "permission denied", Errno: 13}},
+		{syscall.ENOENT, true, &ErrorResponseDotu{Tag: 5, Error: syscall.ENOENT.Error(), Errno: uint32(syscall.ENOENT)}},
+	}
+
+	for i, tt := range tests {
+		resp := ErrorToResponse(5, tt.err, tt.dotu)
+		if !Equal(resp, tt.resp) {
+			t.Errorf("test %d: unexpected response:\n%s", i, Diff(resp, tt.resp))
+		}
+	}
+}
+
+// serverConn is a connection reading a fixed stream of requests, and
+// discarding responses.
+type serverConn struct {
+	io.Reader
+	io.Writer
+}
+
+func TestServerEOF(t *testing.T) {
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf}
+	if err := e.WriteMessage(&ClunkRequest{Tag: 1, Fid: 1}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	full := buf.Bytes()
+
+	tests := []struct {
+		b   []byte
+		err error
+	}{
+		{full, io.EOF},
+		{append(full, full[:HeaderSize+1]...), io.ErrUnexpectedEOF},
+	}
+
+	for _, workers := range []int{0, 2} {
+		for i, tt := range tests {
+			srv := NewServer(NewSession(serverConn{bytes.NewReader(tt.b), ioutil.Discard}, NineP2000, 8192))
+			srv.Workers = workers
+			srv.Handle(Tclunk, func(m Message) (Message, error) {
+				return &ClunkResponse{}, nil
+			})
+			if err := srv.Serve(); err != tt.err {
+				t.Errorf("workers %d, test %d: expected %v, got %v", workers, i, tt.err, err)
+			}
+		}
+	}
+}
+
+func TestServerExtendedRequests(t *testing.T) {
+	extra := []byte{1, 2, 3}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	session := NewSession(c2, NineP2000, 8192)
+	session.Decoder.PreserveExtensions = true
+	srv := NewServer(session)
+	srv.Handle(Twalk, func(m Message) (Message, error) {
+		em, ok := m.(*ExtendedMessage)
+		if !ok || !bytes.Equal(em.Extra, extra) {
+			return nil, fmt.Errorf("expected extended request, got %T", m)
+		}
+		req := BaseMessage(m).(*WalkRequest)
+		return &ExtendedMessage{Message: &WalkResponse{Qids: make([]Qid, len(req.Names))}, Extra: extra}, nil
+	})
+	go srv.Serve()
+
+	s := NewSession(c1, NineP2000, 8192)
+	s.Decoder.PreserveExtensions = true
+	c := NewClient(s)
+	resp, err := c.Send(&ExtendedMessage{Message: &WalkRequest{Fid: 1, NewFid: 2, Names: []string{"usr"}}, Extra: extra})
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	em, ok := resp.(*ExtendedMessage)
+	if !ok || !bytes.Equal(em.Extra, extra) {
+		t.Fatalf("expected extended response, got %#v", resp)
+	}
+	if r, ok := em.Message.(*WalkResponse); !ok || len(r.Qids) != 1 {
+		t.Errorf("expected walk response with a qid, got %#v", em.Message)
+	}
+}
+
+// serveWorkers starts a Server with the provided worker configuration and a
+// Tclunk handler, returning the client end of the connection.
+func serveWorkers(workers int, ordered bool, h Handler) (*Session, net.Conn) {
+	c1, c2 := net.Pipe()
+	srv := NewServer(NewSession(c2, NineP2000, 8192))
+	srv.Workers = workers
+	srv.Ordered = ordered
+	srv.Handle(Tclunk, h)
+	go srv.Serve()
+	return NewSession(c1, NineP2000, 8192), c1
+}
+
+func TestServerWorkersOrdered(t *testing.T) {
+	const requests = 8
+	s, conn := serveWorkers(4, true, func(m Message) (Message, error) {
+		// Earlier requests take longer, so handlers finish in reverse order.
+		time.Sleep(time.Duration(requests-int(MessageTag(m))) * 5 * time.Millisecond)
+		return &ClunkResponse{}, nil
+	})
+	defer conn.Close()
+
+	go func() {
+		for i := 0; i < requests; i++ {
+			s.Encoder.WriteMessage(&ClunkRequest{Tag: Tag(i)})
+		}
+	}()
+
+	for i := 0; i < requests; i++ {
+		m, err := s.Decoder.ReadMessage()
+		if err != nil {
+			t.Fatalf("response %d: read failed: %v", i, err)
+		}
+		if MessageTag(m) != Tag(i) {
+			t.Errorf("response %d: expected tag %d, got %d", i, i, MessageTag(m))
+		}
+	}
+}
+
+func TestServerWorkersUnordered(t *testing.T) {
+	release := make(chan struct{})
+	s, conn := serveWorkers(2, false, func(m Message) (Message, error) {
+		// The first request cannot complete until the second is handled,
+		// which requires the requests to be handled concurrently.
+		if MessageTag(m) == 0 {
+			<-release
+		} else {
+			close(release)
+		}
+		return &ClunkResponse{}, nil
+	})
+	defer conn.Close()
+
+	go func() {
+		s.Encoder.WriteMessage(&ClunkRequest{Tag: 0})
+		s.Encoder.WriteMessage(&ClunkRequest{Tag: 1})
+	}()
+
+	for i, tag := range []Tag{1, 0} {
+		m, err := s.Decoder.ReadMessage()
+		if err != nil {
+			t.Fatalf("response %d: read failed: %v", i, err)
+		}
+		if MessageTag(m) != tag {
+			t.Errorf("response %d: expected tag %d, got %d", i, tag, MessageTag(m))
+		}
+	}
+}
+
+// servePrioritized starts a Prioritized Server with workers and the provided
+// handlers, returning the client end of the connection.
+func servePrioritized(handlers map[MessageType]Handler) (*Session, net.Conn) {
+	c1, c2 := net.Pipe()
+	srv := NewServer(NewSession(c2, NineP2000, 8192))
+	srv.Workers = 4
+	srv.Prioritized = true
+	for mt, h := range handlers {
+		srv.Handle(mt, h)
+	}
+	go srv.Serve()
+	return NewSession(c1, NineP2000, 8192), c1
+}
+
+func TestServerPrioritized(t *testing.T) {
+	s, conn := servePrioritized(map[MessageType]Handler{
+		Tread: func(m Message) (Message, error) {
+			return &ReadResponse{Data: make([]byte, 1000)}, nil
+		},
+		Tclunk: func(m Message) (Message, error) {
+			// Returned once the reads are waiting to be written.
+			time.Sleep(20 * time.Millisecond)
+			return nil, errors.New("oops")
+		},
+	})
+	defer conn.Close()
+
+	go func() {
+		for i := 1; i <= 3; i++ {
+			s.Encoder.WriteMessage(&ReadRequest{Tag: Tag(i), Count: 1000})
+		}
+		s.Encoder.WriteMessage(&ClunkRequest{Tag: 4})
+	}()
+
+	// Responses are only read once all are waiting. The first read response
+	// is already being written, but the error jumps ahead of the others.
+	time.Sleep(100 * time.Millisecond)
+	var tags []Tag
+	for i := 0; i < 4; i++ {
+		m, err := s.Decoder.ReadMessage()
+		if err != nil {
+			t.Fatalf("response %d: read failed: %v", i, err)
+		}
+		tags = append(tags, MessageTag(m))
+		if _, isErr := m.(*ErrorResponse); isErr != (MessageTag(m) == 4) {
+			t.Errorf("response %d: unexpected response %T for tag %d", i, m, MessageTag(m))
+		}
+	}
+	if tags[0] == 4 || tags[1] != 4 {
+		t.Errorf("expected the error to be the second response, got tags %v", tags)
+	}
+}
+
+func TestServerPrioritizedFlush(t *testing.T) {
+	var once sync.Once
+	release := make(chan struct{})
+	s, conn := servePrioritized(map[MessageType]Handler{
+		Tread: func(m Message) (Message, error) {
+			<-release
+			return &ReadResponse{}, nil
+		},
+		Tflush: func(m Message) (Message, error) {
+			// The read completes only after the flush has been answered.
+			once.Do(func() {
+				time.AfterFunc(20*time.Millisecond, func() { close(release) })
+			})
+			return &FlushResponse{}, nil
+		},
+	})
+	defer conn.Close()
+
+	go func() {
+		s.Encoder.WriteMessage(&ReadRequest{Tag: 1})
+		s.Encoder.WriteMessage(&FlushRequest{Tag: 2, OldTag: 1})
+	}()
+
+	// The response to the flush is held back until the flushed read has been
+	// answered.
+	for i, expected := range []Message{&ReadResponse{Tag: 1}, &FlushResponse{Tag: 2}} {
+		m, err := s.Decoder.ReadMessage()
+		if err != nil {
+			t.Fatalf("response %d: read failed: %v", i, err)
+		}
+		if !Equal(m, expected) {
+			t.Errorf("response %d: unexpected response:\n%s", i, Diff(m, expected))
+		}
+	}
+
+	// A flush of a request that is no longer outstanding is not held back.
+	s.Encoder.WriteMessage(&FlushRequest{Tag: 3, OldTag: 1})
+	m, err := s.Decoder.ReadMessage()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !Equal(m, &FlushResponse{Tag: 3}) {
+		t.Errorf("unexpected response:\n%s", Diff(m, &FlushResponse{Tag: 3}))
+	}
+}
+
+func TestServerDuplicateTags(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	release := make(chan struct{})
+	srv := NewServer(NewSession(c2, NineP2000, 8192))
+	srv.Workers = 2
+	srv.RejectDuplicateTags = true
+	srv.Handle(Twalk, func(m Message) (Message, error) {
+		<-release
+		return &WalkResponse{}, nil
+	})
+	go srv.Serve()
+
+	s := NewSession(c1, NineP2000, 8192)
+	go func() {
+		s.Encoder.WriteMessage(&WalkRequest{Tag: 7, Fid: 1, NewFid: 2})
+		s.Encoder.WriteMessage(&WalkRequest{Tag: 7, Fid: 1, NewFid: 3})
+	}()
+
+	// The second walk is rejected while the first is still outstanding.
+	m, err := s.Decoder.ReadMessage()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	expected := &ErrorResponse{Tag: 7, Error: ErrDuplicateTag.Error()}
+	if !Equal(m, expected) {
+		t.Errorf("unexpected response to duplicate:\n%s", Diff(m, expected))
+	}
+
+	close(release)
+	if m, err = s.Decoder.ReadMessage(); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !Equal(m, &WalkResponse{Tag: 7}) {
+		t.Errorf("unexpected response to first walk:\n%s", Diff(m, &WalkResponse{Tag: 7}))
+	}
+
+	// Once the first walk completed, the tag can be reused.
+	go s.Encoder.WriteMessage(&WalkRequest{Tag: 7, Fid: 1, NewFid: 3})
+	if m, err = s.Decoder.ReadMessage(); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !Equal(m, &WalkResponse{Tag: 7}) {
+		t.Errorf("unexpected response to reused tag:\n%s", Diff(m, &WalkResponse{Tag: 7}))
+	}
+}
+
+func TestServerStrictVersionTag(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	srv := NewServer(NewSession(c2, NineP2000, 8192))
+	srv.StrictVersionTag = true
+	srv.Handle(Tversion, func(m Message) (Message, error) {
+		return &VersionResponse{MessageSize: 8192, Version: Version}, nil
+	})
+	go srv.Serve()
+
+	s := NewSession(c1, NineP2000, 8192)
+	tests := []struct {
+		tag  Tag
+		resp Message
+	}{
+		{1, &ErrorResponse{Tag: 1, Error: ErrVersionTag.Error()}},
+		{NOTAG, &VersionResponse{Tag: NOTAG, MessageSize: 8192, Version: Version}},
+	}
+	for i, tt := range tests {
+		go s.Encoder.WriteMessage(&VersionRequest{Tag: tt.tag, MessageSize: 8192, Version: Version})
+		m, err := s.Decoder.ReadMessage()
+		if err != nil {
+			t.Fatalf("test %d: read failed: %v", i, err)
+		}
+		if !Equal(m, tt.resp) {
+			t.Errorf("test %d: unexpected response:\n%s", i, Diff(m, tt.resp))
+		}
+	}
+}
+
+func TestServerUntagged(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	srv := NewServer(NewSession(c2, rawProtocol{}, 8192))
+	srv.RejectDuplicateTags = true
+	srv.Handle(1, func(m Message) (Message, error) {
+		return &rawMessage{Data: append([]byte("re: "), m.(*rawMessage).Data...)}, nil
+	})
+	go srv.Serve()
+
+	s := NewSession(c1, rawProtocol{}, 8192)
+	for i := 0; i < 2; i++ {
+		go s.Encoder.WriteMessage(&rawMessage{Data: []byte("hello")})
+		m, err := s.Decoder.ReadMessage()
+		if err != nil {
+			t.Fatalf("test %d: read failed: %v", i, err)
+		}
+		expected := &rawMessage{Data: []byte("re: hello")}
+		if !Equal(m, expected) {
+			t.Errorf("test %d: unexpected response:\n%s", i, Diff(m, expected))
+		}
+	}
+}
+
+func TestServerRecoverPanics(t *testing.T) {
+	for _, workers := range []int{0, 2} {
+		c1, c2 := net.Pipe()
+
+		srv := NewServer(NewSession(c2, NineP2000, 8192))
+		srv.Workers = workers
+		srv.RecoverPanics = true
+		srv.Handle(Tclunk, func(m Message) (Message, error) {
+			panic("oops")
+		})
+		errc := make(chan error, 1)
+		go func() { errc <- srv.Serve() }()
+
+		// Workers only notice the failure once a later request is read, so
+		// requests are sent until the connection is closed.
+		s := NewSession(c1, NineP2000, 8192)
+		go func() {
+			for i := 0; s.Encoder.WriteMessage(&ClunkRequest{Tag: Tag(i)}) == nil; i++ {
+			}
+		}()
+
+		select {
+		case err := <-errc:
+			if !errors.Is(err, ErrHandlerPanic) {
+				t.Errorf("workers %d: expected ErrHandlerPanic, got %v", workers, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("workers %d: Serve did not return after panic", workers)
+		}
+		c1.Close()
+	}
+}
@@ -0,0 +1,241 @@
+package qp
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+var (
+	// ErrVersionRejected indicates that the peer did not accept any protocol
+	// version during negotiation.
+	ErrVersionRejected = errors.New("protocol version rejected")
+
+	// ErrVersionRequired indicates that the client sent something other than
+	// a VersionRequest when negotiation was expected.
+	ErrVersionRequired = errors.New("version request required")
+
+	// ErrUnsupportedVersion indicates that no Protocol is registered for a
+	// negotiated version in Protocols.
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
+// Protocols maps version strings to the Protocol implementing them. It is
+// used by SwitchProtocol.
+var Protocols = map[string]Protocol{
+	Version:     NineP2000,
+	VersionDotu: NineP2000Dotu,
+	VersionDote: NineP2000Dote,
+}
+
+// ClampMessageSize returns the message size to agree on when requested is
+// proposed, and max is the largest message size that can be handled locally.
+// Like the MessageSize of the Encoder and Decoder, a size of 0 means no limit,
+// so a max of 0 accepts any requested size, and a requested size of 0 is
+// clamped to max.
+func ClampMessageSize(requested, max uint32) uint32 {
+	if max != 0 && (requested == 0 || requested > max) {
+		return max
+	}
+	return requested
+}
+
+// Session is an Encoder and a Decoder operating on the same connection.
+type Session struct {
+	// Encoder is the encoder used for outgoing messages.
+	Encoder *Encoder
+
+	// Decoder is the decoder used for incoming messages.
+	Decoder *Decoder
+}
+
+// NewSession returns a Session that writes to and reads from rw, using the
+// provided protocol and maximum message size for both directions.
+func NewSession(rw io.ReadWriter, p Protocol, msize uint32) *Session {
+	return &Session{
+		Encoder: &Encoder{
+			Protocol:    p,
+			Writer:      rw,
+			MessageSize: msize,
+		},
+		Decoder: &Decoder{
+			Protocol:    p,
+			Reader:      rw,
+			MessageSize: msize,
+		},
+	}
+}
+
+// Close closes the Encoder using Encoder.Close, which closes its Writer if it
+// implements io.Closer, such as the connection of a Session returned by Dial
+// or Listener.AcceptSession.
+func (s *Session) Close() error {
+	return s.Encoder.Close()
+}
+
+// SetMessageSize applies a message size to both the Encoder and the Decoder,
+// such as after version negotiation, using Encoder.SetMessageSize and
+// Decoder.SetMessageSize. It may be called concurrently with ReadMessage and
+// WriteMessage. The Encoder applies the new size to messages encoded after the
+// call, and the Decoder at the next message boundary.
+func (s *Session) SetMessageSize(msize uint32) {
+	s.Encoder.SetMessageSize(msize)
+	s.Decoder.SetMessageSize(msize)
+}
+
+// SwitchProtocol sets the Protocol of both the Encoder and the Decoder to the
+// one registered for version in Protocols, returning ErrUnsupportedVersion if
+// there is none. It is meant to be called right after version negotiation, but
+// may be called concurrently with ReadMessage and WriteMessage, in which case
+// each message is encoded or decoded with either the old or the new Protocol.
+func (s *Session) SwitchProtocol(version string) error {
+	p, ok := Protocols[version]
+	if !ok {
+		return ErrUnsupportedVersion
+	}
+	s.Encoder.SetProtocol(p)
+	s.Decoder.SetProtocol(p)
+	return nil
+}
+
+// ClientVersion negotiates the protocol version and message size as a
+// client. The proposed message size is clamped to the current MessageSize of
+// the Decoder, and the message size of the response is clamped to the
+// proposal. The resulting message size is applied to both the Encoder and the
+// Decoder, and the negotiated version is returned. ErrVersionRejected is
+// returned if the server responds with UnknownVersion.
+func (s *Session) ClientVersion(msize uint32, version string) (string, error) {
+	v, msize, err := s.exchangeVersion(msize, version)
+	if err != nil {
+		return "", err
+	}
+	s.SetMessageSize(msize)
+	return v, nil
+}
+
+// exchangeVersion sends a VersionRequest and reads the response without
+// applying it, returning the negotiated version and message size.
+func (s *Session) exchangeVersion(msize uint32, version string) (string, uint32, error) {
+	msize = ClampMessageSize(msize, s.Decoder.messageSize())
+	err := s.Encoder.WriteMessage(&VersionRequest{
+		Tag:         NOTAG,
+		MessageSize: msize,
+		Version:     version,
+	})
+	if err == nil {
+		err = s.Encoder.Flush()
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	m, err := s.Decoder.ReadMessage()
+	if err != nil {
+		return "", 0, err
+	}
+
+	resp, ok := m.(*VersionResponse)
+	if !ok {
+		if err = responseError(m); err != nil {
+			return "", 0, err
+		}
+		return "", 0, ErrUnexpectedResponse
+	}
+	if resp.Version == UnknownVersion {
+		return "", 0, ErrVersionRejected
+	}
+	return resp.Version, ClampMessageSize(resp.MessageSize, msize), nil
+}
+
+// ServerVersion negotiates the protocol version and message size as a
+// server. It reads a VersionRequest, clamps the requested message size to
+// the current MessageSize of the Decoder, and accepts version if the client
+// requested it, or an extension of it, such as "9P2000.u" for "9P2000". The
+// resulting message size is applied to both the Encoder and the Decoder. If
+// the version is not accepted, UnknownVersion is sent in the response, and
+// ErrVersionRejected is returned. The version requested by the client is
+// returned.
+func (s *Session) ServerVersion(version string) (string, error) {
+	m, err := s.Decoder.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+
+	req, ok := m.(*VersionRequest)
+	if !ok {
+		return "", ErrVersionRequired
+	}
+
+	resp := &VersionResponse{
+		Tag:         req.Tag,
+		MessageSize: ClampMessageSize(req.MessageSize, s.Decoder.messageSize()),
+		Version:     version,
+	}
+	if req.Version != version && !strings.HasPrefix(req.Version, version+".") {
+		resp.Version = UnknownVersion
+	}
+
+	if err = s.Encoder.WriteMessage(resp); err == nil {
+		err = s.Encoder.Flush()
+	}
+	if err != nil {
+		return req.Version, err
+	}
+	if resp.Version == UnknownVersion {
+		return req.Version, ErrVersionRejected
+	}
+	s.SetMessageSize(resp.MessageSize)
+	return req.Version, nil
+}
+
+// ClientVersionSwitch negotiates the protocol version and message size like
+// ClientVersion, and then switches to the Protocol of the negotiated version
+// using SwitchProtocol. The negotiation itself must use a Protocol that can
+// encode VersionRequests and decode VersionResponses, which all registered
+// Protocols can.
+func (s *Session) ClientVersionSwitch(msize uint32, version string) (string, error) {
+	v, err := s.ClientVersion(msize, version)
+	if err != nil {
+		return "", err
+	}
+	return v, s.SwitchProtocol(v)
+}
+
+// Negotiate negotiates the protocol version and message size as a client,
+// proposing the first of versions, in order of preference. The server may
+// respond with any of versions, such as "9P2000" when "9P2000.u" was
+// proposed. The message size is clamped like ClientVersion, and only once the
+// response has been validated are the message size and the Protocol
+// registered for the version in Protocols applied to both the Encoder and the
+// Decoder. ErrUnsupportedVersion is returned if the response is not one of
+// versions, or if no Protocol is registered for it, in which case the Session
+// is left unchanged. Like SetMessageSize, it may be called concurrently with
+// ReadMessage and WriteMessage. The Protocol and message size are applied
+// together, to messages encoded after the call, and to messages decoded from
+// the next message boundary on.
+func (s *Session) Negotiate(msize uint32, versions []string) error {
+	if len(versions) == 0 {
+		return ErrUnsupportedVersion
+	}
+
+	v, msize, err := s.exchangeVersion(msize, versions[0])
+	if err != nil {
+		return err
+	}
+
+	supported := false
+	for _, version := range versions {
+		if v == version {
+			supported = true
+			break
+		}
+	}
+	p, ok := Protocols[v]
+	if !ok || !supported {
+		return ErrUnsupportedVersion
+	}
+
+	s.Encoder.configure(p, msize)
+	s.Decoder.configure(p, msize)
+	return nil
+}
@@ -0,0 +1,395 @@
+package qp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestClampMessageSize(t *testing.T) {
+	tests := []struct {
+		requested, max, expected uint32
+	}{
+		{8192, 4096, 4096},
+		{4096, 8192, 4096},
+		{4096, 4096, 4096},
+		{8192, 0, 8192},
+		{0, 8192, 8192},
+		{0, 0, 0},
+	}
+
+	for i, tt := range tests {
+		if x := ClampMessageSize(tt.requested, tt.max); x != tt.expected {
+			t.Errorf("test %d: expected %d, got %d", i, tt.expected, x)
+		}
+	}
+}
+
+func TestSessionVersion(t *testing.T) {
+	tests := []struct {
+		client, server, expected uint32
+	}{
+		{8192, 4096, 4096},
+		{4096, 8192, 4096},
+		{4096, 4096, 4096},
+		{0, 8192, 8192},
+		{8192, 0, 8192},
+	}
+
+	for i, tt := range tests {
+		c1, c2 := net.Pipe()
+		client := NewSession(c1, NineP2000, tt.client)
+		server := NewSession(c2, NineP2000, tt.server)
+
+		errch := make(chan error, 1)
+		go func() {
+			_, err := server.ServerVersion(Version)
+			errch <- err
+		}()
+
+		// Propose more than the client can handle, which must be clamped too.
+		v, err := client.ClientVersion(tt.client*2, VersionDotu)
+		if err != nil {
+			t.Fatalf("test %d: client negotiation failed: %v", i, err)
+		}
+		if err = <-errch; err != nil {
+			t.Fatalf("test %d: server negotiation failed: %v", i, err)
+		}
+		if v != Version {
+			t.Errorf("test %d: expected version %q, got %q", i, Version, v)
+		}
+
+		for _, s := range []*Session{client, server} {
+			if s.Encoder.messageSize() != tt.expected || s.Decoder.messageSize() != tt.expected {
+				t.Errorf("test %d: expected message size %d, got %d/%d", i, tt.expected, s.Encoder.messageSize(), s.Decoder.messageSize())
+			}
+		}
+
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestSessionVersionRejected(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	client := NewSession(c1, NineP2000, 4096)
+	server := NewSession(c2, NineP2000, 4096)
+
+	errch := make(chan error, 1)
+	go func() {
+		_, err := server.ServerVersion(Version)
+		errch <- err
+	}()
+
+	if _, err := client.ClientVersion(4096, "9P1999"); err != ErrVersionRejected {
+		t.Errorf("expected client to see ErrVersionRejected, got %v", err)
+	}
+	if err := <-errch; err != ErrVersionRejected {
+		t.Errorf("expected server to see ErrVersionRejected, got %v", err)
+	}
+}
+
+func TestSessionSetMessageSize(t *testing.T) {
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf, MessageSize: 8192}
+	for i := 0; i < 3; i++ {
+		if err := e.WriteMessage(&ClunkRequest{Tag: Tag(i), Fid: Fid(i)}); err != nil {
+			t.Fatalf("unable to encode message: %v", err)
+		}
+	}
+	size := uint32(buf.Len() / 3)
+
+	s := NewSession(&buf, NineP2000, 8192)
+	s.Decoder.Greedy = true
+
+	// The first read consumes all messages into the buffer.
+	if _, err := s.Decoder.ReadMessage(); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	s.SetMessageSize(size)
+	if s.Encoder.messageSize() != size || s.Decoder.messageSize() != size {
+		t.Errorf("expected message size %d, got encoder %d, decoder %d", size, s.Encoder.messageSize(), s.Decoder.messageSize())
+	}
+
+	// The buffered messages survive the resize, which is deferred until
+	// the data read ahead fits in the new size.
+	for i := 1; i < 3; i++ {
+		m, err := s.Decoder.ReadMessage()
+		if err != nil {
+			t.Fatalf("message %d: read failed: %v", i, err)
+		}
+		if MessageTag(m) != Tag(i) {
+			t.Errorf("message %d: expected tag %d, got %d", i, i, MessageTag(m))
+		}
+		if expected := map[int]uint32{1: 8192, 2: size}[i]; s.Decoder.MessageSize != expected {
+			t.Errorf("message %d: expected decoder message size %d, got %d", i, expected, s.Decoder.MessageSize)
+		}
+	}
+	if len(s.Decoder.buffer) != int(size) {
+		t.Errorf("expected buffer of %d bytes, got %d", size, len(s.Decoder.buffer))
+	}
+}
+
+func TestSessionSetMessageSizeConcurrent(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	var (
+		lock          sync.Mutex
+		reads, writes []uint64
+	)
+	file := make([]byte, 100000)
+	for i := range file {
+		file[i] = byte(i)
+	}
+	handler := fileServer(&lock, &file, len(file), &reads, &writes)
+	go func() {
+		s := NewSession(c2, NineP2000, 1<<16)
+		for {
+			m, err := s.Decoder.ReadMessage()
+			if err != nil {
+				return
+			}
+			resp := handler(m)
+			resp.(Tagged).SetTag(MessageTag(m))
+			if err = s.Encoder.WriteMessage(resp); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := NewClient(NewSession(c1, NineP2000, 4096))
+	c.session.Decoder.Greedy = true
+
+	// Only grow the size, as responses to reads sent with a larger size would
+	// otherwise be rejected.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for msize := uint32(4096); msize <= 1<<16; msize += 512 {
+			c.session.SetMessageSize(msize)
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		b, err := c.ReadAll(1, 0, len(file))
+		if err != nil {
+			t.Fatalf("read %d failed: %v", i, err)
+		}
+		if !bytes.Equal(b, file) {
+			t.Fatalf("read %d returned wrong data", i)
+		}
+	}
+	<-done
+}
+
+func TestSessionVersionSwitch(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	server := NewSession(c2, NineP2000, 8192)
+	errc := make(chan error, 1)
+	go func() {
+		if _, err := server.ServerVersion(VersionDotu); err != nil {
+			errc <- err
+			return
+		}
+		if err := server.SwitchProtocol(VersionDotu); err != nil {
+			errc <- err
+			return
+		}
+
+		// A 9P2000.u specific message, which 9P2000 cannot encode.
+		_, err := server.Decoder.ReadMessage()
+		if err == nil {
+			err = server.Encoder.WriteMessage(&ErrorResponseDotu{Error: "no", Errno: 2})
+		}
+		errc <- err
+	}()
+
+	client := NewSession(c1, NineP2000, 8192)
+	version, err := client.ClientVersionSwitch(8192, VersionDotu)
+	if err != nil {
+		t.Fatalf("version switch failed: %v", err)
+	}
+	if version != VersionDotu {
+		t.Errorf("expected version %s, got %s", VersionDotu, version)
+	}
+	if client.Encoder.Protocol != NineP2000Dotu || client.Decoder.Protocol != NineP2000Dotu {
+		t.Fatalf("protocol was not switched")
+	}
+
+	if err = client.Encoder.WriteMessage(&ClunkRequest{Fid: 1}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	m, err := client.Decoder.ReadMessage()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if resp, ok := m.(*ErrorResponseDotu); !ok || resp.Errno != 2 {
+		t.Errorf("expected 9P2000.u error response, got %#v", m)
+	}
+	if err = <-errc; err != nil {
+		t.Errorf("server failed: %v", err)
+	}
+
+	if err = client.SwitchProtocol("9P2000.x"); err != ErrUnsupportedVersion {
+		t.Errorf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestSessionSwitchProtocolConcurrent(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	server := NewSession(c2, NineP2000, 8192)
+	srv := NewServer(server)
+	srv.Handle(Tclunk, func(m Message) (Message, error) {
+		return &ClunkResponse{}, nil
+	})
+	go srv.Serve()
+
+	client := NewSession(c1, NineP2000, 8192)
+	c := NewClient(client)
+
+	// Both protocols encode clunks the same way, so every request must
+	// succeed regardless of which one is in use.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		versions := []string{Version, VersionDotu}
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			server.SwitchProtocol(versions[i%2])
+			client.SwitchProtocol(versions[(i+1)%2])
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		if _, err := c.Send(&ClunkRequest{Fid: Fid(i)}); err != nil {
+			t.Fatalf("request %d failed: %v", i, err)
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func TestSessionClientVersionTag(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	tags := make(chan Tag, 1)
+	go func() {
+		s := NewSession(c2, NineP2000, 8192)
+		m, err := s.Decoder.ReadMessage()
+		if err != nil {
+			close(tags)
+			return
+		}
+		tags <- MessageTag(m)
+		s.Encoder.WriteMessage(&VersionResponse{Tag: MessageTag(m), MessageSize: 8192, Version: Version})
+	}()
+
+	if _, err := NewSession(c1, NineP2000, 8192).ClientVersion(8192, Version); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+	if tag := <-tags; tag != NOTAG {
+		t.Errorf("expected version request to use NOTAG, got %d", tag)
+	}
+}
+
+func TestDecoderConfigure(t *testing.T) {
+	var buf bytes.Buffer
+	e := &Encoder{Protocol: NineP2000, Writer: &buf, MessageSize: 8192}
+	for i := 0; i < 3; i++ {
+		if err := e.WriteMessage(&ClunkRequest{Tag: Tag(i), Fid: Fid(i)}); err != nil {
+			t.Fatalf("unable to encode message: %v", err)
+		}
+	}
+	size := uint32(buf.Len() / 3)
+
+	d := &Decoder{Protocol: NineP2000, Reader: &buf, MessageSize: 8192, Greedy: true}
+	if _, err := d.ReadMessage(); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	// The Protocol waits for the size, which waits for the data read ahead
+	// to fit.
+	d.configure(NineP2000Dotu, size)
+	for i := 1; i < 3; i++ {
+		if _, err := d.ReadMessage(); err != nil {
+			t.Fatalf("message %d: read failed: %v", i, err)
+		}
+		changed := i == 2
+		if (d.Protocol == NineP2000Dotu) != changed || (d.MessageSize == size) != changed {
+			t.Errorf("message %d: expected change %t, got protocol %T and size %d", i, changed, d.Protocol, d.MessageSize)
+		}
+	}
+}
+
+// nextProtocol returns the Protocol used by d from the next message boundary.
+func nextProtocol(d *Decoder) Protocol {
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	if d.nextProtocol != nil {
+		return d.nextProtocol
+	}
+	return d.Protocol
+}
+
+func TestSessionNegotiate(t *testing.T) {
+	tests := []struct {
+		server   string
+		versions []string
+		protocol Protocol
+		err      error
+	}{
+		{VersionDotu, []string{VersionDotu, Version}, NineP2000Dotu, nil},
+		{Version, []string{VersionDotu, Version}, NineP2000, nil},
+		{Version, []string{VersionDote, VersionDotu}, nil, ErrUnsupportedVersion},
+		{Version, []string{"9P1999"}, nil, ErrVersionRejected},
+	}
+
+	for i, tt := range tests {
+		c1, c2 := net.Pipe()
+		client := NewSession(c1, NineP2000, 8192)
+		server := NewSession(c2, NineP2000, 4096)
+
+		go server.ServerVersion(tt.server)
+
+		// The client proposes more than it can handle, and the server
+		// clamps it further.
+		err := client.Negotiate(16384, tt.versions)
+		c1.Close()
+		c2.Close()
+
+		if err != tt.err {
+			t.Errorf("test %d: expected %v, got %v", i, tt.err, err)
+			continue
+		}
+
+		protocol, msize := tt.protocol, uint32(4096)
+		if err != nil {
+			// The Session is left unchanged.
+			protocol, msize = NineP2000, 8192
+		}
+		if client.Encoder.protocol() != protocol || nextProtocol(client.Decoder) != protocol {
+			t.Errorf("test %d: protocol was not applied to both sides", i)
+		}
+		if client.Encoder.messageSize() != msize || client.Decoder.messageSize() != msize {
+			t.Errorf("test %d: expected message size %d, got %d/%d", i, msize, client.Encoder.messageSize(), client.Decoder.messageSize())
+		}
+	}
+}
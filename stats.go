@@ -0,0 +1,106 @@
+package qp
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// sizeBuckets counts message sizes in power of two buckets, where bucket i
+// holds sizes larger than 1<<(i-1), and at most 1<<i.
+type sizeBuckets [65]uint64
+
+// add counts a message of size bytes.
+func (sb *sizeBuckets) add(size uint64) {
+	if size == 0 {
+		sb[0]++
+		return
+	}
+	sb[bits.Len64(size-1)]++
+}
+
+// buckets returns the non-empty buckets.
+func (sb *sizeBuckets) buckets() []SizeBucket {
+	var b []SizeBucket
+	for i, c := range sb {
+		if c == 0 {
+			continue
+		}
+		max := uint64(1<<64 - 1)
+		if i < 64 {
+			max = 1 << uint(i)
+		}
+		b = append(b, SizeBucket{Max: max, Count: c})
+	}
+	return b
+}
+
+// SizeBucket is a bucket of a message size histogram.
+type SizeBucket struct {
+	// Max is the largest size counted by the bucket. Buckets are powers of
+	// two, and count sizes larger than half of Max.
+	Max uint64
+
+	// Count is the amount of messages counted by the bucket.
+	Count uint64
+}
+
+// SizeSnapshot is a copy of the histograms collected by a SizeStats. Only
+// non-empty buckets are included, in increasing order of size.
+type SizeSnapshot struct {
+	// Total is the histogram of all messages.
+	Total []SizeBucket
+
+	// Types holds the histogram of every message type seen.
+	Types map[MessageType][]SizeBucket
+}
+
+// SizeStats collects histograms of message sizes, in total and by message
+// type, such as to choose a message size that fits actual traffic. It is set
+// as Encoder.Stats or Decoder.Stats, and may be shared by several of them. The
+// zero value is ready to use. SizeStats is thread safe.
+type SizeStats struct {
+	// lock protects total and types.
+	lock  sync.Mutex
+	total sizeBuckets
+	types map[MessageType]*sizeBuckets
+}
+
+// Record counts a message of type mt and size bytes, including its header.
+func (ss *SizeStats) Record(mt MessageType, size uint64) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if ss.types == nil {
+		ss.types = make(map[MessageType]*sizeBuckets)
+	}
+	sb := ss.types[mt]
+	if sb == nil {
+		sb = &sizeBuckets{}
+		ss.types[mt] = sb
+	}
+	sb.add(size)
+	ss.total.add(size)
+}
+
+// Snapshot returns a copy of the collected histograms.
+func (ss *SizeStats) Snapshot() SizeSnapshot {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	snap := SizeSnapshot{
+		Total: ss.total.buckets(),
+		Types: make(map[MessageType][]SizeBucket, len(ss.types)),
+	}
+	for mt, sb := range ss.types {
+		snap.Types[mt] = sb.buckets()
+	}
+	return snap
+}
+
+// Reset discards the collected histograms.
+func (ss *SizeStats) Reset() {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.total = sizeBuckets{}
+	ss.types = nil
+}
@@ -0,0 +1,99 @@
+package qp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestSizeStats(t *testing.T) {
+	var ss SizeStats
+	for _, tt := range []struct {
+		mt   MessageType
+		size uint64
+	}{
+		{Tclunk, 11},
+		{Tclunk, 11},
+		{Rread, 16},
+		{Rread, 17},
+		{Rread, 8192},
+		{Rclunk, 7},
+	} {
+		ss.Record(tt.mt, tt.size)
+	}
+
+	snap := ss.Snapshot()
+	expected := SizeSnapshot{
+		Total: []SizeBucket{{8, 1}, {16, 3}, {32, 1}, {8192, 1}},
+		Types: map[MessageType][]SizeBucket{
+			Tclunk: {{16, 2}},
+			Rread:  {{16, 1}, {32, 1}, {8192, 1}},
+			Rclunk: {{8, 1}},
+		},
+	}
+	if !reflect.DeepEqual(snap, expected) {
+		t.Errorf("unexpected snapshot:\n%+v\nexpected:\n%+v", snap, expected)
+	}
+
+	ss.Reset()
+	if snap = ss.Snapshot(); len(snap.Total) != 0 || len(snap.Types) != 0 {
+		t.Errorf("expected empty snapshot after reset, got %+v", snap)
+	}
+}
+
+func TestEncoderDecoderStats(t *testing.T) {
+	msgs := []Message{
+		&ClunkRequest{Tag: 1, Fid: 1},
+		&ReadResponse{Tag: 2, Data: make([]byte, 100)},
+		&ClunkRequest{Tag: 3, Fid: 2},
+	}
+
+	var buf bytes.Buffer
+	es := &SizeStats{}
+	e := &Encoder{Protocol: NineP2000, Writer: &buf, Checksum: true, Stats: es}
+	for _, m := range msgs {
+		if err := e.WriteMessage(m); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	stats := map[string]*SizeStats{"encoder": es}
+	readers := map[string]func([]byte) io.Reader{
+		"simple": func(b []byte) io.Reader { return bytes.NewReader(b) },
+		"greedy": func(b []byte) io.Reader { return bytes.NewReader(b) },
+		"bufio":  func(b []byte) io.Reader { return bufio.NewReader(bytes.NewReader(b)) },
+	}
+	for name, r := range readers {
+		ds := &SizeStats{}
+		d := &Decoder{
+			Protocol:    NineP2000,
+			Reader:      r(buf.Bytes()),
+			MessageSize: 1024,
+			Greedy:      name == "greedy",
+			Checksum:    true,
+			Stats:       ds,
+		}
+		for range msgs {
+			if _, err := d.ReadMessage(); err != nil {
+				t.Fatalf("%s: read failed: %v", name, err)
+			}
+		}
+		stats[name] = ds
+	}
+
+	// Sizes include the header and the checksum.
+	expected := SizeSnapshot{
+		Total: []SizeBucket{{16, 2}, {128, 1}},
+		Types: map[MessageType][]SizeBucket{
+			Tclunk: {{16, 2}},
+			Rread:  {{128, 1}},
+		},
+	}
+	for name, ss := range stats {
+		if snap := ss.Snapshot(); !reflect.DeepEqual(snap, expected) {
+			t.Errorf("%s: unexpected snapshot:\n%+v\nexpected:\n%+v", name, snap, expected)
+		}
+	}
+}
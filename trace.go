@@ -0,0 +1,118 @@
+package qp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrTraceTime indicates that a message was traced with a timestamp earlier
+// than the previous message.
+var ErrTraceTime = errors.New("trace timestamp earlier than previous message")
+
+// traceEpoch is the reference for the timestamp of the first message of a
+// trace.
+var traceEpoch = time.Unix(0, 0)
+
+// TraceWriter writes messages in a compact trace format. Each message is
+// written as a uvarint holding the nanoseconds since the previous message,
+// shifted left by one with the direction in the lowest bit, followed by the
+// framed message. The first message is timed relative to the Unix epoch.
+// TraceWriter is thread safe.
+type TraceWriter struct {
+	// lock protects all fields.
+	lock    sync.Mutex
+	w       io.Writer
+	encoder Encoder
+	scratch []byte
+	last    time.Time
+}
+
+// NewTraceWriter returns a TraceWriter writing to w, encoding messages with
+// the provided protocol.
+func NewTraceWriter(w io.Writer, p Protocol) *TraceWriter {
+	return &TraceWriter{
+		w:       w,
+		encoder: Encoder{Protocol: p},
+		last:    traceEpoch,
+	}
+}
+
+// WriteTrace writes a message with its timestamp and direction to the trace.
+// Timestamps must not decrease, or ErrTraceTime is returned.
+func (tw *TraceWriter) WriteTrace(t time.Time, dir Direction, m Message) error {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	delta := t.Sub(tw.last)
+	if delta < 0 {
+		return ErrTraceTime
+	}
+
+	v := uint64(delta) << 1
+	if dir == RecordReceived {
+		v |= 1
+	}
+
+	frame, err := tw.encoder.encode(m, tw.scratch)
+	if err != nil {
+		return err
+	}
+	tw.scratch = frame
+
+	var hdr [binary.MaxVarintLen64]byte
+	if _, err = tw.w.Write(hdr[:binary.PutUvarint(hdr[:], v)]); err != nil {
+		return err
+	}
+	if _, err = tw.w.Write(frame); err != nil {
+		return err
+	}
+	tw.last = t
+	return nil
+}
+
+// TraceReader reads messages written by a TraceWriter.
+type TraceReader struct {
+	r       *bufio.Reader
+	decoder Decoder
+	last    time.Time
+}
+
+// NewTraceReader returns a TraceReader reading from r, decoding messages with
+// the provided protocol.
+func NewTraceReader(r io.Reader, p Protocol) *TraceReader {
+	br := bufio.NewReader(r)
+	return &TraceReader{
+		r:       br,
+		decoder: Decoder{Protocol: p, Reader: br},
+		last:    traceEpoch,
+	}
+}
+
+// ReadTrace reads the next message of the trace, returning its timestamp,
+// direction and the message. io.EOF is returned at the end of the trace, and
+// io.ErrUnexpectedEOF if the trace ends in the middle of a message.
+func (tr *TraceReader) ReadTrace() (time.Time, Direction, Message, error) {
+	v, err := binary.ReadUvarint(tr.r)
+	if err != nil {
+		return time.Time{}, 0, nil, err
+	}
+
+	m, err := tr.decoder.ReadMessage()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return time.Time{}, 0, nil, err
+	}
+
+	dir := RecordSent
+	if v&1 == 1 {
+		dir = RecordReceived
+	}
+	tr.last = tr.last.Add(time.Duration(v >> 1))
+	return tr.last, dir, m, nil
+}
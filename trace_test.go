@@ -0,0 +1,62 @@
+package qp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	start := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		t   time.Time
+		dir Direction
+		m   Message
+	}{
+		{start, RecordSent, &VersionRequest{Tag: NOTAG, MessageSize: 8192, Version: Version}},
+		{start.Add(150 * time.Microsecond), RecordReceived, &VersionResponse{Tag: NOTAG, MessageSize: 8192, Version: Version}},
+		{start.Add(time.Second), RecordSent, &WalkRequest{Tag: 1, Fid: 1, NewFid: 2, Names: []string{"usr", "glenda"}}},
+		{start.Add(time.Second), RecordReceived, &WalkResponse{Tag: 1, Qids: []Qid{NewQid(QTDIR, 0, 1), NewQid(QTDIR, 0, 2)}}},
+	}
+
+	var buf bytes.Buffer
+	tw := NewTraceWriter(&buf, NineP2000)
+	for i, tt := range tests {
+		if err := tw.WriteTrace(tt.t, tt.dir, tt.m); err != nil {
+			t.Fatalf("test %d: write failed: %v", i, err)
+		}
+	}
+	if err := tw.WriteTrace(start, RecordSent, &ClunkRequest{Tag: 2, Fid: 2}); err != ErrTraceTime {
+		t.Errorf("expected ErrTraceTime for earlier timestamp, got %v", err)
+	}
+
+	tr := NewTraceReader(bytes.NewReader(buf.Bytes()), NineP2000)
+	for i, tt := range tests {
+		ts, dir, m, err := tr.ReadTrace()
+		if err != nil {
+			t.Fatalf("test %d: read failed: %v", i, err)
+		}
+		if !ts.Equal(tt.t) {
+			t.Errorf("test %d: expected timestamp %v, got %v", i, tt.t, ts)
+		}
+		if dir != tt.dir {
+			t.Errorf("test %d: expected direction %c, got %c", i, tt.dir, dir)
+		}
+		if !Equal(m, tt.m) {
+			t.Errorf("test %d: unexpected message:\n%s", i, Diff(m, tt.m))
+		}
+	}
+	if _, _, _, err := tr.ReadTrace(); err != io.EOF {
+		t.Errorf("expected io.EOF at end of trace, got %v", err)
+	}
+
+	tr = NewTraceReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), NineP2000)
+	var err error
+	for err == nil {
+		_, _, _, err = tr.ReadTrace()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF for truncated trace, got %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package qp
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// fieldReader decodes the fields of a message body in order. The first field
+// that fails to decode is recorded along with its error, after which all reads
+// return zero values, so that unmarshal methods need not check for errors
+// after every field.
+type fieldReader struct {
+	b   []byte
+	off int
+
+	// maxString and maxElements limit the length of strings and lists, or are
+	// 0 for no limit. They are checked before anything is allocated.
+	maxString, maxElements int
+
+	// prefix is the path of the struct being decoded, such as "Stat", or empty
+	// for the message itself.
+	prefix string
+
+	// field is the path of the field that failed, and err the reason.
+	field string
+	err   error
+}
+
+// fieldUnmarshaler is implemented by the messages of this package, which
+// decode their fields from a fieldReader.
+type fieldUnmarshaler interface {
+	unmarshal(r *fieldReader)
+}
+
+// unmarshalFields decodes r.b into m, returning the error recorded in r. The
+// failing field is only recorded for messages implementing fieldUnmarshaler,
+// and the limits of r are not enforced for other messages.
+func unmarshalFields(m Message, r *fieldReader) error {
+	fu, ok := m.(fieldUnmarshaler)
+	if !ok {
+		r.err = m.Unmarshal(r.b)
+		return r.err
+	}
+	fu.unmarshal(r)
+	return r.err
+}
+
+// fail records err for field, or for element i of it if i is not negative,
+// unless an earlier field already failed.
+func (r *fieldReader) fail(field string, i int, err error) {
+	if r.err != nil {
+		return
+	}
+	if i >= 0 {
+		field += "[" + strconv.Itoa(i) + "]"
+	}
+	switch {
+	case r.prefix == "":
+	case field == "":
+		field = r.prefix
+	default:
+		field = r.prefix + "." + field
+	}
+	r.field, r.err = field, err
+}
+
+// nested decodes a struct named field using fn, prefixing the paths of its
+// fields with the name.
+func (r *fieldReader) nested(field string, fn func(r *fieldReader)) {
+	prefix := r.prefix
+	if prefix != "" {
+		field = prefix + "." + field
+	}
+	r.prefix = field
+	fn(r)
+	r.prefix = prefix
+}
+
+// remaining returns the amount of undecoded bytes.
+func (r *fieldReader) remaining() int {
+	return len(r.b) - r.off
+}
+
+// take consumes the next n bytes for element i of field, or returns nil if
+// they are not available.
+func (r *fieldReader) take(field string, i, n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.remaining() < n {
+		r.fail(field, i, ErrPayloadTooShort)
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *fieldReader) u8(field string) uint8 {
+	if b := r.take(field, -1, 1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *fieldReader) u16(field string) uint16 {
+	if b := r.take(field, -1, 2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *fieldReader) u32(field string) uint32 {
+	if b := r.take(field, -1, 4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *fieldReader) u64(field string) uint64 {
+	if b := r.take(field, -1, 8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *fieldReader) tag() Tag {
+	return Tag(r.u16("Tag"))
+}
+
+func (r *fieldReader) fid(field string) Fid {
+	return Fid(r.u32(field))
+}
+
+// qidAt decodes element i of a qid field.
+func (r *fieldReader) qidAt(field string, i int) Qid {
+	b := r.take(field, i, 13)
+	if b == nil {
+		return Qid{}
+	}
+	return Qid{
+		Type:    QidType(b[0]),
+		Version: binary.LittleEndian.Uint32(b[1:5]),
+		Path:    binary.LittleEndian.Uint64(b[5:13]),
+	}
+}
+
+func (r *fieldReader) qid(field string) Qid {
+	return r.qidAt(field, -1)
+}
+
+// strAt decodes element i of a string field, failing with ErrFieldTooBig if
+// it exceeds maxString.
+func (r *fieldReader) strAt(field string, i int) string {
+	b := r.take(field, i, 2)
+	if b == nil {
+		return ""
+	}
+	l := int(binary.LittleEndian.Uint16(b))
+	if r.maxString > 0 && l > r.maxString {
+		r.fail(field, i, ErrFieldTooBig)
+		return ""
+	}
+	return string(r.take(field, i, l))
+}
+
+func (r *fieldReader) str(field string) string {
+	return r.strAt(field, -1)
+}
+
+// count decodes the element count of a list field whose elements are at least
+// size bytes, failing before anything is allocated if it exceeds maxElements
+// or the remaining payload.
+func (r *fieldReader) count(field string, size int) int {
+	n := int(r.u16(field))
+	switch {
+	case r.err != nil:
+		return 0
+	case r.maxElements > 0 && n > r.maxElements:
+		r.fail(field, -1, ErrFieldTooBig)
+		return 0
+	case r.remaining() < n*size:
+		r.fail(field, -1, ErrPayloadTooShort)
+		return 0
+	}
+	return n
+}
+
+// strs decodes a list of strings, such as the names of a walk.
+func (r *fieldReader) strs(field string) []string {
+	n := r.count(field, 2)
+	if r.err != nil {
+		return nil
+	}
+	s := make([]string, n)
+	for i := range s {
+		s[i] = r.strAt(field, i)
+	}
+	return s
+}
+
+// qids decodes a list of qids.
+func (r *fieldReader) qids(field string) []Qid {
+	n := r.count(field, 13)
+	if r.err != nil {
+		return nil
+	}
+	q := make([]Qid, n)
+	for i := range q {
+		q[i] = r.qidAt(field, i)
+	}
+	return q
+}
+
+// data decodes a data field with a 4-byte count into dst, reusing its
+// capacity, as messages may be recycled.
+func (r *fieldReader) data(field string, dst []byte) []byte {
+	n := r.u32(field)
+	return append(dst[:0], r.take(field, -1, int(n))...)
+}
@@ -0,0 +1,262 @@
+package qp
+
+// Visitor dispatches messages to handlers for their concrete type, as an
+// alternative to a type switch. Handlers that are nil are skipped, in which
+// case Default is called instead, if set. Default is also called for
+// messages of types without a handler field, such as custom messages.
+type Visitor struct {
+	OnVersionRequest    func(*VersionRequest)
+	OnVersionResponse   func(*VersionResponse)
+	OnAuthRequest       func(*AuthRequest)
+	OnAuthResponse      func(*AuthResponse)
+	OnAttachRequest     func(*AttachRequest)
+	OnAttachResponse    func(*AttachResponse)
+	OnErrorResponse     func(*ErrorResponse)
+	OnFlushRequest      func(*FlushRequest)
+	OnFlushResponse     func(*FlushResponse)
+	OnWalkRequest       func(*WalkRequest)
+	OnWalkResponse      func(*WalkResponse)
+	OnOpenRequest       func(*OpenRequest)
+	OnOpenResponse      func(*OpenResponse)
+	OnCreateRequest     func(*CreateRequest)
+	OnCreateResponse    func(*CreateResponse)
+	OnReadRequest       func(*ReadRequest)
+	OnReadResponse      func(*ReadResponse)
+	OnWriteRequest      func(*WriteRequest)
+	OnWriteResponse     func(*WriteResponse)
+	OnClunkRequest      func(*ClunkRequest)
+	OnClunkResponse     func(*ClunkResponse)
+	OnRemoveRequest     func(*RemoveRequest)
+	OnRemoveResponse    func(*RemoveResponse)
+	OnStatRequest       func(*StatRequest)
+	OnStatResponse      func(*StatResponse)
+	OnWriteStatRequest  func(*WriteStatRequest)
+	OnWriteStatResponse func(*WriteStatResponse)
+
+	// 9P2000.u messages.
+	OnAuthRequestDotu      func(*AuthRequestDotu)
+	OnAttachRequestDotu    func(*AttachRequestDotu)
+	OnErrorResponseDotu    func(*ErrorResponseDotu)
+	OnCreateRequestDotu    func(*CreateRequestDotu)
+	OnStatResponseDotu     func(*StatResponseDotu)
+	OnWriteStatRequestDotu func(*WriteStatRequestDotu)
+
+	// 9P2000.e messages.
+	OnSessionRequestDote      func(*SessionRequestDote)
+	OnSessionResponseDote     func(*SessionResponseDote)
+	OnSimpleReadRequestDote   func(*SimpleReadRequestDote)
+	OnSimpleReadResponseDote  func(*SimpleReadResponseDote)
+	OnSimpleWriteRequestDote  func(*SimpleWriteRequestDote)
+	OnSimpleWriteResponseDote func(*SimpleWriteResponseDote)
+
+	// Default is called for messages without a handler.
+	Default func(Message)
+}
+
+// Dispatch calls the handler for the concrete type of m, or Default if there
+// is none. It reports whether a handler or Default was called.
+func (v *Visitor) Dispatch(m Message) bool {
+	switch m := m.(type) {
+	case *VersionRequest:
+		if v.OnVersionRequest != nil {
+			v.OnVersionRequest(m)
+			return true
+		}
+	case *VersionResponse:
+		if v.OnVersionResponse != nil {
+			v.OnVersionResponse(m)
+			return true
+		}
+	case *AuthRequest:
+		if v.OnAuthRequest != nil {
+			v.OnAuthRequest(m)
+			return true
+		}
+	case *AuthResponse:
+		if v.OnAuthResponse != nil {
+			v.OnAuthResponse(m)
+			return true
+		}
+	case *AttachRequest:
+		if v.OnAttachRequest != nil {
+			v.OnAttachRequest(m)
+			return true
+		}
+	case *AttachResponse:
+		if v.OnAttachResponse != nil {
+			v.OnAttachResponse(m)
+			return true
+		}
+	case *ErrorResponse:
+		if v.OnErrorResponse != nil {
+			v.OnErrorResponse(m)
+			return true
+		}
+	case *FlushRequest:
+		if v.OnFlushRequest != nil {
+			v.OnFlushRequest(m)
+			return true
+		}
+	case *FlushResponse:
+		if v.OnFlushResponse != nil {
+			v.OnFlushResponse(m)
+			return true
+		}
+	case *WalkRequest:
+		if v.OnWalkRequest != nil {
+			v.OnWalkRequest(m)
+			return true
+		}
+	case *WalkResponse:
+		if v.OnWalkResponse != nil {
+			v.OnWalkResponse(m)
+			return true
+		}
+	case *OpenRequest:
+		if v.OnOpenRequest != nil {
+			v.OnOpenRequest(m)
+			return true
+		}
+	case *OpenResponse:
+		if v.OnOpenResponse != nil {
+			v.OnOpenResponse(m)
+			return true
+		}
+	case *CreateRequest:
+		if v.OnCreateRequest != nil {
+			v.OnCreateRequest(m)
+			return true
+		}
+	case *CreateResponse:
+		if v.OnCreateResponse != nil {
+			v.OnCreateResponse(m)
+			return true
+		}
+	case *ReadRequest:
+		if v.OnReadRequest != nil {
+			v.OnReadRequest(m)
+			return true
+		}
+	case *ReadResponse:
+		if v.OnReadResponse != nil {
+			v.OnReadResponse(m)
+			return true
+		}
+	case *WriteRequest:
+		if v.OnWriteRequest != nil {
+			v.OnWriteRequest(m)
+			return true
+		}
+	case *WriteResponse:
+		if v.OnWriteResponse != nil {
+			v.OnWriteResponse(m)
+			return true
+		}
+	case *ClunkRequest:
+		if v.OnClunkRequest != nil {
+			v.OnClunkRequest(m)
+			return true
+		}
+	case *ClunkResponse:
+		if v.OnClunkResponse != nil {
+			v.OnClunkResponse(m)
+			return true
+		}
+	case *RemoveRequest:
+		if v.OnRemoveRequest != nil {
+			v.OnRemoveRequest(m)
+			return true
+		}
+	case *RemoveResponse:
+		if v.OnRemoveResponse != nil {
+			v.OnRemoveResponse(m)
+			return true
+		}
+	case *StatRequest:
+		if v.OnStatRequest != nil {
+			v.OnStatRequest(m)
+			return true
+		}
+	case *StatResponse:
+		if v.OnStatResponse != nil {
+			v.OnStatResponse(m)
+			return true
+		}
+	case *WriteStatRequest:
+		if v.OnWriteStatRequest != nil {
+			v.OnWriteStatRequest(m)
+			return true
+		}
+	case *WriteStatResponse:
+		if v.OnWriteStatResponse != nil {
+			v.OnWriteStatResponse(m)
+			return true
+		}
+	case *AuthRequestDotu:
+		if v.OnAuthRequestDotu != nil {
+			v.OnAuthRequestDotu(m)
+			return true
+		}
+	case *AttachRequestDotu:
+		if v.OnAttachRequestDotu != nil {
+			v.OnAttachRequestDotu(m)
+			return true
+		}
+	case *ErrorResponseDotu:
+		if v.OnErrorResponseDotu != nil {
+			v.OnErrorResponseDotu(m)
+			return true
+		}
+	case *CreateRequestDotu:
+		if v.OnCreateRequestDotu != nil {
+			v.OnCreateRequestDotu(m)
+			return true
+		}
+	case *StatResponseDotu:
+		if v.OnStatResponseDotu != nil {
+			v.OnStatResponseDotu(m)
+			return true
+		}
+	case *WriteStatRequestDotu:
+		if v.OnWriteStatRequestDotu != nil {
+			v.OnWriteStatRequestDotu(m)
+			return true
+		}
+	case *SessionRequestDote:
+		if v.OnSessionRequestDote != nil {
+			v.OnSessionRequestDote(m)
+			return true
+		}
+	case *SessionResponseDote:
+		if v.OnSessionResponseDote != nil {
+			v.OnSessionResponseDote(m)
+			return true
+		}
+	case *SimpleReadRequestDote:
+		if v.OnSimpleReadRequestDote != nil {
+			v.OnSimpleReadRequestDote(m)
+			return true
+		}
+	case *SimpleReadResponseDote:
+		if v.OnSimpleReadResponseDote != nil {
+			v.OnSimpleReadResponseDote(m)
+			return true
+		}
+	case *SimpleWriteRequestDote:
+		if v.OnSimpleWriteRequestDote != nil {
+			v.OnSimpleWriteRequestDote(m)
+			return true
+		}
+	case *SimpleWriteResponseDote:
+		if v.OnSimpleWriteResponseDote != nil {
+			v.OnSimpleWriteResponseDote(m)
+			return true
+		}
+	}
+
+	if v.Default != nil {
+		v.Default(m)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package qp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVisitor(t *testing.T) {
+	// Every handler records its field name when called.
+	var called string
+	v := &Visitor{Default: func(Message) { called = "Default" }}
+	rv := reflect.ValueOf(v).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		name := rv.Type().Field(i).Name
+		if name == "Default" {
+			continue
+		}
+		rv.Field(i).Set(reflect.MakeFunc(rv.Field(i).Type(), func([]reflect.Value) []reflect.Value {
+			called = name
+			return nil
+		}))
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range []Protocol{NineP2000, NineP2000Dotu, NineP2000Dote} {
+		for i := 0; i < 256; i++ {
+			m, err := p.Message(MessageType(i))
+			if err != nil {
+				continue
+			}
+			name := "On" + reflect.TypeOf(m).Elem().Name()
+			called = ""
+			if !v.Dispatch(m) || called != name {
+				t.Errorf("%T: expected %s to be called, got %q", m, name, called)
+			}
+			seen[name] = true
+		}
+	}
+	// Every handler field is reachable through a protocol.
+	if len(seen) != rv.NumField()-1 {
+		t.Errorf("expected %d handlers to be called, got %d", rv.NumField()-1, len(seen))
+	}
+
+	called = ""
+	if !v.Dispatch(&rawMessage{}) || called != "Default" {
+		t.Errorf("expected Default for unknown message, got %q", called)
+	}
+
+	// A nil handler falls back to Default.
+	v.OnWalkRequest = nil
+	called = ""
+	if !v.Dispatch(&WalkRequest{}) || called != "Default" {
+		t.Errorf("expected Default for nil handler, got %q", called)
+	}
+
+	v.Default = nil
+	if v.Dispatch(&WalkRequest{}) {
+		t.Errorf("expected no handler to be called")
+	}
+}